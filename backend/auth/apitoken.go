@@ -0,0 +1,5 @@
+package auth
+
+// APITokenPrefix starts every personal API token, which tells them apart
+// from JWTs and makes leaked tokens easy to find with secret scanners.
+const APITokenPrefix = "mmtm_pat_"
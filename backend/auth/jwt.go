@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// AccessTokenTTL is how long an access token is valid. Clients renew it with
+// their refresh token.
+const AccessTokenTTL = 15 * time.Minute
+
+var ErrInvalidClaims = errors.New("invalid token claims")
+
+// Claims are the claims carried by an access token.
+type Claims struct {
+	UserID    int `json:"user_id"`
+	SessionID int `json:"sid"`
+	jwt.RegisteredClaims
+}
+
+// IssueAccessToken signs a short-lived access token bound to a session with
+// the active signing key.
+func IssueAccessToken(userID, sessionID int) (string, time.Time, error) {
+	if keys == nil {
+		return "", time.Time{}, ErrNotConfigured
+	}
+
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(AccessTokenTTL)
+	claims := Claims{
+		UserID:    userID,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        hex.EncodeToString(jti),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+
+	token := jwt.NewWithClaims(keys.signing.method, claims)
+	token.Header["kid"] = keys.signing.id
+	signed, err := token.SignedString(keys.signing.sign)
+	return signed, expiresAt, err
+}
+
+// ParseAccessToken verifies an access token's signature and expiry and
+// returns its claims.
+func ParseAccessToken(tokenString string) (*Claims, error) {
+	if keys == nil {
+		return nil, ErrNotConfigured
+	}
+
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, keys.keyFunc)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, jwt.ErrTokenSignatureInvalid
+	}
+
+	if claims.UserID == 0 || claims.SessionID == 0 || claims.ExpiresAt == nil {
+		return nil, ErrInvalidClaims
+	}
+	return claims, nil
+}
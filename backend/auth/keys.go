@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// minSecretLength is the minimum length of an HS256 secret in bytes.
+const minSecretLength = 32
+
+// defaultKeyID identifies the key configured through JWT_SECRET. Tokens
+// without a kid header are verified with it.
+const defaultKeyID = "default"
+
+var ErrNotConfigured = errors.New("signing keys not configured")
+
+// placeholderSecrets are example values from docs and old code that must
+// never be used as real secrets.
+var placeholderSecrets = map[string]bool{
+	"your-secret-key":                  true,
+	"your-jwt-secret":                  true,
+	"your-super-secure-jwt-secret-key": true,
+}
+
+type signingKey struct {
+	id     string
+	method jwt.SigningMethod
+	sign   interface{} // nil for verify-only keys
+	verify interface{}
+}
+
+type keySet struct {
+	signing *signingKey
+	keys    map[string]*signingKey
+}
+
+var keys *keySet
+
+// Configure loads signing keys from the environment and must succeed before
+// tokens can be issued or verified:
+//
+//   - JWT_SECRET: an HS256 secret of at least 32 bytes, with key ID "default"
+//   - JWT_SECRETS: more HS256 secrets as "kid:secret,kid:secret"
+//   - JWT_KEY_FILES: PEM key files as "kid:/path/key.pem,...". RSA keys use
+//     RS256 and Ed25519 keys use EdDSA; public keys only verify tokens.
+//   - JWT_SIGNING_KEY_ID: the key that signs new tokens. It defaults to the
+//     only configured private key or secret, or to "default".
+//
+// Keeping a retired key configured while signing with a new one lets existing
+// tokens keep working until they expire.
+func Configure() error {
+	set := &keySet{keys: make(map[string]*signingKey)}
+
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		if err := set.addSecret(defaultKeyID, secret); err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range splitList(os.Getenv("JWT_SECRETS")) {
+		kid, secret, ok := strings.Cut(entry, ":")
+		if !ok || kid == "" {
+			return fmt.Errorf("JWT_SECRETS: expected kid:secret, got %q", entry)
+		}
+		if err := set.addSecret(kid, secret); err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range splitList(os.Getenv("JWT_KEY_FILES")) {
+		kid, path, ok := strings.Cut(entry, ":")
+		if !ok || kid == "" || path == "" {
+			return fmt.Errorf("JWT_KEY_FILES: expected kid:path, got %q", entry)
+		}
+		if err := set.addKeyFile(kid, path); err != nil {
+			return err
+		}
+	}
+
+	if len(set.keys) == 0 {
+		return fmt.Errorf("no JWT signing key configured: set JWT_SECRET to a random value of at least %d bytes", minSecretLength)
+	}
+
+	signingID := os.Getenv("JWT_SIGNING_KEY_ID")
+	if signingID == "" {
+		signingID = set.defaultSigningID()
+	}
+	key, ok := set.keys[signingID]
+	if !ok {
+		return fmt.Errorf("JWT_SIGNING_KEY_ID %q does not match a configured key", signingID)
+	}
+	if key.sign == nil {
+		return fmt.Errorf("JWT signing key %q is a public key and cannot sign tokens", signingID)
+	}
+	set.signing = key
+
+	keys = set
+	return nil
+}
+
+func (s *keySet) add(key *signingKey) error {
+	if _, exists := s.keys[key.id]; exists {
+		return fmt.Errorf("duplicate JWT key ID %q", key.id)
+	}
+	s.keys[key.id] = key
+	return nil
+}
+
+func (s *keySet) addSecret(kid, secret string) error {
+	if placeholderSecrets[secret] {
+		return fmt.Errorf("JWT key %q uses a placeholder secret", kid)
+	}
+	if len(secret) < minSecretLength {
+		return fmt.Errorf("JWT key %q is too short: secrets must be at least %d bytes", kid, minSecretLength)
+	}
+	return s.add(&signingKey{id: kid, method: jwt.SigningMethodHS256, sign: []byte(secret), verify: []byte(secret)})
+}
+
+func (s *keySet) addKeyFile(kid, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("JWT key %q: %v", kid, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return fmt.Errorf("JWT key %q: %s is not a PEM file", kid, path)
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return fmt.Errorf("JWT key %q: unsupported PEM block %q", kid, block.Type)
+	}
+	if err != nil {
+		return fmt.Errorf("JWT key %q: %v", kid, err)
+	}
+
+	key := &signingKey{id: kid}
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.method, key.sign, key.verify = jwt.SigningMethodRS256, k, &k.PublicKey
+	case *rsa.PublicKey:
+		key.method, key.verify = jwt.SigningMethodRS256, k
+	case ed25519.PrivateKey:
+		key.method, key.sign, key.verify = jwt.SigningMethodEdDSA, k, k.Public()
+	case ed25519.PublicKey:
+		key.method, key.verify = jwt.SigningMethodEdDSA, crypto.PublicKey(k)
+	default:
+		return fmt.Errorf("JWT key %q: only RSA and Ed25519 keys are supported", kid)
+	}
+	if rsaKey, ok := key.verify.(*rsa.PublicKey); ok && rsaKey.N.BitLen() < 2048 {
+		return fmt.Errorf("JWT key %q: RSA keys must be at least 2048 bits", kid)
+	}
+	return s.add(key)
+}
+
+func (s *keySet) defaultSigningID() string {
+	if _, ok := s.keys[defaultKeyID]; ok {
+		return defaultKeyID
+	}
+	var only string
+	for id, key := range s.keys {
+		if key.sign != nil {
+			if only != "" {
+				return "" // ambiguous: JWT_SIGNING_KEY_ID must be set
+			}
+			only = id
+		}
+	}
+	return only
+}
+
+// keyFunc picks the verification key named by the token's kid header and
+// makes sure the token uses that key's algorithm.
+func (s *keySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		kid = defaultKeyID
+	}
+	key, ok := s.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID %q", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, jwt.ErrSignatureInvalid
+	}
+	return key.verify, nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -8,7 +8,9 @@ import (
 	_ "github.com/lib/pq"
 )
 
-func InitDB() (*sql.DB, error) {
+// ConnString builds the Postgres connection string from the DB_*
+// environment variables.
+func ConnString() string {
 	dbHost := os.Getenv("DB_HOST")
 	dbPort := os.Getenv("DB_PORT")
 	dbUser := os.Getenv("DB_USER")
@@ -26,10 +28,12 @@ func InitDB() (*sql.DB, error) {
 		dbSSLMode = "disable"
 	}
 
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+	return fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
 		dbHost, dbPort, dbUser, dbPassword, dbName, dbSSLMode)
+}
 
-	db, err := sql.Open("postgres", connStr)
+func InitDB() (*sql.DB, error) {
+	db, err := sql.Open("postgres", ConnString())
 	if err != nil {
 		return nil, err
 	}
@@ -89,7 +93,265 @@ func createTables(db *sql.DB) error {
 		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 	);`
 
-	tables := []string{usersTable, tasksTable, moodLogsTable}
+	// Task dependencies table: task_id cannot start until depends_on_id is completed
+	taskDependenciesTable := `
+	CREATE TABLE IF NOT EXISTS task_dependencies (
+		task_id INTEGER REFERENCES tasks(id) ON DELETE CASCADE,
+		depends_on_id INTEGER REFERENCES tasks(id) ON DELETE CASCADE,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (task_id, depends_on_id),
+		CHECK (task_id <> depends_on_id)
+	);`
+
+	// Calendar feed tokens table: one revocable token per user, stored hashed
+	calendarFeedsTable := `
+	CREATE TABLE IF NOT EXISTS calendar_feeds (
+		user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+		token_hash VARCHAR(64) UNIQUE NOT NULL,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	// Sessions table: one row per login, holding the hashed rotating refresh token
+	sessionsTable := `
+	CREATE TABLE IF NOT EXISTS sessions (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+		refresh_token_hash VARCHAR(64) UNIQUE NOT NULL,
+		previous_token_hash VARCHAR(64),
+		expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+		revoked_at TIMESTAMP WITH TIME ZONE,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	// User identities table: links a user to an account at an OIDC provider
+	userIdentitiesTable := `
+	CREATE TABLE IF NOT EXISTS user_identities (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+		issuer VARCHAR(255) NOT NULL,
+		subject VARCHAR(255) NOT NULL,
+		email VARCHAR(255) NOT NULL DEFAULT '',
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (issuer, subject)
+	);`
+
+	// OIDC login requests table: state, nonce and PKCE verifier of logins in progress
+	oidcLoginRequestsTable := `
+	CREATE TABLE IF NOT EXISTS oidc_login_requests (
+		state_hash VARCHAR(64) PRIMARY KEY,
+		nonce VARCHAR(255) NOT NULL,
+		code_verifier VARCHAR(255) NOT NULL,
+		expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+	);`
+
+	// Stream tickets table: hashed single-use tickets that open an event stream
+	streamTicketsTable := `
+	CREATE TABLE IF NOT EXISTS stream_tickets (
+		ticket_hash VARCHAR(64) PRIMARY KEY,
+		user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+		session_id INTEGER REFERENCES sessions(id) ON DELETE CASCADE,
+		expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+	);`
+
+	// User tokens table: hashed single-use tokens for email verification and password resets
+	userTokensTable := `
+	CREATE TABLE IF NOT EXISTS user_tokens (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+		purpose VARCHAR(32) NOT NULL,
+		token_hash VARCHAR(64) UNIQUE NOT NULL,
+		expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+		used_at TIMESTAMP WITH TIME ZONE,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	// Rate limit tables: token buckets and failure lockouts shared between instances
+	rateLimitBucketsTable := `
+	CREATE TABLE IF NOT EXISTS rate_limit_buckets (
+		key VARCHAR(255) PRIMARY KEY,
+		tokens DOUBLE PRECISION NOT NULL,
+		updated_at TIMESTAMP WITH TIME ZONE NOT NULL
+	);`
+
+	rateLimitLockoutsTable := `
+	CREATE TABLE IF NOT EXISTS rate_limit_lockouts (
+		key VARCHAR(255) PRIMARY KEY,
+		failures INTEGER NOT NULL DEFAULT 0,
+		last_failure_at TIMESTAMP WITH TIME ZONE,
+		locked_until TIMESTAMP WITH TIME ZONE
+	);`
+
+	// TOTP table: the user's authenticator secret; enabled once a code has been confirmed
+	userTOTPTable := `
+	CREATE TABLE IF NOT EXISTS user_totp (
+		user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+		secret TEXT NOT NULL,
+		enabled_at TIMESTAMP WITH TIME ZONE,
+		last_step BIGINT NOT NULL DEFAULT 0,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	// Recovery codes table: hashed single-use 2FA backup codes
+	userRecoveryCodesTable := `
+	CREATE TABLE IF NOT EXISTS user_recovery_codes (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+		code_hash VARCHAR(64) NOT NULL,
+		used_at TIMESTAMP WITH TIME ZONE,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	// API tokens table: hashed personal access tokens with space-separated scopes
+	apiTokensTable := `
+	CREATE TABLE IF NOT EXISTS api_tokens (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+		name VARCHAR(100) NOT NULL,
+		token_hash VARCHAR(64) UNIQUE NOT NULL,
+		token_prefix VARCHAR(20) NOT NULL,
+		scopes TEXT NOT NULL,
+		expires_at TIMESTAMP WITH TIME ZONE,
+		last_used_at TIMESTAMP WITH TIME ZONE,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	// Workspaces table: a shared board whose tasks are visible to its members
+	workspacesTable := `
+	CREATE TABLE IF NOT EXISTS workspaces (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR(100) NOT NULL,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	// Workspace members table: who belongs to a workspace and with which role
+	workspaceMembersTable := `
+	CREATE TABLE IF NOT EXISTS workspace_members (
+		workspace_id INTEGER REFERENCES workspaces(id) ON DELETE CASCADE,
+		user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+		role VARCHAR(10) NOT NULL CHECK (role IN ('owner', 'editor', 'viewer')),
+		share_mood BOOLEAN NOT NULL DEFAULT false,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (workspace_id, user_id)
+	);`
+
+	// Task comments table: threaded discussion on a task. Deleted comments
+	// with replies stay as placeholders; content is encrypted at rest
+	taskCommentsTable := `
+	CREATE TABLE IF NOT EXISTS task_comments (
+		id SERIAL PRIMARY KEY,
+		task_id INTEGER NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+		parent_id INTEGER REFERENCES task_comments(id) ON DELETE CASCADE,
+		user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+		content TEXT NOT NULL,
+		edited_at TIMESTAMP WITH TIME ZONE,
+		deleted_at TIMESTAMP WITH TIME ZONE,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	// Comment mentions table: users @mentioned in a comment
+	taskCommentMentionsTable := `
+	CREATE TABLE IF NOT EXISTS task_comment_mentions (
+		comment_id INTEGER REFERENCES task_comments(id) ON DELETE CASCADE,
+		user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+		PRIMARY KEY (comment_id, user_id)
+	);`
+
+	// Notifications table: messages for a user about things that happened to their tasks
+	notificationsTable := `
+	CREATE TABLE IF NOT EXISTS notifications (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		type VARCHAR(32) NOT NULL,
+		message TEXT NOT NULL,
+		task_id INTEGER REFERENCES tasks(id) ON DELETE CASCADE,
+		comment_id INTEGER REFERENCES task_comments(id) ON DELETE CASCADE,
+		actor_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+		read_at TIMESTAMP WITH TIME ZONE,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	// Job runs table: one row per run of a background job
+	jobRunsTable := `
+	CREATE TABLE IF NOT EXISTS job_runs (
+		id SERIAL PRIMARY KEY,
+		job VARCHAR(64) NOT NULL,
+		instance VARCHAR(255) NOT NULL DEFAULT '',
+		status VARCHAR(16) NOT NULL CHECK (status IN ('running', 'succeeded', 'failed')),
+		result TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT '',
+		started_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		finished_at TIMESTAMP WITH TIME ZONE
+	);`
+
+	// Webhooks table: user-registered endpoints and the events they receive
+	webhooksTable := `
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		events TEXT NOT NULL,
+		active BOOLEAN NOT NULL DEFAULT true,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	// Webhook deliveries table: the outbox of events to send, kept as the delivery log
+	webhookDeliveriesTable := `
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id SERIAL PRIMARY KEY,
+		webhook_id INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+		event VARCHAR(64) NOT NULL,
+		payload TEXT NOT NULL,
+		status VARCHAR(16) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'delivered', 'failed')),
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		last_attempt_at TIMESTAMP WITH TIME ZONE,
+		response_status INTEGER,
+		last_error TEXT NOT NULL DEFAULT '',
+		delivered_at TIMESTAMP WITH TIME ZONE,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	// Time entries table: time tracked on tasks, with a timer or by hand. An
+	// entry without ended_at is a running timer.
+	timeEntriesTable := `
+	CREATE TABLE IF NOT EXISTS time_entries (
+		id SERIAL PRIMARY KEY,
+		task_id INTEGER NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+		user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+		started_at TIMESTAMP WITH TIME ZONE NOT NULL,
+		ended_at TIMESTAMP WITH TIME ZONE CHECK (ended_at >= started_at),
+		note TEXT NOT NULL DEFAULT '',
+		source VARCHAR(10) NOT NULL CHECK (source IN ('timer', 'manual')),
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	// Focus sessions table: focused work on a task. Paused time is kept out;
+	// a session may end with a mood check-in, stored as a mood log
+	focusSessionsTable := `
+	CREATE TABLE IF NOT EXISTS focus_sessions (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		task_id INTEGER REFERENCES tasks(id) ON DELETE SET NULL,
+		planned_minutes INTEGER NOT NULL CHECK (planned_minutes >= 5 AND planned_minutes <= 180),
+		status VARCHAR(20) NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'paused', 'completed', 'interrupted')),
+		start_mood VARCHAR(20) NOT NULL DEFAULT '',
+		started_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		paused_at TIMESTAMP WITH TIME ZONE,
+		paused_seconds INTEGER NOT NULL DEFAULT 0,
+		ended_at TIMESTAMP WITH TIME ZONE,
+		mood_log_id INTEGER REFERENCES mood_logs(id) ON DELETE SET NULL,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	tables := []string{usersTable, workspacesTable, workspaceMembersTable, tasksTable, moodLogsTable,
+		taskDependenciesTable, calendarFeedsTable, sessionsTable, userIdentitiesTable, oidcLoginRequestsTable,
+		streamTicketsTable, userTokensTable, rateLimitBucketsTable, rateLimitLockoutsTable, userTOTPTable, userRecoveryCodesTable,
+		apiTokensTable, taskCommentsTable, taskCommentMentionsTable, notificationsTable,
+		jobRunsTable, webhooksTable, webhookDeliveriesTable, timeEntriesTable,
+		focusSessionsTable}
 
 	for _, table := range tables {
 		if _, err := db.Exec(table); err != nil {
@@ -97,5 +359,49 @@ func createTables(db *sql.DB) error {
 		}
 	}
 
+	// Columns added after the initial schema, applied to existing databases
+	migrations := []string{
+		`ALTER TABLE tasks ADD COLUMN IF NOT EXISTS recurrence_rule TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE tasks ADD COLUMN IF NOT EXISTS occurrence INTEGER NOT NULL DEFAULT 1`,
+		`ALTER TABLE tasks ADD COLUMN IF NOT EXISTS recurrence_parent_id INTEGER UNIQUE REFERENCES tasks(id) ON DELETE SET NULL`,
+		`ALTER TABLE sessions ADD COLUMN IF NOT EXISTS user_agent TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE sessions ADD COLUMN IF NOT EXISTS ip VARCHAR(64) NOT NULL DEFAULT ''`,
+		`ALTER TABLE sessions ADD COLUMN IF NOT EXISTS last_used_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMP WITH TIME ZONE`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP WITH TIME ZONE`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS purge_after TIMESTAMP WITH TIME ZONE`,
+		`ALTER TABLE tasks ADD COLUMN IF NOT EXISTS workspace_id INTEGER REFERENCES workspaces(id) ON DELETE CASCADE`,
+		`ALTER TABLE tasks ADD COLUMN IF NOT EXISTS assignee_id INTEGER REFERENCES users(id) ON DELETE SET NULL`,
+		`ALTER TABLE notifications ADD COLUMN IF NOT EXISTS dedupe_key VARCHAR(100)`,
+		`ALTER TABLE tasks ADD COLUMN IF NOT EXISTS overdue BOOLEAN NOT NULL DEFAULT false`,
+		`ALTER TABLE tasks ADD COLUMN IF NOT EXISTS estimated_minutes INTEGER CHECK (estimated_minutes >= 1 AND estimated_minutes <= 1440)`,
+		`ALTER TABLE workspace_members ADD COLUMN IF NOT EXISTS share_mood BOOLEAN NOT NULL DEFAULT false`,
+		`ALTER TABLE mood_logs ADD COLUMN IF NOT EXISTS source VARCHAR(10) NOT NULL DEFAULT 'analysis' CHECK (source IN ('analysis', 'check_in'))`,
+		// Encrypted secrets don't fit the original VARCHAR(64)
+		`ALTER TABLE user_totp ALTER COLUMN secret TYPE TEXT`,
+	}
+
+	for _, migration := range migrations {
+		if _, err := db.Exec(migration); err != nil {
+			return err
+		}
+	}
+
+	// Indexes queries rely on, also created on existing databases
+	indexes := []string{
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_notifications_dedupe_key ON notifications(user_id, dedupe_key)`,
+		`CREATE INDEX IF NOT EXISTS idx_notifications_user_id_id ON notifications(user_id, id)`,
+		`CREATE INDEX IF NOT EXISTS idx_time_entries_task_id ON time_entries(task_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_time_entries_user_id_started_at ON time_entries(user_id, started_at)`,
+		// A user has at most one running timer
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_time_entries_running ON time_entries(user_id) WHERE ended_at IS NULL`,
+	}
+
+	for _, index := range indexes {
+		if _, err := db.Exec(index); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
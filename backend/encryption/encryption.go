@@ -0,0 +1,295 @@
+// Package encryption protects sensitive columns with envelope encryption.
+// Each value is sealed with its own random data key, and the data key is
+// sealed with a versioned master key. Rotating the master key only requires
+// rewrapping data keys, and a value names the master key it needs.
+//
+// Encrypted values start with "enc:v1:" and are bound to their column and
+// row. Plaintext that happens to start with "enc:" is stored behind
+// "enc:plain:", so user text can never pass for ciphertext. Anything else is
+// plaintext.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// tag starts every value this package has to tell apart from plaintext
+	tag = "enc:"
+	// prefix marks encrypted values
+	prefix = tag + "v1:"
+	// plainPrefix escapes plaintext that starts with tag
+	plainPrefix = tag + "plain:"
+)
+
+const keySize = 32 // AES-256
+
+var (
+	ErrNotConfigured = errors.New("encryption keys not configured")
+	ErrUnknownKey    = errors.New("value was encrypted with an unknown key")
+	ErrMalformed     = errors.New("malformed encrypted value")
+)
+
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+type keyRing struct {
+	active string
+	keys   map[string]cipher.AEAD
+}
+
+var ring *keyRing
+
+// Configure loads master keys from the environment:
+//
+//   - ENCRYPTION_KEYS: base64-encoded 32-byte keys as "kid:key,kid:key"
+//   - ENCRYPTION_KEY_FILE: a file with more keys in the same format, one or
+//     more per line
+//   - ENCRYPTION_ACTIVE_KEY: the key that encrypts new values. It defaults
+//     to the only configured key.
+//
+// Without any keys values are stored as plaintext and Enabled reports false.
+// Retired keys must stay configured until ReencryptData has moved every
+// value to the active key.
+func Configure() error {
+	entries := splitList(os.Getenv("ENCRYPTION_KEYS"))
+	if path := os.Getenv("ENCRYPTION_KEY_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("ENCRYPTION_KEY_FILE: %w", err)
+		}
+		entries = append(entries, splitList(strings.ReplaceAll(string(data), "\n", ","))...)
+	}
+
+	r := &keyRing{keys: make(map[string]cipher.AEAD)}
+	for _, entry := range entries {
+		kid, encoded, ok := strings.Cut(entry, ":")
+		if !ok || !keyIDPattern.MatchString(kid) {
+			return fmt.Errorf("encryption keys: expected kid:base64key with a kid of letters, digits, - or _, got %q", redact(entry))
+		}
+		if _, exists := r.keys[kid]; exists {
+			return fmt.Errorf("duplicate encryption key ID %q", kid)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != keySize {
+			return fmt.Errorf("encryption key %q must be %d bytes of base64", kid, keySize)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return err
+		}
+		r.keys[kid] = aead
+	}
+
+	if len(r.keys) == 0 {
+		if os.Getenv("ENCRYPTION_ACTIVE_KEY") != "" {
+			return fmt.Errorf("ENCRYPTION_ACTIVE_KEY is set but no encryption keys are configured")
+		}
+		ring = nil
+		return nil
+	}
+
+	r.active = os.Getenv("ENCRYPTION_ACTIVE_KEY")
+	if r.active == "" {
+		if len(r.keys) > 1 {
+			return fmt.Errorf("ENCRYPTION_ACTIVE_KEY is required when several encryption keys are configured")
+		}
+		for kid := range r.keys {
+			r.active = kid
+		}
+	}
+	if _, ok := r.keys[r.active]; !ok {
+		return fmt.Errorf("ENCRYPTION_ACTIVE_KEY %q does not match a configured key", r.active)
+	}
+
+	ring = r
+	return nil
+}
+
+// Enabled reports whether new values are encrypted.
+func Enabled() bool {
+	return ring != nil
+}
+
+// ActiveKeyID returns the ID of the key that encrypts new values.
+func ActiveKeyID() string {
+	if ring == nil {
+		return ""
+	}
+	return ring.active
+}
+
+// ActivePrefix is the prefix shared by all values encrypted with the active
+// key, so stale values can be found in SQL.
+func ActivePrefix() string {
+	return prefix + ActiveKeyID() + ":"
+}
+
+// Encrypt seals plaintext stored in row rowID of field, a "table.column".
+// Both go into the associated data, so the value can't be moved to another
+// column or row. Empty strings stay empty and, without keys, plaintext is
+// returned unchanged unless it has to be escaped.
+func Encrypt(plaintext, field string, rowID int) (string, error) {
+	if plaintext == "" {
+		return plaintext, nil
+	}
+	if ring == nil {
+		if strings.HasPrefix(plaintext, tag) {
+			return plainPrefix + plaintext, nil
+		}
+		return plaintext, nil
+	}
+
+	dataKey := make([]byte, keySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	sealedKey, err := seal(ring.keys[ring.active], dataKey, []byte(ring.active))
+	if err != nil {
+		return "", err
+	}
+	sealedData, err := seal(dataAEAD, []byte(plaintext), []byte(rowAssociatedData(field, rowID)))
+	if err != nil {
+		return "", err
+	}
+
+	return prefix + ring.active + ":" +
+		base64.RawStdEncoding.EncodeToString(sealedKey) + ":" +
+		base64.RawStdEncoding.EncodeToString(sealedData), nil
+}
+
+// Decrypt opens a value produced by Encrypt for the same field and row.
+// Plaintext values are returned unchanged, including values that look like
+// ciphertext but don't parse as such, which can only be legacy user text.
+func Decrypt(value, field string, rowID int) (string, error) {
+	if strings.HasPrefix(value, plainPrefix) {
+		return strings.TrimPrefix(value, plainPrefix), nil
+	}
+	v, ok := parse(value)
+	if !ok {
+		return value, nil
+	}
+	if ring == nil {
+		return "", ErrNotConfigured
+	}
+
+	master, ok := ring.keys[v.keyID]
+	if !ok {
+		return "", fmt.Errorf("%w %q", ErrUnknownKey, v.keyID)
+	}
+	dataKey, err := open(master, v.sealedKey, []byte(v.keyID))
+	if err != nil {
+		return "", err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(dataAEAD, v.sealedData, []byte(rowAssociatedData(field, rowID)))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// IsEncrypted reports whether a stored value was produced by Encrypt with
+// keys configured.
+func IsEncrypted(value string) bool {
+	_, ok := parse(value)
+	return ok
+}
+
+// sealedValue is a parsed encrypted value.
+type sealedValue struct {
+	keyID      string
+	sealedKey  []byte
+	sealedData []byte
+}
+
+// parse splits an encrypted value into its parts, reporting false for
+// anything that isn't one.
+func parse(value string) (sealedValue, bool) {
+	var v sealedValue
+	rest, ok := strings.CutPrefix(value, prefix)
+	if !ok {
+		return v, false
+	}
+
+	parts := strings.Split(rest, ":")
+	if len(parts) != 3 || !keyIDPattern.MatchString(parts[0]) {
+		return v, false
+	}
+	var err error
+	if v.sealedKey, err = base64.RawStdEncoding.DecodeString(parts[1]); err != nil {
+		return v, false
+	}
+	if v.sealedData, err = base64.RawStdEncoding.DecodeString(parts[2]); err != nil {
+		return v, false
+	}
+	v.keyID = parts[0]
+	return v, true
+}
+
+func rowAssociatedData(field string, rowID int) string {
+	return field + "#" + strconv.Itoa(rowID)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal returns the nonce followed by the ciphertext.
+func seal(aead cipher.AEAD, plaintext, associatedData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, associatedData), nil
+}
+
+func open(aead cipher.AEAD, sealed, associatedData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrMalformed
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, associatedData)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting value: %w", err)
+	}
+	return plaintext, nil
+}
+
+// redact hides the key material of a malformed entry in error messages.
+func redact(entry string) string {
+	if kid, _, ok := strings.Cut(entry, ":"); ok {
+		return kid + ":..."
+	}
+	return "..."
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,184 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testKey returns a fixed master key for kid, so a key ID means the same key
+// every time it is configured.
+func testKey(kid string) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte(kid[:1]), keySize))
+}
+
+// useKeys configures the test keys kids, encrypting new values with active.
+// Without kids encryption is disabled.
+func useKeys(t *testing.T, active string, kids ...string) {
+	t.Helper()
+	var entries []string
+	for _, kid := range kids {
+		entries = append(entries, kid+":"+testKey(kid))
+	}
+	t.Setenv("ENCRYPTION_KEYS", strings.Join(entries, ","))
+	t.Setenv("ENCRYPTION_KEY_FILE", "")
+	t.Setenv("ENCRYPTION_ACTIVE_KEY", active)
+	if err := Configure(); err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	t.Cleanup(func() { ring = nil })
+}
+
+func TestRoundTrip(t *testing.T) {
+	useKeys(t, "a", "a")
+
+	tests := []struct {
+		name      string
+		plaintext string
+	}{
+		{"text", "Feeling great today"},
+		{"unicode", "Ünïcödé ✓ 😀"},
+		{"looks like ciphertext", "enc:v1:a:b:c"},
+		{"multiline", "first line\nsecond line"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sealed, err := Encrypt(tt.plaintext, "tasks.notes", 7)
+			if err != nil {
+				t.Fatalf("Encrypt: %v", err)
+			}
+			if !strings.HasPrefix(sealed, ActivePrefix()) || !IsEncrypted(sealed) {
+				t.Errorf("Encrypt = %q, want a value starting with %q", sealed, ActivePrefix())
+			}
+			if strings.Contains(sealed, tt.plaintext) {
+				t.Errorf("Encrypt = %q contains the plaintext", sealed)
+			}
+			got, err := Decrypt(sealed, "tasks.notes", 7)
+			if err != nil || got != tt.plaintext {
+				t.Errorf("Decrypt = %q, %v, want %q", got, err, tt.plaintext)
+			}
+		})
+	}
+
+	sealed, err := Encrypt("", "tasks.notes", 7)
+	if err != nil || sealed != "" {
+		t.Errorf("Encrypt of an empty string = %q, %v, want it empty", sealed, err)
+	}
+}
+
+func TestBoundToFieldAndRow(t *testing.T) {
+	useKeys(t, "a", "a")
+
+	sealed, err := Encrypt("private note", "tasks.notes", 1)
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		field string
+		rowID int
+	}{
+		{"other row", "tasks.notes", 2},
+		{"other field", "tasks.description", 1},
+		{"other field and row", "mood_logs.text_input", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := Decrypt(sealed, tt.field, tt.rowID); err == nil {
+				t.Errorf("Decrypt = %q, want an error", got)
+			}
+		})
+	}
+}
+
+func TestPlaintextEscaping(t *testing.T) {
+	tests := []struct {
+		name      string
+		plaintext string
+		stored    string
+	}{
+		{"ordinary text", "hello", "hello"},
+		{"looks like ciphertext", "enc:v1:a:b:c", "enc:plain:enc:v1:a:b:c"},
+		{"looks escaped", "enc:plain:hello", "enc:plain:enc:plain:hello"},
+		{"bare tag", "enc:", "enc:plain:enc:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useKeys(t, "")
+			stored, err := Encrypt(tt.plaintext, "tasks.notes", 1)
+			if err != nil || stored != tt.stored {
+				t.Fatalf("Encrypt = %q, %v, want %q", stored, err, tt.stored)
+			}
+			if IsEncrypted(stored) {
+				t.Errorf("IsEncrypted(%q) = true", stored)
+			}
+
+			// Escaped values read back the same once keys are configured
+			useKeys(t, "a", "a")
+			got, err := Decrypt(stored, "tasks.notes", 1)
+			if err != nil || got != tt.plaintext {
+				t.Errorf("Decrypt = %q, %v, want %q", got, err, tt.plaintext)
+			}
+		})
+	}
+}
+
+func TestLegacyPlaintextThatLooksEncrypted(t *testing.T) {
+	useKeys(t, "a", "a")
+
+	// Written before escaping existed, but doesn't parse as ciphertext
+	for _, value := range []string{"enc:v1:", "enc:v1:a:not base64:x", "enc:v2:a:AAAA:AAAA"} {
+		got, err := Decrypt(value, "tasks.notes", 1)
+		if err != nil || got != value {
+			t.Errorf("Decrypt(%q) = %q, %v, want it unchanged", value, got, err)
+		}
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	useKeys(t, "a", "a")
+	old, err := Encrypt("rotate me", "mood_logs.text_input", 3)
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+
+	useKeys(t, "b", "a", "b")
+	if strings.HasPrefix(old, ActivePrefix()) {
+		t.Errorf("%q already has the new active prefix %q", old, ActivePrefix())
+	}
+	got, err := Decrypt(old, "mood_logs.text_input", 3)
+	if err != nil || got != "rotate me" {
+		t.Fatalf("Decrypt with the old key still configured = %q, %v", got, err)
+	}
+	rotated, err := Encrypt(got, "mood_logs.text_input", 3)
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	if !strings.HasPrefix(rotated, "enc:v1:b:") {
+		t.Errorf("Encrypt = %q, want it sealed with key b", rotated)
+	}
+
+	useKeys(t, "b", "b")
+	if _, err := Decrypt(old, "mood_logs.text_input", 3); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Decrypt after removing key a = %v, want ErrUnknownKey", err)
+	}
+	if got, err := Decrypt(rotated, "mood_logs.text_input", 3); err != nil || got != "rotate me" {
+		t.Errorf("Decrypt of the rotated value = %q, %v", got, err)
+	}
+}
+
+func TestDecryptWithoutKeys(t *testing.T) {
+	useKeys(t, "a", "a")
+	sealed, err := Encrypt("secret", "tasks.notes", 1)
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+
+	useKeys(t, "")
+	if _, err := Decrypt(sealed, "tasks.notes", 1); !errors.Is(err, ErrNotConfigured) {
+		t.Errorf("Decrypt = %v, want ErrNotConfigured", err)
+	}
+}
@@ -0,0 +1,105 @@
+// Package events is a small in-process publish/subscribe bus. Code that
+// changes tasks publishes what happened; features that react to it, such as
+// notifications, subscribe without the publishers knowing about them.
+package events
+
+import (
+	"log"
+	"sync"
+
+	"mmtm/models"
+)
+
+// Event types.
+const (
+	// TaskCreated, TaskUpdated and TaskDeleted carry the task as it was
+	// saved, or as it was before deletion. TaskUpdated also carries the task
+	// as it was before the update in Before
+	TaskCreated = "task.created"
+	TaskUpdated = "task.updated"
+	TaskDeleted = "task.deleted"
+	// TaskCompleted is published when a task's status changes to Completed,
+	// along with TaskUpdated
+	TaskCompleted = "task.completed"
+	// TasksReorganized carries the order a reorganize request returned to
+	// the actor in Tasks, and the mood it was for
+	TasksReorganized = "tasks.reorganized"
+	// MoodAnalyzed carries the new mood log in MoodLog, without its text
+	MoodAnalyzed = "mood.analyzed"
+	// NotificationCreated carries a notification that was just stored
+	NotificationCreated = "notification.created"
+	// TaskAssigned is published when a task gets a new assignee
+	TaskAssigned = "task.assigned"
+	// CommentMention is published when a comment mentions users who weren't
+	// mentioned in it before; they are listed in UserIDs
+	CommentMention = "comment.mention"
+	// TaskDueSoon, TaskOverdue and TaskAtRisk are published by the periodic
+	// due date check
+	TaskDueSoon = "task.due_soon"
+	TaskOverdue = "task.overdue"
+	TaskAtRisk  = "task.at_risk"
+	// DailyDigest carries a user's daily summary in Digest
+	DailyDigest = "daily.digest"
+)
+
+type Event struct {
+	Type string
+	// ActorID is the user who caused the event, 0 for the system
+	ActorID      int
+	Task         models.Task
+	Before       *models.Task
+	Tasks        []models.Task
+	Mood         string
+	CommentID    int
+	UserIDs      []int
+	Notification models.Notification
+	Digest       models.Digest
+	MoodLog      models.MoodLog
+}
+
+// Handler reacts to an event. Errors are logged; they never reach the
+// publisher.
+type Handler func(Event) error
+
+type Bus struct {
+	mu       sync.RWMutex
+	handlers map[string][]Handler
+}
+
+func NewBus() *Bus {
+	return &Bus{handlers: make(map[string][]Handler)}
+}
+
+// Subscribe registers handler for events of the given type.
+func (b *Bus) Subscribe(eventType string, handler Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[eventType] = append(b.handlers[eventType], handler)
+}
+
+// Publish runs the handlers subscribed to the event's type in the order they
+// subscribed. Publish only after the change the event describes is
+// committed. Publishing on a nil bus does nothing.
+func (b *Bus) Publish(event Event) {
+	if b == nil {
+		return
+	}
+	b.mu.RLock()
+	handlers := b.handlers[event.Type]
+	b.mu.RUnlock()
+
+	for _, handler := range handlers {
+		run(handler, event)
+	}
+}
+
+func run(handler Handler, event Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Event handler for %s panicked: %v", event.Type, r)
+		}
+	}()
+	if err := handler(event); err != nil {
+		log.Printf("Event handler for %s failed: %v", event.Type, err)
+	}
+}
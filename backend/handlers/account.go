@@ -0,0 +1,259 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+
+	"mmtm/mail"
+	"mmtm/models"
+)
+
+// recentLoginWindow is how fresh the session of an account without a
+// password must be to delete the account, standing in for re-entering the
+// password.
+const recentLoginWindow = 15 * time.Minute
+
+// DeleteAccount deletes the current user after re-confirming the password.
+// With a grace period the account is only deactivated and can be restored
+// by logging in with "restore": true until it is purged.
+func (h *UserHandler) DeleteAccount(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var req models.DeleteAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user models.User
+	err := h.db.QueryRow("SELECT id, username, email, password_hash FROM users WHERE id = $1", userID).Scan(
+		&user.ID, &user.Username, &user.Email, &user.PasswordHash)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if user.PasswordHash != "" {
+		if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)) != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid password"})
+			return
+		}
+	} else {
+		// Single sign-on accounts re-authenticate by logging in again
+		var loggedInAt time.Time
+		err := h.db.QueryRow("SELECT created_at FROM sessions WHERE id = $1", c.GetInt("session_id")).Scan(&loggedInAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if time.Since(loggedInAt) > recentLoginWindow {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Please sign in again before deleting your account"})
+			return
+		}
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	if h.deletionGrace == 0 {
+		if err := purgeAccount(tx, userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account"})
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Account deleted"})
+		return
+	}
+
+	purgeAfter := time.Now().Add(h.deletionGrace)
+	_, err = tx.Exec(`
+		UPDATE users SET deleted_at = CURRENT_TIMESTAMP, purge_after = $1
+		WHERE id = $2`, purgeAfter, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account"})
+		return
+	}
+
+	// Nothing may keep using the account while it waits to be purged
+	cleanup := []string{
+		"UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND revoked_at IS NULL",
+		"UPDATE user_tokens SET used_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND used_at IS NULL",
+		"DELETE FROM api_tokens WHERE user_id = $1",
+		"DELETE FROM calendar_feeds WHERE user_id = $1",
+		"DELETE FROM webhooks WHERE user_id = $1",
+		"UPDATE time_entries SET ended_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND ended_at IS NULL",
+		`UPDATE focus_sessions SET status = 'interrupted', ended_at = CURRENT_TIMESTAMP,
+			paused_seconds = paused_seconds + COALESCE(EXTRACT(EPOCH FROM CURRENT_TIMESTAMP - paused_at)::integer, 0),
+			paused_at = NULL
+		WHERE user_id = $1 AND status IN ('active', 'paused')`,
+	}
+	for _, query := range cleanup {
+		if _, err := tx.Exec(query, userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account"})
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account"})
+		return
+	}
+
+	deliver(h.mailer, mail.Message{
+		To:      user.Email,
+		Subject: "Your account is scheduled for deletion",
+		Body: fmt.Sprintf("Hi %s,\n\nYour mmtm account and all its data will be erased on %s.\n\n"+
+			"Changed your mind? Log in before then and choose to restore your account.\n",
+			user.Username, purgeAfter.UTC().Format("January 2, 2006 15:04 MST")),
+	})
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Account scheduled for deletion", "purgeAfter": purgeAfter})
+}
+
+// checkDeletedAccount lets a login go ahead unless the account is waiting to
+// be purged. Such logins restore the account when the client asked for it;
+// otherwise they are answered with 403.
+func checkDeletedAccount(c *gin.Context, q queryRower, userID int, restore bool) bool {
+	var purgeAfter time.Time
+	err := q.QueryRow("SELECT purge_after FROM users WHERE id = $1 AND deleted_at IS NOT NULL", userID).Scan(&purgeAfter)
+	if err == sql.ErrNoRows {
+		return true
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+
+	if !restore {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error":      "Account is scheduled for deletion. Log in with \"restore\": true to restore it",
+			"purgeAfter": purgeAfter,
+		})
+		return false
+	}
+
+	err = q.QueryRow(`
+		UPDATE users SET deleted_at = NULL, purge_after = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 RETURNING id`, userID).Scan(&userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore account"})
+		return false
+	}
+	return true
+}
+
+// purgeAccount erases a user for good. Mood logs are deleted explicitly
+// because their free text is the most sensitive data we hold; everything
+// else goes with the user row's cascades, except shared workspaces, which
+// are handed over to the remaining members. Rate limiter state keyed by the
+// user's email or ID is removed too.
+func purgeAccount(tx *sql.Tx, userID int) error {
+	var email string
+	if err := tx.QueryRow("SELECT email FROM users WHERE id = $1 FOR UPDATE", userID).Scan(&email); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM mood_logs WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+
+	if err := handOverWorkspaces(tx, userID); err != nil {
+		return err
+	}
+
+	// Comments on shared tasks outlive the author, but not their content
+	_, err := tx.Exec(`
+		UPDATE task_comments SET content = '', deleted_at = COALESCE(deleted_at, CURRENT_TIMESTAMP)
+		WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	// Time tracked on shared tasks still counts towards them; its notes go
+	_, err = tx.Exec("UPDATE time_entries SET note = '' WHERE user_id = $1", userID)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range []string{"rate_limit_buckets", "rate_limit_lockouts"} {
+		_, err := tx.Exec(`DELETE FROM `+table+` WHERE key = $1 OR key LIKE '%:user:' || $2`,
+			loginAccountKey(email), fmt.Sprint(userID))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("DELETE FROM users WHERE id = $1", userID)
+	return err
+}
+
+// PurgeDeletedAccounts erases every account whose deletion grace period is
+// over and returns how many were purged.
+func PurgeDeletedAccounts(db *sql.DB) (int, error) {
+	rows, err := db.Query("SELECT id FROM users WHERE deleted_at IS NOT NULL AND purge_after <= NOW()")
+	if err != nil {
+		return 0, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, id := range ids {
+		tx, err := db.Begin()
+		if err != nil {
+			return purged, err
+		}
+		// The account may have been restored since it was selected
+		var due bool
+		err = tx.QueryRow(`
+			SELECT deleted_at IS NOT NULL AND purge_after <= NOW() FROM users
+			WHERE id = $1 FOR UPDATE`, id).Scan(&due)
+		if err == nil && due {
+			err = purgeAccount(tx, id)
+		}
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to purge user %d: %v", id, err)
+			continue
+		}
+		if due {
+			purged++
+		}
+	}
+	return purged, nil
+}
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"mmtm/auth"
+	"mmtm/models"
+)
+
+// ListAPITokens returns the user's personal API tokens without the secrets.
+func (h *UserHandler) ListAPITokens(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	rows, err := h.db.Query(`
+		SELECT id, name, token_prefix, scopes, created_at, last_used_at, expires_at
+		FROM api_tokens WHERE user_id = $1
+		ORDER BY created_at DESC`, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch API tokens"})
+		return
+	}
+	defer rows.Close()
+
+	tokens := []models.APIToken{}
+	for rows.Next() {
+		var token models.APIToken
+		var scopes string
+		if err := rows.Scan(&token.ID, &token.Name, &token.Prefix, &scopes, &token.CreatedAt,
+			&token.LastUsedAt, &token.ExpiresAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan API token"})
+			return
+		}
+		token.Scopes = strings.Fields(scopes)
+		tokens = append(tokens, token)
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+// CreateAPIToken issues a scoped personal API token. The token is returned
+// once; only its hash is stored.
+func (h *UserHandler) CreateAPIToken(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var req models.CreateAPITokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	secret, err := generateToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	token := auth.APITokenPrefix + secret
+
+	scopes := dedupeScopes(req.Scopes)
+	var expiresAt *time.Time
+	if req.ExpiresInDays != nil {
+		t := time.Now().AddDate(0, 0, *req.ExpiresInDays)
+		expiresAt = &t
+	}
+
+	resp := models.CreateAPITokenResponse{Token: token}
+	err = h.db.QueryRow(`
+		INSERT INTO api_tokens (user_id, name, token_hash, token_prefix, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, name, token_prefix, created_at, last_used_at, expires_at`,
+		userID, req.Name, hashToken(token), token[:len(auth.APITokenPrefix)+4],
+		strings.Join(scopes, " "), expiresAt).Scan(
+		&resp.ID, &resp.Name, &resp.Prefix, &resp.CreatedAt, &resp.LastUsedAt, &resp.ExpiresAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API token"})
+		return
+	}
+	resp.Scopes = scopes
+
+	c.JSON(http.StatusCreated, resp)
+}
+
+// DeleteAPIToken revokes a personal API token.
+func (h *UserHandler) DeleteAPIToken(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	tokenID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid token ID"})
+		return
+	}
+
+	result, err := h.db.Exec("DELETE FROM api_tokens WHERE id = $1 AND user_id = $2", tokenID, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete API token"})
+		return
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check deletion"})
+		return
+	}
+
+	if rowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API token not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "API token revoked successfully"})
+}
+
+func dedupeScopes(scopes []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, scope := range scopes {
+		if !seen[scope] {
+			seen[scope] = true
+			unique = append(unique, scope)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
@@ -2,23 +2,26 @@ package handlers
 
 import (
 	"database/sql"
+	"log"
 	"net/http"
-	"os"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 
+	"mmtm/mail"
 	"mmtm/models"
+	"mmtm/ratelimit"
 )
 
 type AuthHandler struct {
-	db *sql.DB
+	db      *sql.DB
+	mailer  mail.Mailer
+	limiter ratelimit.Limiter
 }
 
-func NewAuthHandler(db *sql.DB) *AuthHandler {
-	return &AuthHandler{db: db}
+func NewAuthHandler(db *sql.DB, mailer mail.Mailer, limiter ratelimit.Limiter) *AuthHandler {
+	return &AuthHandler{db: db, mailer: mailer, limiter: limiter}
 }
 
 func (h *AuthHandler) Register(c *gin.Context) {
@@ -50,27 +53,32 @@ func (h *AuthHandler) Register(c *gin.Context) {
 
 	// Create user
 	var user models.User
-	err = h.db.QueryRow(`
+	err = scanUser(h.db.QueryRow(`
 		INSERT INTO users (username, email, password_hash) 
 		VALUES ($1, $2, $3) 
-		RETURNING id, username, email, created_at, updated_at`,
-		req.Username, req.Email, string(hashedPassword)).Scan(
-		&user.ID, &user.Username, &user.Email, &user.CreatedAt, &user.UpdatedAt)
+		RETURNING `+userColumns,
+		req.Username, req.Email, string(hashedPassword)), &user)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
 		return
 	}
 
-	// Generate JWT token
-	token, err := generateJWT(user.ID)
+	if err := sendVerificationEmail(h.db, h.mailer, user); err != nil {
+		log.Printf("Failed to send verification email to user %d: %v", user.ID, err)
+	}
+
+	// Start a session
+	tokens, err := createSession(c, h.db, user.ID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
 
 	c.JSON(http.StatusCreated, models.AuthResponse{
-		Token: token,
-		User:  user,
+		Token:        tokens.Token,
+		ExpiresAt:    tokens.ExpiresAt,
+		RefreshToken: tokens.RefreshToken,
+		User:         user,
 	})
 }
 
@@ -81,15 +89,23 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		return
 	}
 
+	ctx := c.Request.Context()
+	ip := c.ClientIP()
+	if wait := h.loginBlocked(ctx, ip, req.Email); wait > 0 {
+		tooManyAttempts(c, wait)
+		return
+	}
+
 	// Get user from database
 	var user models.User
 	err := h.db.QueryRow(`
-		SELECT id, username, email, password_hash, created_at, updated_at 
+		SELECT id, username, email, email_verified_at, password_hash, created_at, updated_at 
 		FROM users WHERE email = $1`, req.Email).Scan(
-		&user.ID, &user.Username, &user.Email, &user.PasswordHash, 
+		&user.ID, &user.Username, &user.Email, &user.EmailVerifiedAt, &user.PasswordHash, 
 		&user.CreatedAt, &user.UpdatedAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
+			h.loginFailed(ctx, ip, req.Email)
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 			return
 		}
@@ -99,35 +115,48 @@ func (h *AuthHandler) Login(c *gin.Context) {
 
 	// Check password
 	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
+		h.loginFailed(ctx, ip, req.Email)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
+	h.loginSucceeded(ctx, req.Email)
 
-	// Generate JWT token
-	token, err := generateJWT(user.ID)
+	// With 2FA the password only earns a challenge for POST /auth/2fa/verify,
+	// which also decides on restoring a deleted account
+	enabled, err := twoFactorEnabled(h.db, user.ID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if enabled {
+		challenge, err := issueUserToken(h.db, user.ID, purposeLoginChallenge, loginChallengeTTL)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+			return
+		}
+		c.JSON(http.StatusOK, models.TwoFactorChallengeResponse{
+			TwoFactorRequired: true,
+			ChallengeToken:    challenge,
+			ExpiresAt:         time.Now().Add(loginChallengeTTL),
+		})
 		return
 	}
 
-	c.JSON(http.StatusOK, models.AuthResponse{
-		Token: token,
-		User:  user,
-	})
-}
-
-func generateJWT(userID int) (string, error) {
-	claims := jwt.MapClaims{
-		"user_id": userID,
-		"exp":     time.Now().Add(time.Hour * 24 * 7).Unix(), // 7 days
+	if !checkDeletedAccount(c, h.db, user.ID, req.Restore) {
+		return
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		secret = "your-secret-key" // Use a secure secret in production
+	// Start a session
+	tokens, err := createSession(c, h.db, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
 	}
-	
-	return token.SignedString([]byte(secret))
+
+	c.JSON(http.StatusOK, models.AuthResponse{
+		Token:        tokens.Token,
+		ExpiresAt:    tokens.ExpiresAt,
+		RefreshToken: tokens.RefreshToken,
+		User:         user,
+	})
 }
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+
+	"mmtm/events"
+	"mmtm/models"
+)
+
+// BulkTasks applies a batch of create, update and delete operations in one
+// transaction. In "atomic" mode (the default) nothing is committed unless
+// every operation succeeds; in "best_effort" mode failed operations are rolled
+// back individually and the rest are committed. Every operation is attempted
+// either way so the response reports all errors at once.
+func (h *TaskHandler) BulkTasks(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var req models.BulkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = "atomic"
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	response := models.BulkResponse{Mode: req.Mode, Results: make([]models.BulkResult, len(req.Operations))}
+	var pending []events.Event
+	for i, op := range req.Operations {
+		result := models.BulkResult{Index: i, Op: op.Op, ID: op.ID}
+
+		// A savepoint per operation keeps one failure from aborting the transaction
+		if _, err := tx.Exec("SAVEPOINT bulk_operation"); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		// Keep the task as it was before an update to tell what changed
+		var before *models.Task
+		if op.Op == "update" && op.ID > 0 {
+			if before, err = loadTask(tx, op.ID); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+				return
+			}
+		}
+
+		task, err := applyBulkOperation(tx, userID, op)
+		if err != nil {
+			if _, rbErr := tx.Exec("ROLLBACK TO SAVEPOINT bulk_operation"); rbErr != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+				return
+			}
+			result.Status = "error"
+			result.Error = err.Error()
+			response.Failed++
+		} else {
+			if _, err := tx.Exec("RELEASE SAVEPOINT bulk_operation"); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+				return
+			}
+			result.Status = "ok"
+			if task != nil {
+				result.ID = task.ID
+				if op.Op != "delete" {
+					result.Task = task
+				}
+				if op.Op == "delete" {
+					pending = append(pending, events.Event{Type: events.TaskDeleted, ActorID: userID, Task: *task})
+				} else {
+					pending = append(pending, taskEvents(userID, before, *task)...)
+				}
+			}
+			response.Succeeded++
+		}
+		response.Results[i] = result
+	}
+
+	if req.Mode == "atomic" && response.Failed > 0 {
+		for i := range response.Results {
+			if response.Results[i].Status == "ok" {
+				response.Results[i].Status = "rolled_back"
+				response.Results[i].Task = nil
+			}
+		}
+		response.Succeeded = 0
+		c.JSON(http.StatusUnprocessableEntity, response)
+		return
+	}
+
+	if err := enqueueWebhooks(tx, pending); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to apply operations"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to apply operations"})
+		return
+	}
+
+	for _, event := range pending {
+		h.bus.Publish(event)
+	}
+
+	response.Committed = true
+	c.JSON(http.StatusOK, response)
+}
+
+// applyBulkOperation validates and runs a single operation and returns the
+// task it created, updated or deleted. Errors are returned as messages
+// suitable for the per-item result.
+func applyBulkOperation(tx *sql.Tx, userID int, op models.BulkOperation) (*models.Task, error) {
+	switch op.Op {
+	case "create":
+		if op.Task == nil {
+			return nil, fmt.Errorf("task is required for create")
+		}
+		req := *op.Task
+		if err := binding.Validator.ValidateStruct(&req); err != nil {
+			return nil, err
+		}
+		recurrenceRule, err := normalizeRecurrenceRule(req.RecurrenceRule)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid recurrence rule: %v", err)
+		}
+		req.RecurrenceRule = recurrenceRule
+
+		task, err := insertTask(tx, userID, req)
+		if err != nil {
+			if isTaskAccessError(err) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("Failed to create task")
+		}
+		return &task, nil
+
+	case "update":
+		if op.ID <= 0 {
+			return nil, fmt.Errorf("id is required for update")
+		}
+		if op.Patch == nil {
+			return nil, fmt.Errorf("patch is required for update")
+		}
+		patch := *op.Patch
+		if err := binding.Validator.ValidateStruct(&patch); err != nil {
+			return nil, err
+		}
+		if err := normalizeTaskUpdate(&patch); err != nil {
+			return nil, err
+		}
+
+		task, err := updateTask(tx, userID, op.ID, patch)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return nil, fmt.Errorf("Task not found")
+			}
+			if isTaskAccessError(err) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("Failed to update task")
+		}
+		return &task, nil
+
+	case "delete":
+		if op.ID <= 0 {
+			return nil, fmt.Errorf("id is required for delete")
+		}
+		deleted, err := deleteTask(tx, userID, op.ID)
+		if err != nil {
+			if isTaskAccessError(err) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("Failed to delete task")
+		}
+		if deleted == nil {
+			return nil, fmt.Errorf("Task not found")
+		}
+		return deleted, nil
+	}
+
+	return nil, fmt.Errorf("unknown operation %q", op.Op)
+}
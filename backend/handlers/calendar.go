@@ -0,0 +1,398 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+
+	"mmtm/events"
+	"mmtm/ical"
+	"mmtm/models"
+)
+
+// maxICSUploadSize limits the size of an uploaded .ics file.
+const maxICSUploadSize = 5 << 20
+
+type CalendarHandler struct {
+	db  *sql.DB
+	bus *events.Bus
+}
+
+func NewCalendarHandler(db *sql.DB, bus *events.Bus) *CalendarHandler {
+	return &CalendarHandler{db: db, bus: bus}
+}
+
+// CreateFeedToken issues a new calendar feed token, replacing any previous
+// one. The token is only returned once.
+func (h *CalendarHandler) CreateFeedToken(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	token, err := generateToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	var createdAt time.Time
+	err = h.db.QueryRow(`
+		INSERT INTO calendar_feeds (user_id, token_hash)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET token_hash = EXCLUDED.token_hash, created_at = CURRENT_TIMESTAMP
+		RETURNING created_at`, userID, hashToken(token)).Scan(&createdAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create feed token"})
+		return
+	}
+
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+
+	c.JSON(http.StatusCreated, models.CalendarFeedResponse{
+		Token:     token,
+		URL:       fmt.Sprintf("%s://%s/api/calendar.ics?token=%s", scheme, c.Request.Host, token),
+		CreatedAt: createdAt,
+	})
+}
+
+func (h *CalendarHandler) RevokeFeedToken(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	result, err := h.db.Exec("DELETE FROM calendar_feeds WHERE user_id = $1", userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke feed token"})
+		return
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check deletion"})
+		return
+	}
+
+	if rowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No calendar feed token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Calendar feed token revoked"})
+}
+
+// Feed renders the user's tasks as an iCalendar feed. Calendar clients can't
+// send an Authorization header, so the feed is authenticated by its token.
+// Tasks are rendered as VTODO, or as VEVENT with ?component=event for clients
+// that don't show to-dos.
+func (h *CalendarHandler) Feed(c *gin.Context) {
+	token := c.Query("token")
+	if token == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Feed token required"})
+		return
+	}
+
+	var userID int
+	err := h.db.QueryRow("SELECT user_id FROM calendar_feeds WHERE token_hash = $1",
+		hashToken(token)).Scan(&userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid feed token"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT `+taskColumns+`
+		FROM tasks WHERE `+visibleTasks("", "$1")+` ORDER BY due_date`, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tasks"})
+		return
+	}
+	defer rows.Close()
+
+	asEvents := c.Query("component") == "event"
+
+	cal := &ical.Component{Name: "VCALENDAR"}
+	cal.Add("VERSION", "2.0")
+	cal.Add("PRODID", "-//spaciery//mmtm//EN")
+	cal.Add("CALSCALE", "GREGORIAN")
+	cal.AddText("X-WR-CALNAME", "mmtm tasks")
+
+	for rows.Next() {
+		var task models.Task
+		if err := scanTask(rows, &task); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan task"})
+			return
+		}
+		cal.Components = append(cal.Components, taskComponent(task, asEvents))
+	}
+
+	c.Header("Content-Type", "text/calendar; charset=utf-8")
+	c.Header("Content-Disposition", `inline; filename="mmtm.ics"`)
+	c.Status(http.StatusOK)
+	if err := cal.Encode(c.Writer); err != nil {
+		c.Error(err)
+	}
+}
+
+var icsPriority = map[string]string{"High": "1", "Medium": "5", "Low": "9"}
+
+var icsStatus = map[string]string{
+	"Todo":        "NEEDS-ACTION",
+	"In Progress": "IN-PROCESS",
+	"Completed":   "COMPLETED",
+}
+
+func taskComponent(task models.Task, asEvent bool) *ical.Component {
+	comp := &ical.Component{Name: "VTODO"}
+	if asEvent {
+		comp.Name = "VEVENT"
+	}
+
+	comp.Add("UID", fmt.Sprintf("task-%d@mmtm", task.ID))
+	comp.Add("DTSTAMP", ical.FormatTime(task.UpdatedAt))
+	comp.Add("CREATED", ical.FormatTime(task.CreatedAt))
+	comp.Add("LAST-MODIFIED", ical.FormatTime(task.UpdatedAt))
+	comp.AddText("SUMMARY", task.Title)
+	if task.Description != "" {
+		comp.AddText("DESCRIPTION", task.Description)
+	}
+	if task.Notes != "" {
+		comp.AddText("COMMENT", task.Notes)
+	}
+	comp.AddText("CATEGORIES", task.Category)
+	comp.Add("PRIORITY", icsPriority[task.Priority])
+
+	if asEvent {
+		comp.Add("DTSTART", ical.FormatTime(task.DueDate))
+		comp.Add("DURATION", "PT30M")
+	} else {
+		comp.Add("DUE", ical.FormatTime(task.DueDate))
+		comp.Add("STATUS", icsStatus[task.Status])
+		comp.Add("PERCENT-COMPLETE", strconv.Itoa(task.Progress))
+	}
+	if task.RecurrenceRule != "" {
+		comp.Add("RRULE", task.RecurrenceRule)
+	}
+
+	// mmtm-specific fields so an exported feed imports back losslessly
+	comp.Add("X-MMTM-IMPORTANCE", strconv.Itoa(task.Importance))
+	comp.Add("X-MMTM-REORGANIZABLE", strconv.FormatBool(task.Reorganizable))
+	comp.Add("X-MMTM-STRICT", strconv.FormatBool(task.Strict))
+	return comp
+}
+
+// ImportICS creates tasks from the VTODO and VEVENT components of an uploaded
+// .ics file, sent either as the "file" form field or as the raw request body.
+// Components that don't map onto a valid task, or fail to save, are reported
+// and skipped.
+func (h *CalendarHandler) ImportICS(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxICSUploadSize)
+
+	var body io.Reader = c.Request.Body
+	if strings.HasPrefix(c.ContentType(), "multipart/form-data") {
+		fileHeader, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+			return
+		}
+		file, err := fileHeader.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read file"})
+			return
+		}
+		defer file.Close()
+		body = file
+	}
+
+	cal, err := ical.Parse(body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid iCalendar file: " + err.Error()})
+		return
+	}
+	if cal.Name != "VCALENDAR" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid iCalendar file: missing VCALENDAR"})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	response := models.ICSImportResponse{Tasks: []models.Task{}, Errors: []models.ImportError{}}
+	var pending []events.Event
+	index := 0
+	for _, comp := range cal.Components {
+		if comp.Name != "VTODO" && comp.Name != "VEVENT" {
+			continue
+		}
+		index++
+
+		req, err := taskRequestFromComponent(comp)
+		if err == nil {
+			err = binding.Validator.ValidateStruct(&req)
+		}
+		if err != nil {
+			response.Errors = append(response.Errors, models.ImportError{
+				Index: index, UID: comp.Text("UID"), Error: err.Error(),
+			})
+			continue
+		}
+
+		// A savepoint per component keeps one failure from aborting the transaction
+		if _, err := tx.Exec("SAVEPOINT ics_component"); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		task, err := insertTask(tx, userID, req)
+		if err != nil {
+			if _, rbErr := tx.Exec("ROLLBACK TO SAVEPOINT ics_component"); rbErr != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+				return
+			}
+			message := "Failed to create task"
+			if isTaskAccessError(err) {
+				message = err.Error()
+			}
+			response.Errors = append(response.Errors, models.ImportError{
+				Index: index, UID: comp.Text("UID"), Error: message,
+			})
+			continue
+		}
+		if _, err := tx.Exec("RELEASE SAVEPOINT ics_component"); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		response.Tasks = append(response.Tasks, task)
+		pending = append(pending, taskEvents(userID, nil, task)...)
+	}
+
+	if err := enqueueWebhooks(tx, pending); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to import tasks"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to import tasks"})
+		return
+	}
+
+	for _, event := range pending {
+		h.bus.Publish(event)
+	}
+
+	response.Imported = len(response.Tasks)
+	c.JSON(http.StatusOK, response)
+}
+
+// taskRequestFromComponent maps an iCalendar VTODO or VEVENT onto a task.
+func taskRequestFromComponent(comp *ical.Component) (models.CreateTaskRequest, error) {
+	req := models.CreateTaskRequest{
+		Title:         comp.Text("SUMMARY"),
+		Description:   comp.Text("DESCRIPTION"),
+		Notes:         comp.Text("COMMENT"),
+		Category:      "Imported",
+		Priority:      "Medium",
+		Status:        "Todo",
+		Reorganizable: true,
+	}
+
+	due := comp.Get("DUE")
+	if due == nil {
+		due = comp.Get("DTSTART")
+	}
+	if due == nil {
+		return req, fmt.Errorf("missing DUE or DTSTART")
+	}
+	dueDate, err := due.ParseTime()
+	if err != nil {
+		return req, err
+	}
+	req.DueDate = dueDate
+
+	if categories := comp.Get("CATEGORIES"); categories != nil {
+		if first := splitTextList(categories.Value)[0]; first != "" {
+			req.Category = first
+		}
+	}
+
+	if p, err := strconv.Atoi(comp.Text("PRIORITY")); err == nil {
+		switch {
+		case p >= 1 && p <= 4:
+			req.Priority = "High"
+		case p >= 6 && p <= 9:
+			req.Priority = "Low"
+		}
+	}
+
+	switch comp.Text("STATUS") {
+	case "IN-PROCESS":
+		req.Status = "In Progress"
+	case "COMPLETED":
+		req.Status = "Completed"
+	case "CANCELLED":
+		return req, fmt.Errorf("cancelled items are not imported")
+	}
+	if comp.Get("COMPLETED") != nil {
+		req.Status = "Completed"
+	}
+
+	if percent, err := strconv.Atoi(comp.Text("PERCENT-COMPLETE")); err == nil {
+		req.Progress = percent
+	}
+	if req.Status == "Completed" {
+		req.Progress = 100
+	}
+
+	importance := map[string]int{"High": 8, "Medium": 5, "Low": 3}[req.Priority]
+	if v, err := strconv.Atoi(comp.Text("X-MMTM-IMPORTANCE")); err == nil {
+		importance = v
+	}
+	req.Importance = importance
+
+	if v, err := strconv.ParseBool(comp.Text("X-MMTM-REORGANIZABLE")); err == nil {
+		req.Reorganizable = v
+	}
+	if v, err := strconv.ParseBool(comp.Text("X-MMTM-STRICT")); err == nil {
+		req.Strict = v
+	}
+
+	if rrule := comp.Get("RRULE"); rrule != nil {
+		rule, err := normalizeRecurrenceRule(rrule.Value)
+		if err != nil {
+			return req, fmt.Errorf("unsupported RRULE: %v", err)
+		}
+		req.RecurrenceRule = rule
+	}
+
+	return req, nil
+}
+
+// splitTextList splits a comma-separated TEXT list, honouring escaped commas.
+func splitTextList(value string) []string {
+	var items []string
+	start := 0
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' {
+			i++
+			continue
+		}
+		if value[i] == ',' {
+			items = append(items, ical.Unescape(value[start:i]))
+			start = i + 1
+		}
+	}
+	return append(items, ical.Unescape(value[start:]))
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"mmtm/ical"
+	"mmtm/models"
+)
+
+// TestFeedImportsBack checks that a task exported to the feed imports back
+// as the same task.
+func TestFeedImportsBack(t *testing.T) {
+	task := models.Task{
+		ID:             12,
+		Title:          "Pay rent, then call; landlord",
+		Description:    "Line one\nLine two with a \\ backslash",
+		Notes:          "Ünïcödé notes",
+		Category:       "Home, chores",
+		Priority:       "High",
+		Status:         "In Progress",
+		DueDate:        time.Date(2024, time.March, 15, 14, 30, 0, 0, time.UTC),
+		Importance:     9,
+		Progress:       40,
+		Reorganizable:  false,
+		Strict:         true,
+		RecurrenceRule: "FREQ=WEEKLY;BYDAY=MO,TH",
+		CreatedAt:      time.Date(2024, time.March, 1, 8, 0, 0, 0, time.UTC),
+		UpdatedAt:      time.Date(2024, time.March, 2, 8, 0, 0, 0, time.UTC),
+	}
+
+	for _, asEvent := range []bool{false, true} {
+		cal := &ical.Component{Name: "VCALENDAR", Components: []*ical.Component{taskComponent(task, asEvent)}}
+		var buf bytes.Buffer
+		if err := cal.Encode(&buf); err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+		parsed, err := ical.Parse(&buf)
+		if err != nil {
+			t.Fatalf("Parse: %v", err)
+		}
+
+		req, err := taskRequestFromComponent(parsed.Components[0])
+		if err != nil {
+			t.Fatalf("taskRequestFromComponent: %v", err)
+		}
+		want := models.CreateTaskRequest{
+			Title:          task.Title,
+			Description:    task.Description,
+			Notes:          task.Notes,
+			Category:       task.Category,
+			Priority:       task.Priority,
+			Status:         task.Status,
+			DueDate:        task.DueDate,
+			Importance:     task.Importance,
+			Progress:       task.Progress,
+			Reorganizable:  task.Reorganizable,
+			Strict:         task.Strict,
+			RecurrenceRule: task.RecurrenceRule,
+		}
+		if asEvent {
+			// Events carry no status or progress
+			want.Status, want.Progress = "Todo", 0
+		}
+		if req.DueDate.Equal(want.DueDate) {
+			want.DueDate = req.DueDate
+		}
+		if !reflect.DeepEqual(req, want) {
+			t.Errorf("asEvent=%v: imported %+v, want %+v", asEvent, req, want)
+		}
+	}
+}
@@ -0,0 +1,463 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"mmtm/encryption"
+	"mmtm/events"
+	"mmtm/models"
+)
+
+// maxMentions caps the users one comment can notify.
+const maxMentions = 20
+
+var (
+	mentionPattern = regexp.MustCompile(`(?:^|[^A-Za-z0-9_.@])@([A-Za-z0-9_.-]+)`)
+	// Mentions inside code are examples, not mentions
+	codeBlockPattern  = regexp.MustCompile("(?s)```.*?```")
+	inlineCodePattern = regexp.MustCompile("`[^`\n]*`")
+)
+
+// parseMentions returns the distinct usernames @mentioned in Markdown
+// content, in order of appearance, ignoring code.
+func parseMentions(content string) []string {
+	content = codeBlockPattern.ReplaceAllString(content, "")
+	content = inlineCodePattern.ReplaceAllString(content, "")
+
+	seen := make(map[string]bool)
+	var names []string
+	for _, match := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		name := strings.TrimRight(match[1], ".-")
+		if len(name) < 3 || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+		if len(names) == maxMentions {
+			break
+		}
+	}
+	return names
+}
+
+// resolveMentions looks up mentioned users who can see the task. Mentions
+// of anyone else are ignored.
+func resolveMentions(tx *sql.Tx, taskID int, names []string) (map[int]string, error) {
+	users := make(map[int]string)
+	if len(names) == 0 {
+		return users, nil
+	}
+
+	args := []interface{}{taskID}
+	placeholders := make([]string, len(names))
+	for i, name := range names {
+		args = append(args, name)
+		placeholders[i] = "$" + strconv.Itoa(i+2)
+	}
+
+	rows, err := tx.Query(`
+		SELECT u.id, u.username
+		FROM users u
+		JOIN tasks t ON t.id = $1
+		WHERE u.username IN (`+strings.Join(placeholders, ", ")+`) AND u.deleted_at IS NULL
+		  AND `+visibleTasks("t.", "u.id"), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var username string
+		if err := rows.Scan(&id, &username); err != nil {
+			return nil, err
+		}
+		users[id] = username
+	}
+	return users, rows.Err()
+}
+
+// saveMentions records the users mentioned in a comment. Users who are no
+// longer mentioned are forgotten, but their notifications stay. If the
+// comment newly mentions anyone besides its author, it returns the event to
+// publish once the comment is committed.
+func saveMentions(tx *sql.Tx, authorID int, comment models.TaskComment) ([]string, *events.Event, error) {
+	mentioned, err := resolveMentions(tx, comment.TaskID, parseMentions(comment.Content))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	existing := make(map[int]bool)
+	rows, err := tx.Query("SELECT user_id FROM task_comment_mentions WHERE comment_id = $1", comment.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		existing[userID] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	for userID := range existing {
+		if _, ok := mentioned[userID]; !ok {
+			_, err := tx.Exec("DELETE FROM task_comment_mentions WHERE comment_id = $1 AND user_id = $2",
+				comment.ID, userID)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	names := []string{}
+	var notify []int
+	for userID, username := range mentioned {
+		names = append(names, username)
+		if existing[userID] {
+			continue
+		}
+		if _, err := tx.Exec("INSERT INTO task_comment_mentions (comment_id, user_id) VALUES ($1, $2)",
+			comment.ID, userID); err != nil {
+			return nil, nil, err
+		}
+		if userID != authorID {
+			notify = append(notify, userID)
+		}
+	}
+	sort.Strings(names)
+	if len(notify) == 0 {
+		return names, nil, nil
+	}
+
+	event := events.Event{Type: events.CommentMention, ActorID: authorID, CommentID: comment.ID, UserIDs: notify}
+	err = scanTask(tx.QueryRow("SELECT "+taskColumns+" FROM tasks WHERE id = $1", comment.TaskID), &event.Task)
+	if err != nil {
+		return nil, nil, err
+	}
+	return names, &event, nil
+}
+
+// taskFromRoute parses the task ID of a task route and checks that the
+// user can see the task, returning their role for it.
+func taskFromRoute(c *gin.Context, q queryRower) (int, string, bool) {
+	taskID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid task ID"})
+		return 0, "", false
+	}
+	role, err := taskRole(q, c.GetInt("user_id"), taskID)
+	if err != nil {
+		respondTaskError(c, err, "Database error")
+		return 0, "", false
+	}
+	return taskID, role, true
+}
+
+// GetComments lists the comments on a task, oldest first. Replies refer to
+// their parent through parentId.
+func (h *TaskHandler) GetComments(c *gin.Context) {
+	taskID, _, ok := taskFromRoute(c, h.db)
+	if !ok {
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT c.id, c.task_id, c.parent_id, c.user_id, COALESCE(u.username, ''), c.content,
+		       c.edited_at, c.deleted_at IS NOT NULL, c.created_at
+		FROM task_comments c
+		LEFT JOIN users u ON u.id = c.user_id
+		WHERE c.task_id = $1
+		ORDER BY c.created_at, c.id`, taskID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch comments"})
+		return
+	}
+	defer rows.Close()
+
+	comments := []models.TaskComment{}
+	index := make(map[int]int)
+	for rows.Next() {
+		var comment models.TaskComment
+		if err := rows.Scan(&comment.ID, &comment.TaskID, &comment.ParentID, &comment.AuthorID,
+			&comment.AuthorUsername, &comment.Content, &comment.EditedAt, &comment.Deleted,
+			&comment.CreatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan comment"})
+			return
+		}
+		if comment.Content, err = encryption.Decrypt(comment.Content, fieldCommentContent, comment.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt comment"})
+			return
+		}
+		comment.Mentions = []string{}
+		index[comment.ID] = len(comments)
+		comments = append(comments, comment)
+	}
+	rows.Close()
+
+	mentionRows, err := h.db.Query(`
+		SELECT m.comment_id, u.username
+		FROM task_comment_mentions m
+		JOIN task_comments c ON c.id = m.comment_id
+		JOIN users u ON u.id = m.user_id
+		WHERE c.task_id = $1
+		ORDER BY u.username`, taskID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch mentions"})
+		return
+	}
+	defer mentionRows.Close()
+
+	for mentionRows.Next() {
+		var commentID int
+		var username string
+		if err := mentionRows.Scan(&commentID, &username); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan mention"})
+			return
+		}
+		if i, ok := index[commentID]; ok {
+			comments[i].Mentions = append(comments[i].Mentions, username)
+		}
+	}
+
+	c.JSON(http.StatusOK, comments)
+}
+
+// CreateComment adds a comment or, with parentId, a reply. Everyone who can
+// see the task can comment on it, viewers included.
+func (h *TaskHandler) CreateComment(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var req models.CreateCommentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	taskID, _, ok := taskFromRoute(c, tx)
+	if !ok {
+		return
+	}
+
+	if req.ParentID != nil {
+		var parentDeleted bool
+		err := tx.QueryRow("SELECT deleted_at IS NOT NULL FROM task_comments WHERE id = $1 AND task_id = $2",
+			*req.ParentID, taskID).Scan(&parentDeleted)
+		if err == sql.ErrNoRows || parentDeleted {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Parent comment not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+	}
+
+	comment := models.TaskComment{TaskID: taskID, ParentID: req.ParentID, AuthorID: &userID, Content: req.Content}
+	comment.ID, err = nextID(tx, "task_comments")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	content, err := encryption.Encrypt(req.Content, fieldCommentContent, comment.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create comment"})
+		return
+	}
+
+	err = tx.QueryRow(`
+		INSERT INTO task_comments (id, task_id, parent_id, user_id, content)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING created_at`, comment.ID, taskID, req.ParentID, userID, content).Scan(&comment.CreatedAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create comment"})
+		return
+	}
+
+	if err := tx.QueryRow("SELECT username FROM users WHERE id = $1", userID).Scan(&comment.AuthorUsername); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	var mention *events.Event
+	comment.Mentions, mention, err = saveMentions(tx, userID, comment)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save mentions"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create comment"})
+		return
+	}
+	if mention != nil {
+		h.bus.Publish(*mention)
+	}
+
+	c.JSON(http.StatusCreated, comment)
+}
+
+// loadOwnComment loads a live comment on the task and locks it. It writes
+// the error response and returns false if there is none or the user may not
+// change it: only its author can, and with allowOwner also owners of the
+// task (workspace owners, or the user for their personal tasks).
+func loadOwnComment(c *gin.Context, tx *sql.Tx, taskID int, allowOwner bool, role string) (models.TaskComment, bool) {
+	var comment models.TaskComment
+	commentID, err := strconv.Atoi(c.Param("commentId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid comment ID"})
+		return comment, false
+	}
+
+	err = tx.QueryRow(`
+		SELECT c.id, c.task_id, c.parent_id, c.user_id, COALESCE(u.username, ''), c.edited_at, c.created_at
+		FROM task_comments c
+		LEFT JOIN users u ON u.id = c.user_id
+		WHERE c.id = $1 AND c.task_id = $2 AND c.deleted_at IS NULL
+		FOR UPDATE OF c`, commentID, taskID).Scan(&comment.ID, &comment.TaskID, &comment.ParentID,
+		&comment.AuthorID, &comment.AuthorUsername, &comment.EditedAt, &comment.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Comment not found"})
+			return comment, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return comment, false
+	}
+
+	isAuthor := comment.AuthorID != nil && *comment.AuthorID == c.GetInt("user_id")
+	if !isAuthor && !(allowOwner && role == models.WorkspaceRoleOwner) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can only change your own comments"})
+		return comment, false
+	}
+	return comment, true
+}
+
+// UpdateComment edits the user's own comment. Newly mentioned users are
+// notified.
+func (h *TaskHandler) UpdateComment(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var req models.UpdateCommentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	taskID, role, ok := taskFromRoute(c, tx)
+	if !ok {
+		return
+	}
+	comment, ok := loadOwnComment(c, tx, taskID, false, role)
+	if !ok {
+		return
+	}
+
+	content, err := encryption.Encrypt(req.Content, fieldCommentContent, comment.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update comment"})
+		return
+	}
+	err = tx.QueryRow(`
+		UPDATE task_comments SET content = $1, edited_at = CURRENT_TIMESTAMP
+		WHERE id = $2 RETURNING edited_at`, content, comment.ID).Scan(&comment.EditedAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update comment"})
+		return
+	}
+	comment.Content = req.Content
+
+	var mention *events.Event
+	comment.Mentions, mention, err = saveMentions(tx, userID, comment)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save mentions"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update comment"})
+		return
+	}
+	if mention != nil {
+		h.bus.Publish(*mention)
+	}
+
+	c.JSON(http.StatusOK, comment)
+}
+
+// DeleteComment deletes a comment. Authors can delete their own comments
+// and owners any comment on their tasks. A comment with replies is blanked
+// and kept so the thread stays intact.
+func (h *TaskHandler) DeleteComment(c *gin.Context) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	taskID, role, ok := taskFromRoute(c, tx)
+	if !ok {
+		return
+	}
+	comment, ok := loadOwnComment(c, tx, taskID, true, role)
+	if !ok {
+		return
+	}
+
+	if err := deleteComment(tx, comment.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete comment"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete comment"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Comment deleted successfully"})
+}
+
+// deleteComment removes a comment, or blanks it if it has replies.
+func deleteComment(e execer, commentID int) error {
+	_, err := e.Exec(`
+		DELETE FROM task_comments c
+		WHERE c.id = $1 AND NOT EXISTS (SELECT 1 FROM task_comments r WHERE r.parent_id = c.id)`, commentID)
+	if err != nil {
+		return err
+	}
+	_, err = e.Exec("DELETE FROM task_comment_mentions WHERE comment_id = $1", commentID)
+	if err != nil {
+		return err
+	}
+	_, err = e.Exec(`
+		UPDATE task_comments SET content = '', deleted_at = CURRENT_TIMESTAMP
+		WHERE id = $1`, commentID)
+	return err
+}
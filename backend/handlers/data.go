@@ -0,0 +1,813 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+
+	"mmtm/encryption"
+	"mmtm/events"
+	"mmtm/models"
+)
+
+// maxImportSize limits the size of an uploaded import file.
+const maxImportSize = 10 << 20
+
+// maxImportEntrySize limits the uncompressed size of each file in an
+// imported zip, so a small archive can't expand without bound.
+const maxImportEntrySize = 50 << 20
+
+var taskCSVHeader = []string{
+	"id", "title", "description", "category", "priority", "status", "dueDate",
+	"importance", "progress", "reorganizable", "strict", "notes", "recurrenceRule",
+	"createdAt", "updatedAt", "estimatedMinutes",
+}
+
+var moodLogCSVHeader = []string{"id", "mood", "confidence", "textInput", "createdAt", "source"}
+
+// DataHandler exports and imports a user's complete data for backups and
+// portability.
+type DataHandler struct {
+	db  *sql.DB
+	bus *events.Bus
+}
+
+func NewDataHandler(db *sql.DB, bus *events.Bus) *DataHandler {
+	return &DataHandler{db: db, bus: bus}
+}
+
+// Export streams the user's profile, tasks and mood logs, either as a single
+// JSON document or as a zip of CSV files (profile.csv, tasks.csv and
+// mood_logs.csv).
+func (h *DataHandler) Export(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or csv"})
+		return
+	}
+
+	var user models.User
+	err := scanUser(h.db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = $1", userID), &user)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	filename := fmt.Sprintf("mmtm-export-%s-%s", user.Username, time.Now().UTC().Format("20060102"))
+	if format == "json" {
+		c.Header("Content-Type", "application/json")
+		c.Header("Content-Disposition", `attachment; filename="`+filename+`.json"`)
+		c.Status(http.StatusOK)
+		err = h.exportJSON(c.Writer, user)
+	} else {
+		c.Header("Content-Type", "application/zip")
+		c.Header("Content-Disposition", `attachment; filename="`+filename+`.zip"`)
+		c.Status(http.StatusOK)
+		err = h.exportCSV(c.Writer, user)
+	}
+
+	// The response is already streaming, so a late failure can only be logged
+	if err != nil {
+		c.Error(err)
+	}
+}
+
+func (h *DataHandler) exportJSON(w io.Writer, user models.User) error {
+	profile, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, `{"version":1,"exportedAt":%q,"profile":%s,"tasks":[`,
+		time.Now().UTC().Format(time.RFC3339), profile)
+
+	first := true
+	err = h.eachTask(user.ID, func(task models.Task) error {
+		b, err := json.Marshal(task)
+		if err != nil {
+			return err
+		}
+		if !first {
+			io.WriteString(w, ",")
+		}
+		first = false
+		_, err = w.Write(b)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	io.WriteString(w, `],"moodLogs":[`)
+	first = true
+	err = h.eachMoodLog(user.ID, func(log models.MoodLog) error {
+		b, err := json.Marshal(log)
+		if err != nil {
+			return err
+		}
+		if !first {
+			io.WriteString(w, ",")
+		}
+		first = false
+		_, err = w.Write(b)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, "]}")
+	return err
+}
+
+func (h *DataHandler) exportCSV(w io.Writer, user models.User) error {
+	archive := zip.NewWriter(w)
+
+	f, err := archive.Create("profile.csv")
+	if err != nil {
+		return err
+	}
+	cw := csv.NewWriter(f)
+	cw.Write([]string{"id", "username", "email", "createdAt"})
+	cw.Write([]string{strconv.Itoa(user.ID), user.Username, user.Email, user.CreatedAt.UTC().Format(time.RFC3339)})
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+
+	f, err = archive.Create("tasks.csv")
+	if err != nil {
+		return err
+	}
+	cw = csv.NewWriter(f)
+	cw.Write(taskCSVHeader)
+	err = h.eachTask(user.ID, func(task models.Task) error {
+		estimate := ""
+		if task.EstimatedMinutes != nil {
+			estimate = strconv.Itoa(*task.EstimatedMinutes)
+		}
+		return cw.Write([]string{
+			strconv.Itoa(task.ID), task.Title, task.Description, task.Category,
+			task.Priority, task.Status, task.DueDate.UTC().Format(time.RFC3339),
+			strconv.Itoa(task.Importance), strconv.Itoa(task.Progress),
+			strconv.FormatBool(task.Reorganizable), strconv.FormatBool(task.Strict),
+			task.Notes, task.RecurrenceRule,
+			task.CreatedAt.UTC().Format(time.RFC3339), task.UpdatedAt.UTC().Format(time.RFC3339),
+			estimate,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+
+	f, err = archive.Create("mood_logs.csv")
+	if err != nil {
+		return err
+	}
+	cw = csv.NewWriter(f)
+	cw.Write(moodLogCSVHeader)
+	err = h.eachMoodLog(user.ID, func(log models.MoodLog) error {
+		return cw.Write([]string{
+			strconv.Itoa(log.ID), log.Mood, strconv.FormatFloat(log.Confidence, 'f', -1, 64),
+			log.TextInput, log.CreatedAt.UTC().Format(time.RFC3339), log.Source,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+// eachTask visits the user's personal tasks. Workspace tasks belong to the
+// workspace and are neither exported nor replaced by an import.
+func (h *DataHandler) eachTask(userID int, fn func(models.Task) error) error {
+	rows, err := h.db.Query(`
+		SELECT `+taskColumns+`
+		FROM tasks WHERE user_id = $1 AND workspace_id IS NULL ORDER BY created_at`, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var task models.Task
+		if err := scanTask(rows, &task); err != nil {
+			return err
+		}
+		if err := fn(task); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (h *DataHandler) eachMoodLog(userID int, fn func(models.MoodLog) error) error {
+	rows, err := h.db.Query(`
+		SELECT id, user_id, mood, confidence, text_input, source, created_at
+		FROM mood_logs WHERE user_id = $1 ORDER BY created_at`, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var log models.MoodLog
+		if err := rows.Scan(&log.ID, &log.UserID, &log.Mood, &log.Confidence,
+			&log.TextInput, &log.Source, &log.CreatedAt); err != nil {
+			return err
+		}
+		text, err := encryption.Decrypt(log.TextInput, fieldMoodText, log.ID)
+		if err != nil {
+			return fmt.Errorf("mood log %d: %w", log.ID, err)
+		}
+		log.TextInput = text
+		if err := fn(log); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// importData holds the validated rows of an import. A nil slice means the
+// dataset was absent, which matters for replace mode.
+type importData struct {
+	tasks    []models.CreateTaskRequest
+	moodLogs []models.MoodLog
+	errors   []models.ImportRowError
+}
+
+// Import loads data produced by Export: a JSON document, a tasks CSV, or the
+// zip of CSVs. Every row is validated first and nothing is written unless all
+// rows are valid. In "merge" mode (the default) tasks with the same title and
+// due date as an existing task update it and other rows are added; in
+// "replace" mode each dataset present in the import replaces the user's
+// existing data of that kind.
+func (h *DataHandler) Import(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	mode := c.DefaultQuery("mode", "merge")
+	if mode != "merge" && mode != "replace" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "mode must be merge or replace"})
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImportSize)
+
+	kind := importKind(c.ContentType(), "")
+	var body io.Reader = c.Request.Body
+	if strings.HasPrefix(c.ContentType(), "multipart/form-data") {
+		fileHeader, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+			return
+		}
+		file, err := fileHeader.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read file"})
+			return
+		}
+		defer file.Close()
+		body = file
+		kind = importKind("", fileHeader.Filename)
+	}
+
+	var data importData
+	var err error
+	switch kind {
+	case "json":
+		data, err = parseJSONImport(body)
+	case "csv":
+		data.tasks, data.errors, err = parseTaskCSV(body)
+	case "zip":
+		data, err = parseZipImport(body)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported import format, expected JSON, CSV or zip"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid import file: " + err.Error()})
+		return
+	}
+
+	response := models.ImportResponse{Mode: mode, Errors: data.errors}
+	if response.Errors == nil {
+		response.Errors = []models.ImportRowError{}
+	}
+	if len(response.Errors) > 0 {
+		c.JSON(http.StatusUnprocessableEntity, response)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	pending, err := applyImport(tx, userID, mode, data, &response)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to import data"})
+		return
+	}
+	if err := enqueueWebhooks(tx, pending); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to import data"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to import data"})
+		return
+	}
+
+	for _, event := range pending {
+		h.bus.Publish(event)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func importKind(contentType, filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		return "json"
+	case ".csv":
+		return "csv"
+	case ".zip":
+		return "zip"
+	}
+	switch contentType {
+	case "application/json":
+		return "json"
+	case "text/csv":
+		return "csv"
+	case "application/zip":
+		return "zip"
+	}
+	return ""
+}
+
+func parseJSONImport(r io.Reader) (importData, error) {
+	var data importData
+	var doc models.ExportDocument
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return data, err
+	}
+
+	if doc.Tasks != nil {
+		data.tasks = []models.CreateTaskRequest{}
+		for i, req := range *doc.Tasks {
+			if err := validateImportedTask(&req); err != nil {
+				data.errors = append(data.errors, models.ImportRowError{Dataset: "tasks", Row: i + 1, Error: err.Error()})
+				continue
+			}
+			data.tasks = append(data.tasks, req)
+		}
+	}
+	if doc.MoodLogs != nil {
+		data.moodLogs = []models.MoodLog{}
+		for i, log := range *doc.MoodLogs {
+			if err := validateImportedMoodLog(&log); err != nil {
+				data.errors = append(data.errors, models.ImportRowError{Dataset: "moodLogs", Row: i + 1, Error: err.Error()})
+				continue
+			}
+			data.moodLogs = append(data.moodLogs, log)
+		}
+	}
+	return data, nil
+}
+
+func parseZipImport(r io.Reader) (importData, error) {
+	var data importData
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return data, err
+	}
+	archive, err := zip.NewReader(bytes.NewReader(raw), int64(len(raw)))
+	if err != nil {
+		return data, err
+	}
+
+	for _, f := range archive.File {
+		var rowErrors []models.ImportRowError
+		switch filepath.Base(f.Name) {
+		case "tasks.csv":
+			rc, err := openZipEntry(f)
+			if err != nil {
+				return data, err
+			}
+			data.tasks, rowErrors, err = parseTaskCSV(rc)
+			rc.Close()
+			if err != nil {
+				return data, fmt.Errorf("tasks.csv: %v", err)
+			}
+		case "mood_logs.csv":
+			rc, err := openZipEntry(f)
+			if err != nil {
+				return data, err
+			}
+			data.moodLogs, rowErrors, err = parseMoodLogCSV(rc)
+			rc.Close()
+			if err != nil {
+				return data, fmt.Errorf("mood_logs.csv: %v", err)
+			}
+		}
+		data.errors = append(data.errors, rowErrors...)
+	}
+	return data, nil
+}
+
+// openZipEntry opens a file of an imported zip, refusing files larger than
+// maxImportEntrySize. The declared size can't be trusted, so reading also
+// fails once more than that has been decompressed.
+func openZipEntry(f *zip.File) (io.ReadCloser, error) {
+	if f.UncompressedSize64 > maxImportEntrySize {
+		return nil, fmt.Errorf("%s: file is too large", f.Name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	return &limitedEntry{ReadCloser: rc, name: f.Name, left: maxImportEntrySize}, nil
+}
+
+// limitedEntry fails reads once more than left bytes have been read.
+type limitedEntry struct {
+	io.ReadCloser
+	name string
+	left int64
+}
+
+func (e *limitedEntry) Read(p []byte) (int, error) {
+	if e.left <= 0 {
+		return 0, fmt.Errorf("%s: file is too large", e.name)
+	}
+	if int64(len(p)) > e.left {
+		p = p[:e.left]
+	}
+	n, err := e.ReadCloser.Read(p)
+	e.left -= int64(n)
+	return n, err
+}
+
+// csvRecords reads a CSV with a header row and returns each data row as a
+// column-name map together with its line number.
+func csvRecords(r io.Reader, required []string) ([]map[string]string, []int, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("missing header row")
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(strings.TrimPrefix(header[i], "\ufeff"))
+	}
+	present := make(map[string]bool, len(header))
+	for _, name := range header {
+		present[name] = true
+	}
+	for _, name := range required {
+		if !present[name] {
+			return nil, nil, fmt.Errorf("missing column %q", name)
+		}
+	}
+
+	var records []map[string]string
+	var lines []int
+	for {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		record := make(map[string]string, len(header))
+		for i, name := range header {
+			if i < len(fields) {
+				record[name] = fields[i]
+			}
+		}
+		records = append(records, record)
+		lines = append(lines, line)
+	}
+	return records, lines, nil
+}
+
+func parseTaskCSV(r io.Reader) ([]models.CreateTaskRequest, []models.ImportRowError, error) {
+	records, lines, err := csvRecords(r, []string{"title", "category", "priority", "status", "dueDate", "importance"})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tasks := []models.CreateTaskRequest{}
+	var rowErrors []models.ImportRowError
+	for i, record := range records {
+		req, err := taskRequestFromRecord(record)
+		if err == nil {
+			err = validateImportedTask(&req)
+		}
+		if err != nil {
+			rowErrors = append(rowErrors, models.ImportRowError{Dataset: "tasks", Row: lines[i], Error: err.Error()})
+			continue
+		}
+		tasks = append(tasks, req)
+	}
+	return tasks, rowErrors, nil
+}
+
+func taskRequestFromRecord(record map[string]string) (models.CreateTaskRequest, error) {
+	req := models.CreateTaskRequest{
+		Title:          record["title"],
+		Description:    record["description"],
+		Category:       record["category"],
+		Priority:       record["priority"],
+		Status:         record["status"],
+		Notes:          record["notes"],
+		RecurrenceRule: record["recurrenceRule"],
+		Reorganizable:  true,
+	}
+
+	dueDate, err := time.Parse(time.RFC3339, record["dueDate"])
+	if err != nil {
+		return req, fmt.Errorf("invalid dueDate %q", record["dueDate"])
+	}
+	req.DueDate = dueDate
+
+	if req.Importance, err = strconv.Atoi(record["importance"]); err != nil {
+		return req, fmt.Errorf("invalid importance %q", record["importance"])
+	}
+	if v := record["progress"]; v != "" {
+		if req.Progress, err = strconv.Atoi(v); err != nil {
+			return req, fmt.Errorf("invalid progress %q", v)
+		}
+	}
+	if v := record["estimatedMinutes"]; v != "" {
+		estimate, err := strconv.Atoi(v)
+		if err != nil {
+			return req, fmt.Errorf("invalid estimatedMinutes %q", v)
+		}
+		req.EstimatedMinutes = &estimate
+	}
+	if v := record["reorganizable"]; v != "" {
+		if req.Reorganizable, err = strconv.ParseBool(v); err != nil {
+			return req, fmt.Errorf("invalid reorganizable %q", v)
+		}
+	}
+	if v := record["strict"]; v != "" {
+		if req.Strict, err = strconv.ParseBool(v); err != nil {
+			return req, fmt.Errorf("invalid strict %q", v)
+		}
+	}
+	return req, nil
+}
+
+func parseMoodLogCSV(r io.Reader) ([]models.MoodLog, []models.ImportRowError, error) {
+	records, lines, err := csvRecords(r, []string{"mood", "confidence", "textInput"})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logs := []models.MoodLog{}
+	var rowErrors []models.ImportRowError
+	for i, record := range records {
+		log := models.MoodLog{Mood: record["mood"], TextInput: record["textInput"], Source: record["source"]}
+		log.Confidence, err = strconv.ParseFloat(record["confidence"], 64)
+		if err != nil {
+			err = fmt.Errorf("invalid confidence %q", record["confidence"])
+		} else if v := record["createdAt"]; v != "" {
+			if log.CreatedAt, err = time.Parse(time.RFC3339, v); err != nil {
+				err = fmt.Errorf("invalid createdAt %q", v)
+			}
+		}
+		if err == nil {
+			err = validateImportedMoodLog(&log)
+		}
+		if err != nil {
+			rowErrors = append(rowErrors, models.ImportRowError{Dataset: "moodLogs", Row: lines[i], Error: err.Error()})
+			continue
+		}
+		logs = append(logs, log)
+	}
+	return logs, rowErrors, nil
+}
+
+// validateImportedTask applies the same rules as creating a task through the API.
+func validateImportedTask(req *models.CreateTaskRequest) error {
+	if err := binding.Validator.ValidateStruct(req); err != nil {
+		return err
+	}
+	recurrenceRule, err := normalizeRecurrenceRule(req.RecurrenceRule)
+	if err != nil {
+		return fmt.Errorf("Invalid recurrence rule: %v", err)
+	}
+	req.RecurrenceRule = recurrenceRule
+	// Imports restore personal tasks; sharing happens through the task API
+	req.WorkspaceID = nil
+	req.AssigneeID = nil
+	return nil
+}
+
+func validateImportedMoodLog(log *models.MoodLog) error {
+	if !validMoods[log.Mood] {
+		return fmt.Errorf("invalid mood %q", log.Mood)
+	}
+	if log.Confidence < 0 || log.Confidence > 1 {
+		return fmt.Errorf("confidence must be between 0 and 1")
+	}
+	switch log.Source {
+	case "":
+		log.Source = models.MoodSourceAnalysis
+	case models.MoodSourceAnalysis, models.MoodSourceCheckIn:
+	default:
+		return fmt.Errorf("invalid source %q", log.Source)
+	}
+	// Check-ins only carry an optional note
+	if log.Source == models.MoodSourceAnalysis && strings.TrimSpace(log.TextInput) == "" {
+		return fmt.Errorf("text input is required")
+	}
+	if log.CreatedAt.IsZero() {
+		log.CreatedAt = time.Now()
+	}
+	return nil
+}
+
+// applyImport writes imported data in mode and returns the events to publish
+// once the transaction commits.
+func applyImport(tx *sql.Tx, userID int, mode string, data importData, response *models.ImportResponse) ([]events.Event, error) {
+	var pending []events.Event
+	if mode == "replace" {
+		if data.tasks != nil {
+			deleted, err := personalTasks(tx, userID)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := tx.Exec("DELETE FROM tasks WHERE user_id = $1 AND workspace_id IS NULL", userID); err != nil {
+				return nil, err
+			}
+			for _, task := range deleted {
+				pending = append(pending, events.Event{Type: events.TaskDeleted, ActorID: userID, Task: task})
+			}
+			response.TasksDeleted = len(deleted)
+		}
+		if data.moodLogs != nil {
+			result, err := tx.Exec("DELETE FROM mood_logs WHERE user_id = $1", userID)
+			if err != nil {
+				return nil, err
+			}
+			deleted, _ := result.RowsAffected()
+			response.MoodLogsDeleted = int(deleted)
+		}
+	}
+
+	// In merge mode a task with the same title and due date is the same task
+	existing := make(map[string]int)
+	if mode == "merge" && len(data.tasks) > 0 {
+		rows, err := tx.Query("SELECT id, title, due_date FROM tasks WHERE user_id = $1 AND workspace_id IS NULL", userID)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id int
+			var title string
+			var dueDate time.Time
+			if err := rows.Scan(&id, &title, &dueDate); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			existing[taskMergeKey(title, dueDate)] = id
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, req := range data.tasks {
+		key := taskMergeKey(req.Title, req.DueDate)
+		if id, ok := existing[key]; ok {
+			before, err := loadTask(tx, id)
+			if err != nil {
+				return nil, err
+			}
+			task, err := updateTask(tx, userID, id, patchFromCreateRequest(req))
+			if err != nil {
+				return nil, err
+			}
+			pending = append(pending, taskEvents(userID, before, task)...)
+			response.TasksUpdated++
+			continue
+		}
+
+		task, err := insertTask(tx, userID, req)
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, taskEvents(userID, nil, task)...)
+		if mode == "merge" {
+			existing[key] = task.ID
+		}
+		response.TasksCreated++
+	}
+
+	for _, log := range data.moodLogs {
+		id, err := nextID(tx, "mood_logs")
+		if err != nil {
+			return nil, err
+		}
+		text, err := encryption.Encrypt(log.TextInput, fieldMoodText, id)
+		if err != nil {
+			return nil, err
+		}
+
+		// Mood logs have no natural key, so skip exact duplicates explicitly
+		result, err := tx.Exec(`
+			INSERT INTO mood_logs (id, user_id, mood, confidence, text_input, created_at, source)
+			SELECT $7::integer, $1::integer, $2::varchar, $3::float8, $4::text, $5::timestamptz, $6::varchar
+			WHERE NOT EXISTS (
+				SELECT 1 FROM mood_logs WHERE user_id = $1 AND mood = $2 AND created_at = $5
+			)`,
+			userID, log.Mood, log.Confidence, text, log.CreatedAt, log.Source, id)
+		if err != nil {
+			return nil, err
+		}
+		inserted, _ := result.RowsAffected()
+		response.MoodLogsImported += int(inserted)
+	}
+
+	return pending, nil
+}
+
+// personalTasks returns the user's tasks outside of workspaces.
+func personalTasks(tx *sql.Tx, userID int) ([]models.Task, error) {
+	rows, err := tx.Query("SELECT "+taskColumns+" FROM tasks WHERE user_id = $1 AND workspace_id IS NULL", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tasks []models.Task
+	for rows.Next() {
+		var task models.Task
+		if err := scanTask(rows, &task); err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, rows.Err()
+}
+
+func taskMergeKey(title string, dueDate time.Time) string {
+	return strings.ToLower(strings.TrimSpace(title)) + "|" + dueDate.UTC().Format(time.RFC3339)
+}
+
+func patchFromCreateRequest(req models.CreateTaskRequest) models.UpdateTaskRequest {
+	// A missing estimate clears the existing one, like every other field
+	estimate := 0
+	if req.EstimatedMinutes != nil {
+		estimate = *req.EstimatedMinutes
+	}
+	return models.UpdateTaskRequest{
+		Title:            &req.Title,
+		Description:      &req.Description,
+		Category:         &req.Category,
+		Priority:         &req.Priority,
+		Status:           &req.Status,
+		DueDate:          &req.DueDate,
+		Importance:       &req.Importance,
+		Progress:         &req.Progress,
+		Reorganizable:    &req.Reorganizable,
+		Strict:           &req.Strict,
+		Notes:            &req.Notes,
+		RecurrenceRule:   &req.RecurrenceRule,
+		EstimatedMinutes: &estimate,
+	}
+}
@@ -0,0 +1,275 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"mmtm/models"
+)
+
+func (h *TaskHandler) GetDependencies(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	taskID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid task ID"})
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT d.task_id, d.depends_on_id, d.created_at
+		FROM task_dependencies d
+		JOIN tasks t ON t.id = d.task_id
+		WHERE d.task_id = $1 AND `+visibleTasks("t.", "$2")+`
+		ORDER BY d.created_at`, taskID, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch dependencies"})
+		return
+	}
+	defer rows.Close()
+
+	dependencies := []models.TaskDependency{}
+	for rows.Next() {
+		var dep models.TaskDependency
+		if err := rows.Scan(&dep.TaskID, &dep.DependsOnID, &dep.CreatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan dependency"})
+			return
+		}
+		dependencies = append(dependencies, dep)
+	}
+
+	c.JSON(http.StatusOK, dependencies)
+}
+
+func (h *TaskHandler) AddDependency(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	taskID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid task ID"})
+		return
+	}
+
+	var req models.AddDependencyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.DependsOnID == taskID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A task cannot depend on itself"})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	if err := authorizeTaskEdit(tx, userID, taskID); err != nil {
+		respondTaskError(c, err, "Database error")
+		return
+	}
+
+	// Serialize dependency changes per board (the user's personal tasks or
+	// a workspace) so concurrent links can't form a cycle
+	var workspaceID sql.NullInt64
+	if err := tx.QueryRow("SELECT workspace_id FROM tasks WHERE id = $1", taskID).Scan(&workspaceID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if workspaceID.Valid {
+		_, err = tx.Exec("SELECT id FROM workspaces WHERE id = $1 FOR UPDATE", workspaceID.Int64)
+	} else {
+		_, err = tx.Exec("SELECT id FROM users WHERE id = $1 FOR UPDATE", userID)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	// The prerequisite must be visible and on the same board
+	var sameBoard bool
+	err = tx.QueryRow(`
+		SELECT workspace_id IS NOT DISTINCT FROM $2 FROM tasks
+		WHERE id = $1 AND `+visibleTasks("", "$3"),
+		req.DependsOnID, workspaceID, userID).Scan(&sameBoard)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !sameBoard {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A task can only depend on tasks in the same workspace"})
+		return
+	}
+
+	// Adding task -> prerequisite creates a cycle if the prerequisite already
+	// (transitively) depends on the task
+	var cycle bool
+	err = tx.QueryRow(`
+		WITH RECURSIVE chain(id) AS (
+			SELECT depends_on_id FROM task_dependencies WHERE task_id = $1
+			UNION
+			SELECT d.depends_on_id FROM task_dependencies d JOIN chain ON d.task_id = chain.id
+		)
+		SELECT EXISTS(SELECT 1 FROM chain WHERE id = $2)`,
+		req.DependsOnID, taskID).Scan(&cycle)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if cycle {
+		c.JSON(http.StatusConflict, gin.H{"error": "Dependency would create a cycle"})
+		return
+	}
+
+	var dep models.TaskDependency
+	err = tx.QueryRow(`
+		INSERT INTO task_dependencies (task_id, depends_on_id)
+		VALUES ($1, $2)
+		ON CONFLICT (task_id, depends_on_id) DO NOTHING
+		RETURNING task_id, depends_on_id, created_at`,
+		taskID, req.DependsOnID).Scan(&dep.TaskID, &dep.DependsOnID, &dep.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusConflict, gin.H{"error": "Dependency already exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add dependency"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add dependency"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, dep)
+}
+
+func (h *TaskHandler) RemoveDependency(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	taskID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid task ID"})
+		return
+	}
+	dependsOnID, err := strconv.Atoi(c.Param("dependsOnId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid dependency ID"})
+		return
+	}
+
+	if err := authorizeTaskEdit(h.db, userID, taskID); err != nil {
+		respondTaskError(c, err, "Failed to remove dependency")
+		return
+	}
+
+	result, err := h.db.Exec("DELETE FROM task_dependencies WHERE task_id = $1 AND depends_on_id = $2",
+		taskID, dependsOnID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove dependency"})
+		return
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check deletion"})
+		return
+	}
+
+	if rowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Dependency not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Dependency removed successfully"})
+}
+
+// loadUnfinishedDependencies returns, for each task the user can see, the
+// prerequisites that are not yet completed.
+func loadUnfinishedDependencies(db *sql.DB, userID int) (map[int][]int, error) {
+	rows, err := db.Query(`
+		SELECT d.task_id, d.depends_on_id
+		FROM task_dependencies d
+		JOIN tasks t ON t.id = d.task_id
+		JOIN tasks p ON p.id = d.depends_on_id
+		WHERE `+visibleTasks("t.", "$1")+` AND p.status != 'Completed'`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deps := make(map[int][]int)
+	for rows.Next() {
+		var taskID, dependsOnID int
+		if err := rows.Scan(&taskID, &dependsOnID); err != nil {
+			return nil, err
+		}
+		deps[taskID] = append(deps[taskID], dependsOnID)
+	}
+	return deps, rows.Err()
+}
+
+// markBlocked flags tasks that still wait on an unfinished prerequisite.
+func markBlocked(tasks []models.Task, deps map[int][]int) {
+	for i := range tasks {
+		tasks[i].Blocked = tasks[i].Status != "Completed" && len(deps[tasks[i].ID]) > 0
+	}
+}
+
+// orderByDependencies reorders tasks so that no task comes before one of its
+// unfinished prerequisites, otherwise keeping the existing (mood-driven) order.
+// Prerequisites outside the slice don't constrain the order.
+func orderByDependencies(tasks []models.Task, deps map[int][]int) {
+	position := make(map[int]int, len(tasks))
+	for i, task := range tasks {
+		position[task.ID] = i
+	}
+
+	pending := make([]int, len(tasks))
+	dependents := make(map[int][]int)
+	for i, task := range tasks {
+		for _, prereq := range deps[task.ID] {
+			if j, ok := position[prereq]; ok {
+				pending[i]++
+				dependents[j] = append(dependents[j], i)
+			}
+		}
+	}
+
+	// Repeatedly take the highest-ranked task whose prerequisites are placed
+	ordered := make([]models.Task, 0, len(tasks))
+	placed := make([]bool, len(tasks))
+	for len(ordered) < len(tasks) {
+		next := -1
+		for i := range tasks {
+			if !placed[i] && pending[i] == 0 {
+				next = i
+				break
+			}
+		}
+		if next == -1 {
+			// Cycles are rejected on insert; keep the remaining order if one slips through
+			for i := range tasks {
+				if !placed[i] {
+					ordered = append(ordered, tasks[i])
+				}
+			}
+			break
+		}
+		placed[next] = true
+		ordered = append(ordered, tasks[next])
+		for _, dependent := range dependents[next] {
+			pending[dependent]--
+		}
+	}
+
+	copy(tasks, ordered)
+}
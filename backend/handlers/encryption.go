@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	"mmtm/encryption"
+	"mmtm/models"
+)
+
+// encryptedColumns are the free-text columns encrypted at rest. The column
+// name and row ID make up the associated data, so a value only decrypts in
+// the row and column it was written to. key is the column holding the row
+// ID.
+var encryptedColumns = []struct{ table, column, key string }{
+	{"tasks", "description", "id"},
+	{"tasks", "notes", "id"},
+	{"mood_logs", "text_input", "id"},
+	{"task_comments", "content", "id"},
+	{"webhooks", "secret", "id"},
+	{"webhook_deliveries", "payload", "id"},
+	{"time_entries", "note", "id"},
+	{"user_totp", "secret", "user_id"},
+}
+
+const (
+	fieldTaskDescription = "tasks.description"
+	fieldTaskNotes       = "tasks.notes"
+	fieldMoodText        = "mood_logs.text_input"
+	fieldCommentContent  = "task_comments.content"
+	fieldWebhookSecret   = "webhooks.secret"
+	fieldWebhookPayload  = "webhook_deliveries.payload"
+	fieldTimeEntryNote   = "time_entries.note"
+	fieldTOTPSecret      = "user_totp.secret"
+)
+
+// reencryptBatchSize bounds how many rows ReencryptData rewrites per query.
+const reencryptBatchSize = 500
+
+// nextID reserves the ID of a row about to be inserted into table, so values
+// encrypted for the row can be bound to it.
+func nextID(q queryRower, table string) (int, error) {
+	var id int
+	err := q.QueryRow("SELECT nextval(pg_get_serial_sequence($1, 'id'))", table).Scan(&id)
+	return id, err
+}
+
+// encryptTaskFields encrypts the free text of a task about to be written.
+func encryptTaskFields(taskID int, description, notes string) (string, string, error) {
+	description, err := encryption.Encrypt(description, fieldTaskDescription, taskID)
+	if err != nil {
+		return "", "", err
+	}
+	notes, err = encryption.Encrypt(notes, fieldTaskNotes, taskID)
+	return description, notes, err
+}
+
+func decryptTask(task *models.Task) error {
+	var err error
+	if task.Description, err = encryption.Decrypt(task.Description, fieldTaskDescription, task.ID); err != nil {
+		return fmt.Errorf("task %d description: %w", task.ID, err)
+	}
+	if task.Notes, err = encryption.Decrypt(task.Notes, fieldTaskNotes, task.ID); err != nil {
+		return fmt.Errorf("task %d notes: %w", task.ID, err)
+	}
+	return nil
+}
+
+// ReencryptData brings every encrypted column up to date with the active
+// key: plaintext written before encryption was enabled is encrypted and
+// values sealed with a retired key are re-encrypted. It returns how many
+// values were rewritten. Rows edited concurrently are skipped and picked up
+// by the next run, which happens anyway since they are then current. Values
+// that can't be decrypted are logged and left alone.
+func ReencryptData(db *sql.DB) (int, error) {
+	if !encryption.Enabled() {
+		return 0, nil
+	}
+
+	total := 0
+	for _, col := range encryptedColumns {
+		field := col.table + "." + col.column
+		lastID := 0
+		for {
+			rows, err := db.Query(`
+				SELECT `+col.key+`, `+col.column+` FROM `+col.table+`
+				WHERE `+col.key+` > $1 AND `+col.column+` <> '' AND left(`+col.column+`, $2) <> $3
+				ORDER BY `+col.key+` LIMIT $4`,
+				lastID, len(encryption.ActivePrefix()), encryption.ActivePrefix(), reencryptBatchSize)
+			if err != nil {
+				return total, err
+			}
+
+			type staleValue struct {
+				id    int
+				value string
+			}
+			var batch []staleValue
+			for rows.Next() {
+				var v staleValue
+				if err := rows.Scan(&v.id, &v.value); err != nil {
+					rows.Close()
+					return total, err
+				}
+				batch = append(batch, v)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return total, err
+			}
+			if len(batch) == 0 {
+				break
+			}
+
+			for _, v := range batch {
+				lastID = v.id
+				plaintext, err := encryption.Decrypt(v.value, field, v.id)
+				if err != nil {
+					log.Printf("Re-encryption: %s row %d: %v", field, v.id, err)
+					continue
+				}
+				sealed, err := encryption.Encrypt(plaintext, field, v.id)
+				if err != nil {
+					return total, err
+				}
+				result, err := db.Exec(`
+					UPDATE `+col.table+` SET `+col.column+` = $1
+					WHERE `+col.key+` = $2 AND `+col.column+` = $3`, sealed, v.id, v.value)
+				if err != nil {
+					return total, err
+				}
+				if n, _ := result.RowsAffected(); n > 0 {
+					total++
+				}
+			}
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"errors"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"mmtm/encryption"
+)
+
+// columnStore is an in-memory stand-in for the encrypted columns, keyed by
+// "table.column" and row ID. It understands just the queries ReencryptData
+// sends.
+type columnStore struct {
+	mu     sync.Mutex
+	values map[string]map[int]string
+}
+
+var (
+	selectStalePattern = regexp.MustCompile(`SELECT \w+, (\w+) FROM (\w+)`)
+	updateValuePattern = regexp.MustCompile(`UPDATE (\w+) SET (\w+) = \$1`)
+)
+
+type columnConn struct{ store *columnStore }
+
+func (c *columnConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements not supported")
+}
+func (c *columnConn) Close() error              { return nil }
+func (c *columnConn) Begin() (driver.Tx, error) { return nil, errors.New("transactions not supported") }
+
+func (c *columnConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	m := selectStalePattern.FindStringSubmatch(query)
+	if m == nil {
+		return nil, errors.New("unexpected query: " + query)
+	}
+	lastID, activePrefix, limit := args[0].Value.(int64), args[2].Value.(string), args[3].Value.(int64)
+
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	column := c.store.values[m[2]+"."+m[1]]
+	var ids []int
+	for id, value := range column {
+		if int64(id) > lastID && value != "" && !strings.HasPrefix(value, activePrefix) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	if len(ids) > int(limit) {
+		ids = ids[:limit]
+	}
+	rows := &columnRows{}
+	for _, id := range ids {
+		rows.rows = append(rows.rows, []driver.Value{int64(id), column[id]})
+	}
+	return rows, nil
+}
+
+func (c *columnConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	m := updateValuePattern.FindStringSubmatch(query)
+	if m == nil {
+		return nil, errors.New("unexpected statement: " + query)
+	}
+	value, id, old := args[0].Value.(string), int(args[1].Value.(int64)), args[2].Value.(string)
+
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	column := c.store.values[m[1]+"."+m[2]]
+	if column[id] != old {
+		return driver.RowsAffected(0), nil
+	}
+	column[id] = value
+	return driver.RowsAffected(1), nil
+}
+
+type columnRows struct {
+	rows [][]driver.Value
+}
+
+func (r *columnRows) Columns() []string { return []string{"id", "value"} }
+func (r *columnRows) Close() error      { return nil }
+
+func (r *columnRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+var registerColumnStore sync.Once
+
+// openColumnStore returns a database backed by store.
+func openColumnStore(t *testing.T, store *columnStore) *sql.DB {
+	t.Helper()
+	registerColumnStore.Do(func() { sql.Register("columnstore", &storeDriver{}) })
+	storeDrivers.Store(t.Name(), store)
+	db, err := sql.Open("columnstore", t.Name())
+	if err != nil {
+		t.Fatalf("opening the column store: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// storeDriver hands out the store registered under the data source name, so
+// tests can each use their own.
+type storeDriver struct{}
+
+var storeDrivers sync.Map
+
+func (storeDriver) Open(name string) (driver.Conn, error) {
+	store, ok := storeDrivers.Load(name)
+	if !ok {
+		return nil, errors.New("no column store named " + name)
+	}
+	return &columnConn{store.(*columnStore)}, nil
+}
+
+// useEncryptionKeys configures test master keys, encrypting new values with
+// active, and restores the environment's configuration afterwards.
+func useEncryptionKeys(t *testing.T, active string, kids ...string) {
+	t.Helper()
+	var entries []string
+	for _, kid := range kids {
+		key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte(kid[:1]), 32))
+		entries = append(entries, kid+":"+key)
+	}
+	// Registered before t.Setenv, so it runs once the variables are restored
+	t.Cleanup(func() { encryption.Configure() })
+	t.Setenv("ENCRYPTION_KEYS", strings.Join(entries, ","))
+	t.Setenv("ENCRYPTION_KEY_FILE", "")
+	t.Setenv("ENCRYPTION_ACTIVE_KEY", active)
+	if err := encryption.Configure(); err != nil {
+		t.Fatalf("configuring encryption: %v", err)
+	}
+}
+
+func TestReencryptDataRotatesKeys(t *testing.T) {
+	useEncryptionKeys(t, "old", "old")
+	sealed := func(plaintext, field string, rowID int) string {
+		value, err := encryption.Encrypt(plaintext, field, rowID)
+		if err != nil {
+			t.Fatalf("Encrypt: %v", err)
+		}
+		return value
+	}
+	moodText := sealed("rough morning", fieldMoodText, 1)
+
+	store := &columnStore{values: make(map[string]map[int]string)}
+	for _, col := range encryptedColumns {
+		store.values[col.table+"."+col.column] = make(map[int]string)
+	}
+	store.values[fieldMoodText][1] = moodText
+	// Copied from row 1, so it doesn't decrypt and is left alone
+	store.values[fieldMoodText][2] = moodText
+	store.values[fieldTaskNotes][5] = sealed("call the bank", fieldTaskNotes, 5)
+	store.values[fieldTaskDescription][5] = "written before encryption"
+	store.values[fieldTaskDescription][6] = ""
+	store.values[fieldTOTPSecret][7] = "JBSWY3DPEHPK3PXP"
+	db := openColumnStore(t, store)
+
+	useEncryptionKeys(t, "new", "old", "new")
+	n, err := ReencryptData(db)
+	if err != nil {
+		t.Fatalf("ReencryptData: %v", err)
+	}
+	if n != 4 {
+		t.Errorf("ReencryptData rewrote %d values, want 4", n)
+	}
+
+	want := []struct {
+		field     string
+		rowID     int
+		plaintext string
+	}{
+		{fieldMoodText, 1, "rough morning"},
+		{fieldTaskNotes, 5, "call the bank"},
+		{fieldTaskDescription, 5, "written before encryption"},
+		{fieldTOTPSecret, 7, "JBSWY3DPEHPK3PXP"},
+	}
+	for _, w := range want {
+		value := store.values[w.field][w.rowID]
+		if !strings.HasPrefix(value, encryption.ActivePrefix()) {
+			t.Errorf("%s row %d = %q, want it sealed with the active key", w.field, w.rowID, value)
+		}
+		if got, err := encryption.Decrypt(value, w.field, w.rowID); err != nil || got != w.plaintext {
+			t.Errorf("%s row %d decrypts to %q, %v, want %q", w.field, w.rowID, got, err, w.plaintext)
+		}
+	}
+	if store.values[fieldMoodText][2] != moodText {
+		t.Errorf("value copied to another row was rewritten")
+	}
+	if store.values[fieldTaskDescription][6] != "" {
+		t.Errorf("empty value was rewritten")
+	}
+
+	// Once rotated, the old key can go
+	useEncryptionKeys(t, "new", "new")
+	if n, err := ReencryptData(db); err != nil || n != 0 {
+		t.Errorf("second ReencryptData = %d, %v, want nothing left to rewrite", n, err)
+	}
+}
@@ -0,0 +1,488 @@
+package handlers
+
+import (
+	"database/sql"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"mmtm/encryption"
+	"mmtm/middleware"
+	"mmtm/models"
+)
+
+const (
+	// defaultFocusMinutes is the length of a focus session unless planned
+	// otherwise
+	defaultFocusMinutes = 25
+	// focusStatsDays is how many days of sessions the stats cover by default
+	focusStatsDays = 30
+	// focusPerformanceWindow is how far back focus sessions inform the
+	// Focused strategy
+	focusPerformanceWindow = 30 * 24 * time.Hour
+	// minFocusSessions is how many ended sessions a category needs before
+	// its focus performance is trusted
+	minFocusSessions = 3
+)
+
+// focusedSeconds is the time focused in session f: since it started, up to
+// when it ended, was paused or now, less the time spent paused.
+const focusedSeconds = `GREATEST(EXTRACT(EPOCH FROM COALESCE(f.ended_at, f.paused_at, NOW()) - f.started_at)::bigint - f.paused_seconds, 0)`
+
+// focusSessionColumns is the column list scanned by scanFocusSession,
+// selected from focus_sessions f. The task title is only shown while the
+// user can still see the task.
+const focusSessionColumns = `f.id, f.task_id, COALESCE(t.title, ''), f.planned_minutes, f.status, f.start_mood,
+	f.started_at, f.paused_at, f.paused_seconds, f.ended_at, ` + focusedSeconds + `, f.mood_log_id, COALESCE(m.mood, '')`
+
+// focusSessionJoins joins a focus session f to its task t and check-in m.
+var focusSessionJoins = `
+	LEFT JOIN tasks t ON t.id = f.task_id AND ` + visibleTasks("t.", "f.user_id") + `
+	LEFT JOIN mood_logs m ON m.id = f.mood_log_id`
+
+func scanFocusSession(row rowScanner, session *models.FocusSession) error {
+	return row.Scan(&session.ID, &session.TaskID, &session.TaskTitle, &session.PlannedMinutes,
+		&session.Status, &session.StartMood, &session.StartedAt, &session.PausedAt,
+		&session.PausedSeconds, &session.EndedAt, &session.FocusedSeconds, &session.MoodLogID,
+		&session.CheckInMood)
+}
+
+// openFocusSession returns the user's active or paused session, or nil if
+// they have none.
+func openFocusSession(q queryRower, userID int) (*models.FocusSession, error) {
+	var session models.FocusSession
+	err := scanFocusSession(q.QueryRow(`
+		SELECT `+focusSessionColumns+`
+		FROM focus_sessions f`+focusSessionJoins+`
+		WHERE f.user_id = $1 AND f.status IN ('active', 'paused')`, userID), &session)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// focusSessionID parses the session ID of a focus session route.
+func focusSessionID(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid focus session ID"})
+		return 0, false
+	}
+	return id, true
+}
+
+// StartFocusSession starts a focus session on a task. A user has at most one
+// open session, so starting one while another is active or paused is a
+// conflict.
+func (h *TaskHandler) StartFocusSession(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var req models.StartFocusRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.PlannedMinutes == 0 {
+		req.PlannedMinutes = defaultFocusMinutes
+	}
+
+	// The mood the session starts in is what the stats group it by
+	mood, err := recentMood(h.db, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch mood"})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	role, err := taskRole(tx, userID, req.TaskID)
+	if err != nil {
+		respondTaskError(c, err, "Database error")
+		return
+	}
+	if !canEditTasks(role) {
+		respondTaskError(c, errTaskForbidden, "")
+		return
+	}
+
+	// Serialize starts, so the check for an open session holds until commit
+	if _, err := tx.Exec("SELECT id FROM users WHERE id = $1 FOR UPDATE", userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	open, err := openFocusSession(tx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check open focus session"})
+		return
+	}
+	if open != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "A focus session is already open", "session": open})
+		return
+	}
+
+	var session models.FocusSession
+	err = scanFocusSession(tx.QueryRow(`
+		WITH f AS (
+			INSERT INTO focus_sessions (user_id, task_id, planned_minutes, start_mood)
+			VALUES ($1, $2, $3, $4)
+			RETURNING *)
+		SELECT `+focusSessionColumns+` FROM f`+focusSessionJoins,
+		userID, req.TaskID, req.PlannedMinutes, mood), &session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start focus session"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start focus session"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, session)
+}
+
+// GetFocusSession returns the user's open focus session.
+func (h *TaskHandler) GetFocusSession(c *gin.Context) {
+	open, err := openFocusSession(h.db, c.GetInt("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch focus session"})
+		return
+	}
+	if open == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No focus session is open"})
+		return
+	}
+
+	c.JSON(http.StatusOK, open)
+}
+
+// ListFocusSessions lists the user's focus sessions, newest first. ?limit=
+// caps how many are returned, 50 by default.
+func (h *TaskHandler) ListFocusSessions(c *gin.Context) {
+	limit := 50
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 200 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 200"})
+			return
+		}
+		limit = n
+	}
+
+	rows, err := h.db.Query(`
+		SELECT `+focusSessionColumns+`
+		FROM focus_sessions f`+focusSessionJoins+`
+		WHERE f.user_id = $1
+		ORDER BY f.started_at DESC, f.id DESC
+		LIMIT $2`, c.GetInt("user_id"), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch focus sessions"})
+		return
+	}
+	defer rows.Close()
+
+	sessions := []models.FocusSession{}
+	for rows.Next() {
+		var session models.FocusSession
+		if err := scanFocusSession(rows, &session); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan focus session"})
+			return
+		}
+		sessions = append(sessions, session)
+	}
+
+	c.JSON(http.StatusOK, sessions)
+}
+
+// PauseFocusSession pauses an active focus session. Paused time doesn't
+// count as focused.
+func (h *TaskHandler) PauseFocusSession(c *gin.Context) {
+	h.changeFocusSession(c, models.FocusActive, "status = 'paused', paused_at = NOW()",
+		"Only an active focus session can be paused")
+}
+
+// ResumeFocusSession resumes a paused focus session.
+func (h *TaskHandler) ResumeFocusSession(c *gin.Context) {
+	h.changeFocusSession(c, models.FocusPaused,
+		"status = 'active', paused_seconds = paused_seconds + EXTRACT(EPOCH FROM NOW() - paused_at)::integer, paused_at = NULL",
+		"Only a paused focus session can be resumed")
+}
+
+// changeFocusSession applies set to one of the user's focus sessions if it
+// is in the from state, and returns the session.
+func (h *TaskHandler) changeFocusSession(c *gin.Context, from, set, conflict string) {
+	userID := c.GetInt("user_id")
+	id, ok := focusSessionID(c)
+	if !ok {
+		return
+	}
+
+	var session models.FocusSession
+	err := scanFocusSession(h.db.QueryRow(`
+		WITH f AS (
+			UPDATE focus_sessions SET `+set+`
+			WHERE id = $1 AND user_id = $2 AND status = $3
+			RETURNING *)
+		SELECT `+focusSessionColumns+` FROM f`+focusSessionJoins,
+		id, userID, from), &session)
+	if err == sql.ErrNoRows {
+		var exists bool
+		err = h.db.QueryRow("SELECT EXISTS (SELECT 1 FROM focus_sessions WHERE id = $1 AND user_id = $2)",
+			id, userID).Scan(&exists)
+		if err == nil && !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Focus session not found"})
+			return
+		}
+		if err == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": conflict})
+			return
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update focus session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, session)
+}
+
+// CompleteFocusSession ends a focus session that went as planned.
+func (h *TaskHandler) CompleteFocusSession(c *gin.Context) {
+	h.endFocusSession(c, models.FocusCompleted)
+}
+
+// InterruptFocusSession ends a focus session that was cut short.
+func (h *TaskHandler) InterruptFocusSession(c *gin.Context) {
+	h.endFocusSession(c, models.FocusInterrupted)
+}
+
+// endFocusSession ends one of the user's open focus sessions with status. The
+// body may carry a quick mood check-in, which is logged with the user's
+// other moods. API tokens need the mood:write scope to check in.
+func (h *TaskHandler) endFocusSession(c *gin.Context, status string) {
+	userID := c.GetInt("user_id")
+	id, ok := focusSessionID(c)
+	if !ok {
+		return
+	}
+
+	// The body, with an optional check-in, may be left out
+	var req models.EndFocusRequest
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Mood != "" && !middleware.HasScope(c, models.ScopeMoodWrite) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "API token is missing the " + models.ScopeMoodWrite + " scope"})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var current string
+	err = tx.QueryRow("SELECT status FROM focus_sessions WHERE id = $1 AND user_id = $2 FOR UPDATE",
+		id, userID).Scan(&current)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Focus session not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if current != models.FocusActive && current != models.FocusPaused {
+		c.JSON(http.StatusConflict, gin.H{"error": "The focus session has already ended"})
+		return
+	}
+
+	var moodLogID *int
+	if req.Mood != "" {
+		id, err := nextID(tx, "mood_logs")
+		var note string
+		if err == nil {
+			note, err = encryption.Encrypt(req.Note, fieldMoodText, id)
+		}
+		if err == nil {
+			_, err = tx.Exec(`
+				INSERT INTO mood_logs (id, user_id, mood, confidence, text_input, source)
+				VALUES ($1, $2, $3, 1, $4, $5)`, id, userID, req.Mood, note, models.MoodSourceCheckIn)
+			moodLogID = &id
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log mood"})
+			return
+		}
+	}
+
+	// A session ended while paused stops counting at the pause
+	var session models.FocusSession
+	err = scanFocusSession(tx.QueryRow(`
+		WITH f AS (
+			UPDATE focus_sessions
+			SET status = $3, ended_at = NOW(), mood_log_id = $4,
+			    paused_seconds = paused_seconds + COALESCE(EXTRACT(EPOCH FROM NOW() - paused_at)::integer, 0),
+			    paused_at = NULL
+			WHERE id = $1 AND user_id = $2
+			RETURNING *)
+		SELECT `+focusSessionColumns+` FROM f`+focusSessionJoins,
+		id, userID, status, moodLogID), &session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to end focus session"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to end focus session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, session)
+}
+
+// GetFocusStats sums the user's ended focus sessions over the last ?days=
+// days, 30 by default: how many were completed and how long they focused,
+// overall, by task category and by the mood they started in.
+func (h *TaskHandler) GetFocusStats(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	days := focusStatsDays
+	if value := c.Query("days"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 365 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "days must be between 1 and 365"})
+			return
+		}
+		days = n
+	}
+
+	// Sessions on tasks the user can no longer see count without a category
+	rows, err := h.db.Query(`
+		SELECT f.status, COALESCE(t.category, ''), f.start_mood, COALESCE(m.mood, ''), `+focusedSeconds+`
+		FROM focus_sessions f`+focusSessionJoins+`
+		WHERE f.user_id = $1 AND f.ended_at IS NOT NULL AND f.started_at >= $2`,
+		userID, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch focus sessions"})
+		return
+	}
+	defer rows.Close()
+
+	stats := models.FocusStats{
+		Days:       days,
+		ByCategory: make(map[string]models.FocusGroup),
+		ByMood:     make(map[string]models.FocusGroup),
+		CheckIns:   make(map[string]int),
+	}
+	var focused int
+	for rows.Next() {
+		var status, category, startMood, checkIn string
+		var seconds int
+		if err := rows.Scan(&status, &category, &startMood, &checkIn, &seconds); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan focus session"})
+			return
+		}
+
+		completed := status == models.FocusCompleted
+		stats.Sessions++
+		if completed {
+			stats.Completed++
+		} else {
+			stats.Interrupted++
+		}
+		focused += seconds
+
+		if category != "" {
+			stats.ByCategory[category] = addFocusSession(stats.ByCategory[category], completed, seconds)
+		}
+		if startMood != "" {
+			stats.ByMood[startMood] = addFocusSession(stats.ByMood[startMood], completed, seconds)
+		}
+		if checkIn != "" {
+			stats.CheckIns[checkIn]++
+		}
+	}
+
+	stats.FocusedMinutes = focused / 60
+	if stats.Sessions > 0 {
+		stats.CompletionRate = completionRate(stats.Completed, stats.Sessions)
+		stats.AverageFocusedMinutes = focused / stats.Sessions / 60
+	}
+	for key, group := range stats.ByCategory {
+		group.CompletionRate = completionRate(group.Completed, group.Sessions)
+		stats.ByCategory[key] = group
+	}
+	for key, group := range stats.ByMood {
+		group.CompletionRate = completionRate(group.Completed, group.Sessions)
+		stats.ByMood[key] = group
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
+
+// addFocusSession counts an ended session towards group. The focused
+// minutes are rounded down per session.
+func addFocusSession(group models.FocusGroup, completed bool, seconds int) models.FocusGroup {
+	group.Sessions++
+	if completed {
+		group.Completed++
+	}
+	group.FocusedMinutes += seconds / 60
+	return group
+}
+
+// completionRate is completed over sessions, rounded to two decimals.
+func completionRate(completed, sessions int) float64 {
+	return math.Round(float64(completed)/float64(sessions)*100) / 100
+}
+
+// focusPerformance returns, per category, how well the user's recent focus
+// sessions on its tasks went, for categories with enough of them: 0.5 plus
+// the share of sessions completed, so from 0.5 to 1.5.
+func focusPerformance(db *sql.DB, userID int) (map[string]float64, error) {
+	rows, err := db.Query(`
+		SELECT t.category, COUNT(*), COUNT(*) FILTER (WHERE f.status = 'completed')
+		FROM focus_sessions f
+		JOIN tasks t ON t.id = f.task_id AND `+visibleTasks("t.", "f.user_id")+`
+		WHERE f.user_id = $1 AND f.ended_at IS NOT NULL AND f.started_at >= $2
+		GROUP BY t.category
+		HAVING COUNT(*) >= $3`, userID, time.Now().Add(-focusPerformanceWindow), minFocusSessions)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	performance := make(map[string]float64)
+	for rows.Next() {
+		var category string
+		var sessions, completed int
+		if err := rows.Scan(&category, &sessions, &completed); err != nil {
+			return nil, err
+		}
+		performance[category] = 0.5 + float64(completed)/float64(sessions)
+	}
+	return performance, rows.Err()
+}
+
+// focusWeight is the weight the Focused strategy gives a category's tasks:
+// its focus performance, or 1 without enough sessions.
+func focusWeight(focus map[string]float64, category string) float64 {
+	if weight, ok := focus[category]; ok {
+		return weight
+	}
+	return 1
+}
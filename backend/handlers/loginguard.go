@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"mmtm/ratelimit"
+)
+
+// Login attempts are limited per client IP and per account. On top of that,
+// repeated failures lock the account or IP out for exponentially growing
+// periods.
+var (
+	loginIPLimit      = ratelimit.Every(6*time.Second, 20)
+	loginAccountLimit = ratelimit.Every(time.Minute, 10)
+
+	loginIPLockout = ratelimit.LockoutPolicy{
+		Threshold: 20, Base: time.Minute, Max: time.Hour, Window: time.Hour,
+	}
+	loginAccountLockout = ratelimit.LockoutPolicy{
+		Threshold: 5, Base: time.Minute, Max: time.Hour, Window: time.Hour,
+	}
+)
+
+func loginIPKey(ip string) string {
+	return "login:ip:" + ip
+}
+
+func loginAccountKey(email string) string {
+	return "login:account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// loginBlocked takes a token from both login buckets and checks both
+// lockouts. It returns how long the client has to wait, or 0 when the attempt
+// may go ahead. Limiter errors let the attempt through.
+func (h *AuthHandler) loginBlocked(ctx context.Context, ip, email string) time.Duration {
+	var wait time.Duration
+	checks := []struct {
+		key   string
+		limit ratelimit.Limit
+	}{
+		{loginIPKey(ip), loginIPLimit},
+		{loginAccountKey(email), loginAccountLimit},
+	}
+
+	for _, check := range checks {
+		result, err := h.limiter.Allow(ctx, check.key, check.limit)
+		if err != nil {
+			log.Printf("Rate limiter error: %v", err)
+			continue
+		}
+		if !result.Allowed && result.RetryAfter > wait {
+			wait = result.RetryAfter
+		}
+
+		locked, err := h.limiter.LockedFor(ctx, check.key)
+		if err != nil {
+			log.Printf("Rate limiter error: %v", err)
+			continue
+		}
+		if locked > wait {
+			wait = locked
+		}
+	}
+	return wait
+}
+
+// loginFailed counts a failed attempt against the IP and the account.
+func (h *AuthHandler) loginFailed(ctx context.Context, ip, email string) {
+	if _, err := h.limiter.RecordFailure(ctx, loginIPKey(ip), loginIPLockout); err != nil {
+		log.Printf("Rate limiter error: %v", err)
+	}
+	if _, err := h.limiter.RecordFailure(ctx, loginAccountKey(email), loginAccountLockout); err != nil {
+		log.Printf("Rate limiter error: %v", err)
+	}
+}
+
+// loginSucceeded clears the account's failures. The IP's failures are kept,
+// so logging into one account can't be used to keep guessing others.
+func (h *AuthHandler) loginSucceeded(ctx context.Context, email string) {
+	if err := h.limiter.Reset(ctx, loginAccountKey(email)); err != nil {
+		log.Printf("Rate limiter error: %v", err)
+	}
+}
+
+func tooManyAttempts(c *gin.Context, wait time.Duration) {
+	c.Header("Retry-After", ratelimit.RetryAfter(wait))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many login attempts, please try again later"})
+}
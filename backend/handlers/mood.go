@@ -7,18 +7,26 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
+	"mmtm/encryption"
+	"mmtm/events"
 	"mmtm/models"
 )
 
+var validMoods = map[string]bool{
+	"Happy": true, "Tired": true, "Stressed": true, "Focused": true, "Energetic": true,
+}
+
 type MoodHandler struct {
-	db *sql.DB
+	db  *sql.DB
+	bus *events.Bus
 }
 
-func NewMoodHandler(db *sql.DB) *MoodHandler {
-	return &MoodHandler{db: db}
+func NewMoodHandler(db *sql.DB, bus *events.Bus) *MoodHandler {
+	return &MoodHandler{db: db, bus: bus}
 }
 
 func (h *MoodHandler) AnalyzeMood(c *gin.Context) {
@@ -38,13 +46,12 @@ func (h *MoodHandler) AnalyzeMood(c *gin.Context) {
 	}
 
 	// Log the mood analysis
-	_, err = h.db.Exec(`
-		INSERT INTO mood_logs (user_id, mood, confidence, text_input)
-		VALUES ($1, $2, $3, $4)`,
-		userID, mood, confidence, req.Text)
-	if err != nil {
+	moodLog := models.MoodLog{UserID: userID, Mood: mood, Confidence: confidence, Source: models.MoodSourceAnalysis}
+	if err := h.logMood(userID, req.Text, &moodLog); err != nil {
 		// Don't fail the request if logging fails
 		fmt.Printf("Failed to log mood: %v\n", err)
+	} else {
+		h.bus.Publish(events.Event{Type: events.MoodAnalyzed, ActorID: userID, MoodLog: moodLog})
 	}
 
 	response := models.MoodAnalysisResponse{
@@ -56,6 +63,37 @@ func (h *MoodHandler) AnalyzeMood(c *gin.Context) {
 	c.JSON(http.StatusOK, response)
 }
 
+// logMood stores an analysis with its encrypted journal text and queues the
+// webhooks for it in the same transaction.
+func (h *MoodHandler) logMood(userID int, text string, moodLog *models.MoodLog) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if moodLog.ID, err = nextID(tx, "mood_logs"); err != nil {
+		return err
+	}
+	sealed, err := encryption.Encrypt(text, fieldMoodText, moodLog.ID)
+	if err != nil {
+		return err
+	}
+	err = tx.QueryRow(`
+		INSERT INTO mood_logs (id, user_id, mood, confidence, text_input)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING created_at`,
+		moodLog.ID, userID, moodLog.Mood, moodLog.Confidence, sealed).Scan(&moodLog.CreatedAt)
+	if err != nil {
+		return err
+	}
+	event := events.Event{Type: events.MoodAnalyzed, ActorID: userID, MoodLog: *moodLog}
+	if err := enqueueWebhooks(tx, []events.Event{event}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func (h *MoodHandler) analyzeWithAI(text string) (string, float64, string, error) {
 	openaiKey := os.Getenv("OPENAI_API_KEY")
 	if openaiKey == "" {
@@ -144,9 +182,6 @@ Respond only with valid JSON.`, text)
 	}
 
 	// Validate the mood
-	validMoods := map[string]bool{
-		"Happy": true, "Tired": true, "Stressed": true, "Focused": true, "Energetic": true,
-	}
 	if !validMoods[result.Mood] {
 		return "", 0, "", fmt.Errorf("invalid mood returned: %s", result.Mood)
 	}
@@ -219,3 +254,13 @@ func (h *MoodHandler) analyzeWithKeywords(text string) (string, float64, string)
 
 	return detectedMood, confidence, explanation
 }
+
+// PurgeOldMoodLogs deletes mood logs older than retention and returns how
+// many it deleted.
+func PurgeOldMoodLogs(db *sql.DB, retention time.Duration) (int64, error) {
+	result, err := db.Exec("DELETE FROM mood_logs WHERE created_at < $1", time.Now().Add(-retention))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,262 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"mmtm/events"
+	"mmtm/models"
+)
+
+const (
+	defaultNotificationLimit = 50
+	maxNotificationLimit     = 100
+)
+
+type NotificationHandler struct {
+	db *sql.DB
+}
+
+func NewNotificationHandler(db *sql.DB) *NotificationHandler {
+	return &NotificationHandler{db: db}
+}
+
+// ListNotifications returns the user's newest notifications and how many are
+// unread. ?unread=true lists unread ones only, ?limit= caps the page and
+// ?before=<id> continues after the last notification of the previous page.
+func (h *NotificationHandler) ListNotifications(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	limit := defaultNotificationLimit
+	if l := c.Query("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > maxNotificationLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 100"})
+			return
+		}
+		limit = n
+	}
+
+	query := `
+		SELECT id, type, message, task_id, comment_id, actor_id, read_at, created_at
+		FROM notifications WHERE user_id = $1`
+	args := []interface{}{userID}
+	if c.Query("unread") == "true" {
+		query += " AND read_at IS NULL"
+	}
+	if before := c.Query("before"); before != "" {
+		id, err := strconv.Atoi(before)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid before ID"})
+			return
+		}
+		args = append(args, id)
+		query += " AND id < $" + strconv.Itoa(len(args))
+	}
+	args = append(args, limit)
+	query += " ORDER BY id DESC LIMIT $" + strconv.Itoa(len(args))
+
+	rows, err := h.db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch notifications"})
+		return
+	}
+	defer rows.Close()
+
+	list := models.NotificationList{Notifications: []models.Notification{}}
+	for rows.Next() {
+		var n models.Notification
+		if err := rows.Scan(&n.ID, &n.Type, &n.Message, &n.TaskID, &n.CommentID, &n.ActorID,
+			&n.ReadAt, &n.CreatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan notification"})
+			return
+		}
+		list.Notifications = append(list.Notifications, n)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch notifications"})
+		return
+	}
+
+	err = h.db.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = $1 AND read_at IS NULL",
+		userID).Scan(&list.UnreadCount)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count notifications"})
+		return
+	}
+
+	c.JSON(http.StatusOK, list)
+}
+
+// MarkNotificationRead marks one of the user's notifications as read.
+func (h *NotificationHandler) MarkNotificationRead(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	notificationID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid notification ID"})
+		return
+	}
+
+	var n models.Notification
+	err = h.db.QueryRow(`
+		UPDATE notifications SET read_at = COALESCE(read_at, CURRENT_TIMESTAMP)
+		WHERE id = $1 AND user_id = $2
+		RETURNING id, type, message, task_id, comment_id, actor_id, read_at, created_at`,
+		notificationID, userID).Scan(&n.ID, &n.Type, &n.Message, &n.TaskID, &n.CommentID, &n.ActorID,
+		&n.ReadAt, &n.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Notification not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update notification"})
+		return
+	}
+
+	c.JSON(http.StatusOK, n)
+}
+
+// MarkAllNotificationsRead marks all of the user's notifications as read.
+func (h *NotificationHandler) MarkAllNotificationsRead(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	result, err := h.db.Exec(`
+		UPDATE notifications SET read_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND read_at IS NULL`, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update notifications"})
+		return
+	}
+	marked, _ := result.RowsAffected()
+
+	c.JSON(http.StatusOK, gin.H{"marked": marked})
+}
+
+// createNotification stores a notification for n.UserID unless one with the
+// same dedupe key exists already, or it is about a task the user can't see.
+// It returns the stored notification, or nil if it was skipped. The unique
+// index on dedupe keys keeps concurrent producers from storing duplicates.
+func createNotification(q queryRower, n models.Notification) (*models.Notification, error) {
+	var dedupeKey *string
+	if n.DedupeKey != "" {
+		dedupeKey = &n.DedupeKey
+	}
+	err := q.QueryRow(`
+		INSERT INTO notifications (user_id, type, message, task_id, comment_id, actor_id, dedupe_key)
+		SELECT $1::integer, $2::varchar, $3::text, $4::integer, $5::integer, $6::integer, $7::varchar
+		WHERE $4::integer IS NULL OR EXISTS (
+		        SELECT 1 FROM tasks WHERE id = $4 AND `+visibleTasks("", "$1")+`)
+		ON CONFLICT (user_id, dedupe_key) DO NOTHING
+		RETURNING id, created_at`,
+		n.UserID, n.Type, n.Message, n.TaskID, n.CommentID, n.ActorID, dedupeKey).Scan(&n.ID, &n.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+// RegisterNotifications subscribes the producers that turn task events into
+// notifications. New triggers publish an event and add a producer here.
+func RegisterNotifications(bus *events.Bus, db *sql.DB) {
+	// notify stores a notification and announces it to the user's clients
+	notify := func(n models.Notification) error {
+		created, err := createNotification(db, n)
+		if err != nil || created == nil {
+			return err
+		}
+		bus.Publish(events.Event{Type: events.NotificationCreated, Notification: *created})
+		return nil
+	}
+
+	bus.Subscribe(events.TaskAssigned, func(e events.Event) error {
+		actor, err := username(db, e.ActorID)
+		if err != nil {
+			return err
+		}
+		return notify(models.Notification{
+			UserID:  *e.Task.AssigneeID,
+			Type:    models.NotificationAssigned,
+			Message: fmt.Sprintf("%s assigned %q to you", actor, e.Task.Title),
+			TaskID:  &e.Task.ID,
+			ActorID: &e.ActorID,
+		})
+	})
+
+	bus.Subscribe(events.CommentMention, func(e events.Event) error {
+		actor, err := username(db, e.ActorID)
+		if err != nil {
+			return err
+		}
+		for _, userID := range e.UserIDs {
+			err := notify(models.Notification{
+				UserID:    userID,
+				Type:      models.NotificationMention,
+				Message:   fmt.Sprintf("%s mentioned you in a comment on %q", actor, e.Task.Title),
+				TaskID:    &e.Task.ID,
+				CommentID: &e.CommentID,
+				ActorID:   &e.ActorID,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	// Due date reminders go to whoever is responsible for the task and are
+	// sent once per due date, so moving the date sends them again
+	dueDateReminder := func(notificationType string, message func(task models.Task) string) events.Handler {
+		return func(e events.Event) error {
+			return notify(models.Notification{
+				UserID:    taskOwner(e.Task),
+				Type:      notificationType,
+				Message:   message(e.Task),
+				TaskID:    &e.Task.ID,
+				DedupeKey: fmt.Sprintf("%s:%d:%d", notificationType, e.Task.ID, e.Task.DueDate.Unix()),
+			})
+		}
+	}
+	// The due soon window is configurable, so the message gives the date
+	// rather than how far off it is
+	bus.Subscribe(events.TaskDueSoon, dueDateReminder(models.NotificationDueSoon, func(task models.Task) string {
+		return fmt.Sprintf("%q is due soon, on %s", task.Title, task.DueDate.UTC().Format("January 2, 2006 15:04 MST"))
+	}))
+	bus.Subscribe(events.TaskOverdue, dueDateReminder(models.NotificationOverdue, func(task models.Task) string {
+		return fmt.Sprintf("%q is overdue", task.Title)
+	}))
+	bus.Subscribe(events.TaskAtRisk, dueDateReminder(models.NotificationAtRisk, func(task models.Task) string {
+		return fmt.Sprintf("%q is strict and due soon, but not far enough along to finish in time", task.Title)
+	}))
+
+	bus.Subscribe(events.DailyDigest, func(e events.Event) error {
+		return notify(models.Notification{
+			UserID: e.Digest.UserID,
+			Type:   models.NotificationDigest,
+			Message: fmt.Sprintf("Your day: %d due today, %d overdue, %d completed yesterday",
+				e.Digest.DueToday, e.Digest.Overdue, e.Digest.CompletedYesterday),
+			DedupeKey: "digest:" + e.Digest.Date,
+		})
+	})
+}
+
+// taskOwner is the user responsible for a task: its assignee, or its
+// creator while it has none.
+func taskOwner(task models.Task) int {
+	if task.AssigneeID != nil {
+		return *task.AssigneeID
+	}
+	return task.UserID
+}
+
+func username(q queryRower, userID int) (string, error) {
+	var name string
+	err := q.QueryRow("SELECT username FROM users WHERE id = $1", userID).Scan(&name)
+	return name, err
+}
@@ -0,0 +1,258 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"mmtm/models"
+	"mmtm/oidc"
+)
+
+// oidcLoginTTL is how long a user has to finish logging in at the provider.
+const oidcLoginTTL = 10 * time.Minute
+
+var errUnverifiedEmail = errors.New("identity provider did not return a verified email")
+
+// errUnverifiedAccount is returned when the identity's email belongs to a
+// local account that never verified it. Anyone can register with any email,
+// so linking could hand the account, and whoever holds its password, to the
+// identity.
+var errUnverifiedAccount = errors.New("local account with this email is not verified")
+
+var usernameDisallowed = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+type OIDCHandler struct {
+	db       *sql.DB
+	provider *oidc.Provider
+}
+
+func NewOIDCHandler(db *sql.DB, provider *oidc.Provider) *OIDCHandler {
+	return &OIDCHandler{db: db, provider: provider}
+}
+
+// Authorize starts a single sign-on login. The client sends the user to the
+// returned URL; the provider redirects back to OIDC_REDIRECT_URL with a code
+// and the state, which the client posts to Callback.
+func (h *OIDCHandler) Authorize(c *gin.Context) {
+	state, err := generateToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+		return
+	}
+	nonce, err := generateToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+		return
+	}
+	verifier, err := generateToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+		return
+	}
+
+	authURL, err := h.provider.AuthCodeURL(c.Request.Context(), state, nonce, verifier)
+	if err != nil {
+		log.Printf("OIDC authorize: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Identity provider unavailable"})
+		return
+	}
+
+	// Abandoned logins are cleaned up whenever a new one starts
+	h.db.Exec("DELETE FROM oidc_login_requests WHERE expires_at < NOW()")
+
+	_, err = h.db.Exec(`
+		INSERT INTO oidc_login_requests (state_hash, nonce, code_verifier, expires_at)
+		VALUES ($1, $2, $3, $4)`,
+		hashToken(state), nonce, verifier, time.Now().Add(oidcLoginTTL))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.OIDCAuthorizeResponse{AuthorizationURL: authURL, State: state})
+}
+
+// Callback finishes a single sign-on login and starts a session like Login.
+func (h *OIDCHandler) Callback(c *gin.Context) {
+	var req models.OIDCCallbackRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Each state can be used once
+	var nonce, verifier string
+	var expiresAt time.Time
+	err := h.db.QueryRow(`
+		DELETE FROM oidc_login_requests WHERE state_hash = $1
+		RETURNING nonce, code_verifier, expires_at`, hashToken(req.State)).Scan(&nonce, &verifier, &expiresAt)
+	if err == sql.ErrNoRows || (err == nil && time.Now().After(expiresAt)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired login state"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	identity, err := h.provider.Exchange(c.Request.Context(), req.Code, verifier, nonce)
+	if err != nil {
+		log.Printf("OIDC callback: %v", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Single sign-on failed"})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	user, err := findOrProvisionOIDCUser(tx, identity)
+	if err == errUnverifiedEmail {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Your identity provider account has no verified email"})
+		return
+	}
+	if err == errUnverifiedAccount {
+		c.JSON(http.StatusConflict, gin.H{"error": "An account with this email exists but its email isn't verified. Verify it, or reset its password, then sign in again"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign in"})
+		return
+	}
+
+	// The provider stands in for the password only: with 2FA the login
+	// continues at POST /auth/2fa/verify like a password login
+	enabled, err := twoFactorEnabled(tx, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if enabled {
+		challenge, err := issueUserToken(tx, user.ID, purposeLoginChallenge, loginChallengeTTL)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign in"})
+			return
+		}
+		c.JSON(http.StatusOK, models.TwoFactorChallengeResponse{
+			TwoFactorRequired: true,
+			ChallengeToken:    challenge,
+			ExpiresAt:         time.Now().Add(loginChallengeTTL),
+		})
+		return
+	}
+
+	if !checkDeletedAccount(c, tx, user.ID, req.Restore) {
+		return
+	}
+
+	tokens, err := createSession(c, tx, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign in"})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.AuthResponse{
+		Token:        tokens.Token,
+		ExpiresAt:    tokens.ExpiresAt,
+		RefreshToken: tokens.RefreshToken,
+		User:         user,
+	})
+}
+
+// findOrProvisionOIDCUser returns the user linked to an identity. Unlinked
+// identities are linked to the user with the same email if that user has
+// verified it, or get a new user without a password.
+func findOrProvisionOIDCUser(tx *sql.Tx, identity *oidc.Identity) (models.User, error) {
+	var user models.User
+	err := scanUser(tx.QueryRow(`
+		SELECT `+userColumns+` FROM users
+		WHERE id = (SELECT user_id FROM user_identities WHERE issuer = $1 AND subject = $2)`,
+		identity.Issuer, identity.Subject), &user)
+	if err != sql.ErrNoRows {
+		return user, err
+	}
+
+	if identity.Email == "" || !identity.EmailVerified {
+		return user, errUnverifiedEmail
+	}
+
+	var verified bool
+	err = tx.QueryRow(`
+		SELECT id, email_verified_at IS NOT NULL FROM users
+		WHERE LOWER(email) = LOWER($1)
+		FOR UPDATE`, identity.Email).Scan(&user.ID, &verified)
+	switch {
+	case err == sql.ErrNoRows:
+		user, err = provisionOIDCUser(tx, identity)
+	case err == nil && !verified:
+		return user, errUnverifiedAccount
+	case err == nil:
+		err = scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = $1", user.ID), &user)
+	}
+	if err != nil {
+		return user, err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO user_identities (user_id, issuer, subject, email)
+		VALUES ($1, $2, $3, $4)`,
+		user.ID, identity.Issuer, identity.Subject, identity.Email)
+	return user, err
+}
+
+// provisionOIDCUser creates a user for a first-time single sign-on login. The
+// empty password hash never matches, so the user can only log in through SSO.
+func provisionOIDCUser(tx *sql.Tx, identity *oidc.Identity) (models.User, error) {
+	base := identity.PreferredUsername
+	if base == "" {
+		base, _, _ = strings.Cut(identity.Email, "@")
+	}
+	base = strings.Trim(usernameDisallowed.ReplaceAllString(base, ""), ".-_")
+	if len(base) < 3 {
+		base = "user"
+	}
+	if len(base) > 40 {
+		base = base[:40]
+	}
+
+	username := base
+	for n := 2; ; n++ {
+		var taken bool
+		err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = $1)", username).Scan(&taken)
+		if err != nil {
+			return models.User{}, err
+		}
+		if !taken {
+			break
+		}
+		username = fmt.Sprintf("%s-%d", base, n)
+	}
+
+	var user models.User
+	err := scanUser(tx.QueryRow(`
+		INSERT INTO users (username, email, password_hash, email_verified_at)
+		VALUES ($1, $2, '', CURRENT_TIMESTAMP)
+		RETURNING `+userColumns,
+		username, identity.Email), &user)
+	return user, err
+}
@@ -0,0 +1,458 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"mmtm/models"
+)
+
+const (
+	// maxPlanWindow is the longest span of working hours a plan covers
+	maxPlanWindow = 24 * time.Hour
+	// planMoodMaxAge is how recent a mood analysis must be to set the mood
+	// of a plan
+	planMoodMaxAge = 24 * time.Hour
+	// planSlot is the granularity of the plan's start and of task lengths
+	planSlot = 5 * time.Minute
+	// minPlanChunk is the shortest piece a task is split into to fill a gap
+	// before a busy block or a break
+	minPlanChunk = 15 * time.Minute
+	// learnedEstimateWindow is how far back completed tasks are used to
+	// learn how long a category takes
+	learnedEstimateWindow = 90 * 24 * time.Hour
+	// minLearnedTasks is how many tracked, completed tasks a category needs
+	// before its learned length is used
+	minLearnedTasks = 3
+)
+
+// pacing is how long to work before taking a break and how long the break is.
+type pacing struct {
+	focus time.Duration
+	rest  time.Duration
+}
+
+// moodPacing sizes work blocks and breaks for each mood: short blocks and
+// long breaks when tired, long uninterrupted blocks when focused.
+var moodPacing = map[string]pacing{
+	"Tired":     {focus: 25 * time.Minute, rest: 10 * time.Minute},
+	"Stressed":  {focus: 45 * time.Minute, rest: 10 * time.Minute},
+	"Happy":     {focus: 50 * time.Minute, rest: 10 * time.Minute},
+	"Energetic": {focus: 75 * time.Minute, rest: 10 * time.Minute},
+	"Focused":   {focus: 90 * time.Minute, rest: 15 * time.Minute},
+}
+
+var defaultPacing = pacing{focus: 50 * time.Minute, rest: 10 * time.Minute}
+
+// priorityEstimates stand in, in minutes, for tasks without an estimate.
+var priorityEstimates = map[string]int{"Low": 30, "Medium": 60, "High": 90}
+
+// PlanToday builds a time-boxed schedule of the user's open tasks for the
+// given working hours, around their busy blocks. The plan is only returned,
+// never stored.
+func (h *TaskHandler) PlanToday(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var req models.PlanRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !req.End.After(req.Start) || req.End.Sub(req.Start) > maxPlanWindow {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "end must be after start and at most 24 hours later"})
+		return
+	}
+	for _, block := range req.Busy {
+		if !block.End.After(block.Start) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Busy blocks must end after they start"})
+			return
+		}
+	}
+
+	// Time that has already passed can't be planned
+	start := req.Start
+	if now := time.Now(); start.Before(now) {
+		start = now.Add(planSlot - 1).Truncate(planSlot).In(req.Start.Location())
+	}
+	if !start.Before(req.End) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "These working hours are already over"})
+		return
+	}
+
+	mood := req.Mood
+	if mood == "" {
+		var err error
+		if mood, err = recentMood(h.db, userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch mood"})
+			return
+		}
+	}
+
+	// Plan the open tasks the user is responsible for
+	rows, err := h.db.Query(`
+		SELECT `+taskColumns+`
+		FROM tasks
+		WHERE `+visibleTasks("", "$1")+` AND status != 'Completed'
+		  AND COALESCE(assignee_id, user_id) = $1
+		ORDER BY due_date, id`, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tasks"})
+		return
+	}
+	defer rows.Close()
+
+	var tasks []models.Task
+	for rows.Next() {
+		var task models.Task
+		if err := scanTask(rows, &task); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan task"})
+			return
+		}
+		tasks = append(tasks, task)
+	}
+
+	deps, err := loadUnfinishedDependencies(h.db, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch dependencies"})
+		return
+	}
+
+	learned, err := learnedEstimates(h.db, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tracked time"})
+		return
+	}
+
+	var focus map[string]float64
+	if mood == "Focused" {
+		if focus, err = focusPerformance(h.db, userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch focus sessions"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, buildPlan(tasks, deps, learned, focus, mood, start, req.End, req.Busy))
+}
+
+// learnedEstimates returns, per category, the average minutes tracked on the
+// user's recently completed tasks, for categories with enough of them.
+func learnedEstimates(db *sql.DB, userID int) (map[string]int, error) {
+	rows, err := db.Query(`
+		SELECT category, AVG(minutes)::int
+		FROM (SELECT t.category, (SELECT `+trackedSeconds+` / 60 FROM time_entries e WHERE e.task_id = t.id) AS minutes
+		      FROM tasks t
+		      WHERE `+visibleTasks("t.", "$1")+` AND COALESCE(t.assignee_id, t.user_id) = $1
+		        AND t.status = 'Completed' AND t.updated_at > $2) completed
+		WHERE minutes > 0
+		GROUP BY category
+		HAVING COUNT(*) >= $3`, userID, time.Now().Add(-learnedEstimateWindow), minLearnedTasks)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	learned := make(map[string]int)
+	for rows.Next() {
+		var category string
+		var minutes int
+		if err := rows.Scan(&category, &minutes); err != nil {
+			return nil, err
+		}
+		learned[category] = minutes
+	}
+	return learned, rows.Err()
+}
+
+// recentMood returns the mood of the user's latest analysis, or "" if there
+// was none recently.
+func recentMood(db *sql.DB, userID int) (string, error) {
+	var mood string
+	err := db.QueryRow(`
+		SELECT mood FROM mood_logs
+		WHERE user_id = $1 AND created_at > $2
+		ORDER BY created_at DESC LIMIT 1`, userID, time.Now().Add(-planMoodMaxAge)).Scan(&mood)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return mood, err
+}
+
+// buildPlan schedules tasks, in planOrder, into the free time between start
+// and end. A task is only scheduled whole, after all of its unfinished
+// prerequisites among tasks, and a strict task only if it finishes by its
+// due date. Prerequisites outside tasks can't be planned around; tasks
+// waiting on them are listed in the plan's Waiting.
+func buildPlan(tasks []models.Task, deps map[int][]int, learned map[string]int, focus map[string]float64,
+	mood string, start, end time.Time, busy []models.TimeBlock) models.Plan {
+	pace, ok := moodPacing[mood]
+	if !ok {
+		pace = defaultPacing
+	}
+
+	plan := models.Plan{
+		Mood:         mood,
+		Start:        start,
+		End:          end.In(start.Location()),
+		FocusMinutes: int(pace.focus / time.Minute),
+		BreakMinutes: int(pace.rest / time.Minute),
+		Items:        []models.PlanItem{},
+		Unscheduled:  []models.UnscheduledTask{},
+		Waiting:      []models.WaitingTask{},
+	}
+
+	inPlan := make(map[int]bool, len(tasks))
+	for _, task := range tasks {
+		inPlan[task.ID] = true
+	}
+
+	slots, busyItems := freeSlots(start, end, busy)
+	plan.Items = append(plan.Items, busyItems...)
+	var free time.Duration
+	for _, s := range slots {
+		free += s.end.Sub(s.start)
+	}
+
+	cursor := planCursor{slots: slots}
+	scheduled := make(map[int]bool)
+	for _, task := range planOrder(tasks, deps, focus, mood, end) {
+		need, guessed := remainingWork(task, learned)
+		skip := func(reason string) {
+			plan.Unscheduled = append(plan.Unscheduled, models.UnscheduledTask{
+				TaskID: task.ID, Title: task.Title, Minutes: int(need / time.Minute), Reason: reason,
+			})
+		}
+
+		blocked := false
+		var outside []int
+		for _, prereq := range deps[task.ID] {
+			if !inPlan[prereq] {
+				outside = append(outside, prereq)
+				continue
+			}
+			blocked = blocked || !scheduled[prereq]
+		}
+		if len(outside) > 0 {
+			plan.Waiting = append(plan.Waiting, models.WaitingTask{
+				TaskID: task.ID, Title: task.Title, PrerequisiteIDs: outside,
+			})
+		}
+		if blocked {
+			skip(models.PlanBlocked)
+			continue
+		}
+
+		items, next, ok := cursor.place(task, need, pace)
+		if !ok {
+			skip(models.PlanNotEnoughTime)
+			continue
+		}
+		// Strict tasks that are already overdue are planned as soon as possible
+		if task.Strict && task.DueDate.After(start) && items[len(items)-1].End.After(task.DueDate) {
+			skip(models.PlanWouldMissDue)
+			continue
+		}
+
+		for i := range items {
+			if items[i].Type == models.PlanItemTask {
+				items[i].GuessedEstimate = guessed
+			}
+		}
+		cursor = next
+		scheduled[task.ID] = true
+		plan.Items = append(plan.Items, items...)
+		plan.ScheduledMinutes += int(need / time.Minute)
+	}
+
+	sort.SliceStable(plan.Items, func(i, j int) bool {
+		return plan.Items[i].Start.Before(plan.Items[j].Start)
+	})
+	for _, item := range plan.Items {
+		if item.Type != models.PlanItemBusy {
+			free -= item.End.Sub(item.Start)
+		}
+	}
+	plan.FreeMinutes = int(free / time.Minute)
+	return plan
+}
+
+// planOrder ranks tasks for a plan. Strict tasks due before the plan ends
+// come first, earliest due date first. Then come reorganizable tasks in the
+// order of the mood's strategy, and the remaining tasks by due date. As with
+// reorganizing, no task comes before one of its unfinished prerequisites.
+// tasks must be sorted by due date.
+func planOrder(tasks []models.Task, deps map[int][]int, focus map[string]float64, mood string, end time.Time) []models.Task {
+	var urgent, ranked, rest []models.Task
+	for _, task := range tasks {
+		switch {
+		case task.Strict && !task.DueDate.After(end):
+			urgent = append(urgent, task)
+		case task.Reorganizable:
+			ranked = append(ranked, task)
+		default:
+			rest = append(rest, task)
+		}
+	}
+	reorganizeTasks(ranked, mood, focus)
+
+	ordered := append(append(urgent, ranked...), rest...)
+	orderByDependencies(ordered, deps)
+	return ordered
+}
+
+// remainingWork estimates the work left on a task from its progress and its
+// estimate. Without an estimate it uses how long the category has taken,
+// learned from tracked time, or else the task's priority, and reports that
+// the estimate was guessed.
+func remainingWork(task models.Task, learned map[string]int) (time.Duration, bool) {
+	estimate, guessed := priorityEstimates[task.Priority], true
+	if minutes, ok := learned[task.Category]; ok {
+		estimate = minutes
+	}
+	if task.EstimatedMinutes != nil {
+		estimate, guessed = *task.EstimatedMinutes, false
+	}
+
+	left := time.Duration(estimate*(100-task.Progress)) * time.Minute / 100
+	if rem := left % planSlot; rem != 0 {
+		left += planSlot - rem
+	}
+	if left < planSlot {
+		left = planSlot
+	}
+	return left, guessed
+}
+
+type timeSlot struct {
+	start time.Time
+	end   time.Time
+}
+
+// freeSlots returns the free time between start and end around the busy
+// blocks, and the busy blocks within it as plan items.
+func freeSlots(start, end time.Time, busy []models.TimeBlock) ([]timeSlot, []models.PlanItem) {
+	loc := start.Location()
+	blocks := append([]models.TimeBlock(nil), busy...)
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].Start.Before(blocks[j].Start)
+	})
+
+	var slots []timeSlot
+	var items []models.PlanItem
+	cursor := start
+	for _, block := range blocks {
+		blockStart, blockEnd := block.Start, block.End
+		if blockStart.Before(start) {
+			blockStart = start
+		}
+		if blockEnd.After(end) {
+			blockEnd = end
+		}
+		if !blockEnd.After(blockStart) {
+			continue
+		}
+
+		items = append(items, models.PlanItem{
+			Type:    models.PlanItemBusy,
+			Start:   blockStart.In(loc),
+			End:     blockEnd.In(loc),
+			Minutes: int(blockEnd.Sub(blockStart) / time.Minute),
+			Title:   block.Title,
+		})
+		if blockStart.After(cursor) {
+			slots = append(slots, timeSlot{start: cursor, end: blockStart.In(loc)})
+		}
+		if blockEnd.After(cursor) {
+			cursor = blockEnd.In(loc)
+		}
+	}
+	if end.After(cursor) {
+		slots = append(slots, timeSlot{start: cursor, end: end.In(loc)})
+	}
+	return slots, items
+}
+
+// planCursor is how far a plan has been filled: the free time left, and
+// how long has been worked since the last break.
+type planCursor struct {
+	slots  []timeSlot
+	worked time.Duration
+}
+
+// place lays out need worth of work on task from the cursor on, splitting
+// it around busy blocks and taking breaks according to pace. It returns the
+// items and the cursor after them, or false if the work doesn't fit. A busy
+// block at least as long as a break counts as one.
+func (c planCursor) place(task models.Task, need time.Duration, pace pacing) ([]models.PlanItem, planCursor, bool) {
+	slots := append([]timeSlot(nil), c.slots...)
+	worked := c.worked
+	advance := func() {
+		if len(slots) > 1 && slots[1].start.Sub(slots[0].end) >= pace.rest {
+			worked = 0
+		}
+		slots = slots[1:]
+	}
+
+	var items []models.PlanItem
+	for need > 0 {
+		if len(slots) == 0 {
+			return nil, c, false
+		}
+		slot := &slots[0]
+
+		// Break when the block is used up, or so nearly used up that only a
+		// sliver of the task would fit before the break
+		left := pace.focus - worked
+		if left <= 0 || (worked > 0 && left < need && left < minPlanChunk) {
+			breakEnd := slot.start.Add(pace.rest)
+			if breakEnd.After(slot.end) {
+				advance()
+				continue
+			}
+			items = append(items, models.PlanItem{
+				Type:    models.PlanItemBreak,
+				Start:   slot.start,
+				End:     breakEnd,
+				Minutes: int(pace.rest / time.Minute),
+			})
+			slot.start = breakEnd
+			worked = 0
+			left = pace.focus
+		}
+
+		available := slot.end.Sub(slot.start)
+		if available < need && available < minPlanChunk {
+			advance()
+			continue
+		}
+
+		chunk := need
+		if chunk > left {
+			chunk = left
+		}
+		if chunk > available {
+			chunk = available
+		}
+		taskID, dueDate := task.ID, task.DueDate
+		items = append(items, models.PlanItem{
+			Type:    models.PlanItemTask,
+			Start:   slot.start,
+			End:     slot.start.Add(chunk),
+			Minutes: int(chunk / time.Minute),
+			TaskID:  &taskID,
+			Title:   task.Title,
+			Strict:  task.Strict,
+			DueDate: &dueDate,
+		})
+		slot.start = slot.start.Add(chunk)
+		worked += chunk
+		need -= chunk
+		if !slot.start.Before(slot.end) {
+			advance()
+		}
+	}
+	return items, planCursor{slots: slots, worked: worked}, true
+}
@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"mmtm/models"
+)
+
+// at returns the time of day h:m on the day plans are built for in these tests.
+func at(h, m int) time.Time {
+	return time.Date(2026, time.March, 2, h, m, 0, 0, time.UTC)
+}
+
+func planTask(id, minutes int) models.Task {
+	return models.Task{
+		ID:               id,
+		Title:            "Task",
+		Priority:         "Medium",
+		Status:           "Todo",
+		DueDate:          at(0, 0).AddDate(0, 0, 7),
+		EstimatedMinutes: &minutes,
+	}
+}
+
+// taskOrder returns the task IDs of a plan's task items, in order.
+func taskOrder(items []models.PlanItem) []int {
+	var ids []int
+	for _, item := range items {
+		if item.Type == models.PlanItemTask {
+			ids = append(ids, *item.TaskID)
+		}
+	}
+	return ids
+}
+
+func TestFreeSlots(t *testing.T) {
+	busy := []models.TimeBlock{
+		{Start: at(13, 0), End: at(14, 0), Title: "Lunch"},
+		{Start: at(8, 0), End: at(9, 30), Title: "Early"},
+		{Start: at(10, 15), End: at(11, 0)},
+		{Start: at(10, 0), End: at(10, 30)},
+		{Start: at(16, 30), End: at(18, 0)},
+		{Start: at(18, 0), End: at(19, 0), Title: "After hours"},
+	}
+
+	slots, items := freeSlots(at(9, 0), at(17, 0), busy)
+
+	wantSlots := []timeSlot{
+		{start: at(9, 30), end: at(10, 0)},
+		{start: at(11, 0), end: at(13, 0)},
+		{start: at(14, 0), end: at(16, 30)},
+	}
+	if !reflect.DeepEqual(slots, wantSlots) {
+		t.Errorf("slots = %v, want %v", slots, wantSlots)
+	}
+
+	// Busy blocks are clipped to the working hours, and those outside them dropped
+	wantMinutes := []int{30, 30, 45, 60, 30}
+	var minutes []int
+	for _, item := range items {
+		if item.Type != models.PlanItemBusy {
+			t.Errorf("item type = %q, want %q", item.Type, models.PlanItemBusy)
+		}
+		minutes = append(minutes, item.Minutes)
+	}
+	if !reflect.DeepEqual(minutes, wantMinutes) {
+		t.Errorf("busy minutes = %v, want %v", minutes, wantMinutes)
+	}
+	if !items[0].Start.Equal(at(9, 0)) || !items[4].End.Equal(at(17, 0)) {
+		t.Errorf("busy blocks not clipped: first starts %v, last ends %v", items[0].Start, items[4].End)
+	}
+}
+
+func TestFreeSlotsWithoutBusyBlocks(t *testing.T) {
+	slots, items := freeSlots(at(9, 0), at(17, 0), nil)
+	want := []timeSlot{{start: at(9, 0), end: at(17, 0)}}
+	if !reflect.DeepEqual(slots, want) || len(items) != 0 {
+		t.Errorf("freeSlots = %v, %v, want %v and no items", slots, items, want)
+	}
+}
+
+func TestPlace(t *testing.T) {
+	pace := pacing{focus: 50 * time.Minute, rest: 10 * time.Minute}
+
+	type span struct {
+		typ        string
+		start, end time.Time
+	}
+	tests := []struct {
+		name       string
+		cursor     planCursor
+		need       time.Duration
+		want       []span
+		wantWorked time.Duration
+	}{
+		{
+			name:   "breaks after each block",
+			cursor: planCursor{slots: []timeSlot{{start: at(9, 0), end: at(12, 0)}}},
+			need:   120 * time.Minute,
+			want: []span{
+				{models.PlanItemTask, at(9, 0), at(9, 50)},
+				{models.PlanItemBreak, at(9, 50), at(10, 0)},
+				{models.PlanItemTask, at(10, 0), at(10, 50)},
+				{models.PlanItemBreak, at(10, 50), at(11, 0)},
+				{models.PlanItemTask, at(11, 0), at(11, 20)},
+			},
+			wantWorked: 20 * time.Minute,
+		},
+		{
+			name: "busy block counts as a break",
+			cursor: planCursor{slots: []timeSlot{
+				{start: at(9, 0), end: at(9, 30)},
+				{start: at(10, 0), end: at(12, 0)},
+			}},
+			need: 60 * time.Minute,
+			want: []span{
+				{models.PlanItemTask, at(9, 0), at(9, 30)},
+				{models.PlanItemTask, at(10, 0), at(10, 30)},
+			},
+			wantWorked: 30 * time.Minute,
+		},
+		{
+			name:   "breaks early rather than fitting a sliver",
+			cursor: planCursor{slots: []timeSlot{{start: at(9, 0), end: at(12, 0)}}, worked: 40 * time.Minute},
+			need:   30 * time.Minute,
+			want: []span{
+				{models.PlanItemBreak, at(9, 0), at(9, 10)},
+				{models.PlanItemTask, at(9, 10), at(9, 40)},
+			},
+			wantWorked: 30 * time.Minute,
+		},
+		{
+			name: "skips gaps too short for a chunk",
+			cursor: planCursor{slots: []timeSlot{
+				{start: at(9, 0), end: at(9, 10)},
+				{start: at(9, 20), end: at(12, 0)},
+			}},
+			need: 30 * time.Minute,
+			want: []span{
+				{models.PlanItemTask, at(9, 20), at(9, 50)},
+			},
+			wantWorked: 30 * time.Minute,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, next, ok := tt.cursor.place(planTask(1, 0), tt.need, pace)
+			if !ok {
+				t.Fatal("place reported the work doesn't fit")
+			}
+			var got []span
+			for _, item := range items {
+				got = append(got, span{item.Type, item.Start, item.End})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("items = %v, want %v", got, tt.want)
+			}
+			if next.worked != tt.wantWorked {
+				t.Errorf("worked = %v, want %v", next.worked, tt.wantWorked)
+			}
+		})
+	}
+}
+
+func TestPlaceDoesNotFit(t *testing.T) {
+	pace := pacing{focus: 50 * time.Minute, rest: 10 * time.Minute}
+	cursor := planCursor{slots: []timeSlot{{start: at(9, 0), end: at(9, 30)}}}
+
+	items, next, ok := cursor.place(planTask(1, 0), time.Hour, pace)
+	if ok || items != nil {
+		t.Fatalf("place = %v, %v, want no items and false", items, ok)
+	}
+	// The cursor is left as it was
+	if !reflect.DeepEqual(next, cursor) || !cursor.slots[0].start.Equal(at(9, 0)) {
+		t.Errorf("cursor changed to %v", next)
+	}
+}
+
+func TestBuildPlanOrdersByPrerequisites(t *testing.T) {
+	tasks := []models.Task{planTask(1, 20), planTask(2, 20)}
+	deps := map[int][]int{1: {2}}
+
+	plan := buildPlan(tasks, deps, nil, nil, "", at(9, 0), at(12, 0), nil)
+
+	if got := taskOrder(plan.Items); !reflect.DeepEqual(got, []int{2, 1}) {
+		t.Errorf("task order = %v, want [2 1]", got)
+	}
+	if len(plan.Unscheduled) != 0 || len(plan.Waiting) != 0 {
+		t.Errorf("unscheduled = %v, waiting = %v, want none", plan.Unscheduled, plan.Waiting)
+	}
+	if plan.ScheduledMinutes != 40 || plan.FreeMinutes != 140 {
+		t.Errorf("scheduled %d, free %d minutes, want 40 and 140", plan.ScheduledMinutes, plan.FreeMinutes)
+	}
+}
+
+func TestBuildPlanPrerequisiteOutsidePlan(t *testing.T) {
+	// Task 99 is someone else's, so it isn't among the tasks to plan
+	tasks := []models.Task{planTask(1, 20), planTask(2, 20)}
+	deps := map[int][]int{2: {99}}
+
+	plan := buildPlan(tasks, deps, nil, nil, "", at(9, 0), at(12, 0), nil)
+
+	if got := taskOrder(plan.Items); !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Errorf("task order = %v, want [1 2]", got)
+	}
+	if len(plan.Unscheduled) != 0 {
+		t.Errorf("unscheduled = %v, want none", plan.Unscheduled)
+	}
+	want := []models.WaitingTask{{TaskID: 2, Title: "Task", PrerequisiteIDs: []int{99}}}
+	if !reflect.DeepEqual(plan.Waiting, want) {
+		t.Errorf("waiting = %v, want %v", plan.Waiting, want)
+	}
+}
+
+func TestBuildPlanUnscheduled(t *testing.T) {
+	strict := planTask(3, 60)
+	strict.Strict = true
+	strict.DueDate = at(9, 30)
+
+	// Task 2 doesn't fit, which blocks task 1 that depends on it, and the
+	// strict task 3 can't finish by its due date
+	tasks := []models.Task{strict, planTask(1, 20), planTask(2, 120)}
+	deps := map[int][]int{1: {2}}
+
+	plan := buildPlan(tasks, deps, nil, nil, "", at(9, 0), at(11, 0), nil)
+
+	reasons := make(map[int]string)
+	for _, task := range plan.Unscheduled {
+		reasons[task.TaskID] = task.Reason
+	}
+	want := map[int]string{
+		1: models.PlanBlocked,
+		2: models.PlanNotEnoughTime,
+		3: models.PlanWouldMissDue,
+	}
+	if !reflect.DeepEqual(reasons, want) {
+		t.Errorf("unscheduled reasons = %v, want %v", reasons, want)
+	}
+	if len(plan.Items) != 0 || plan.FreeMinutes != 120 {
+		t.Errorf("items = %v, free %d minutes, want no items and 120", plan.Items, plan.FreeMinutes)
+	}
+}
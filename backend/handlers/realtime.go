@@ -0,0 +1,353 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"mmtm/events"
+	"mmtm/models"
+	"mmtm/realtime"
+)
+
+const (
+	// streamHeartbeat is how often an idle event stream sends a comment to
+	// keep proxies from closing it, and checks that its session is still
+	// active
+	streamHeartbeat = 25 * time.Second
+	// streamTicketTTL is how long a stream ticket can open a stream
+	streamTicketTTL = 30 * time.Second
+)
+
+type EventsHandler struct {
+	db        *sql.DB
+	broker    realtime.Broker
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewEventsHandler(db *sql.DB, broker realtime.Broker) *EventsHandler {
+	return &EventsHandler{db: db, broker: broker, done: make(chan struct{})}
+}
+
+// Close ends open event streams and any opened later, so a server shutting
+// down doesn't wait for clients that never disconnect. It is safe to call
+// more than once.
+func (h *EventsHandler) Close() {
+	h.closeOnce.Do(func() { close(h.done) })
+}
+
+// IssueTicket returns a single-use ticket that opens the event stream of the
+// caller's session when passed as ?ticket=, for clients that can't send an
+// Authorization header.
+func (h *EventsHandler) IssueTicket(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	sessionID := c.GetInt("session_id")
+
+	ticket, err := generateToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate ticket"})
+		return
+	}
+
+	// Unused tickets are cleaned up whenever a new one is issued
+	h.db.Exec("DELETE FROM stream_tickets WHERE expires_at < NOW()")
+
+	expiresAt := time.Now().Add(streamTicketTTL)
+	_, err = h.db.Exec(`
+		INSERT INTO stream_tickets (ticket_hash, user_id, session_id, expires_at)
+		VALUES ($1, $2, $3, $4)`,
+		hashToken(ticket), userID, sessionID, expiresAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue ticket"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"ticket": ticket, "expiresAt": expiresAt})
+}
+
+// Stream sends the user's live events as Server-Sent Events until the
+// client disconnects or its session is revoked. Each event is named after
+// its type and its data is JSON.
+func (h *EventsHandler) Stream(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	sessionID := c.GetInt("session_id")
+
+	sub := h.broker.Subscribe(userID)
+	defer sub.Close()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	w := c.Writer
+	if _, err := fmt.Fprint(w, "retry: 3000\n\n"); err != nil {
+		return
+	}
+	w.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+
+		case <-h.done:
+			return
+
+		case msg, ok := <-sub.C:
+			// A closed subscription fell behind; the client reconnects
+			if !ok {
+				return
+			}
+			data := msg.Data
+			if msg.Truncated {
+				data = json.RawMessage(`{"truncated":true}`)
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", msg.Type, data); err != nil {
+				return
+			}
+			w.Flush()
+
+		case <-heartbeat.C:
+			var active bool
+			err := h.db.QueryRow(`
+				SELECT EXISTS (SELECT 1 FROM sessions
+				               WHERE id = $1 AND revoked_at IS NULL AND expires_at > NOW())`,
+				sessionID).Scan(&active)
+			if err == nil && !active {
+				return
+			}
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			w.Flush()
+		}
+	}
+}
+
+// RegisterRealtime forwards the events clients care about to the broker,
+// addressed to the users who can see them. Messages name the records they
+// are about so other processes can load them again with RealtimeLoader.
+func RegisterRealtime(bus *events.Bus, db *sql.DB, broker realtime.Broker) {
+	send := func(msg realtime.Message, data interface{}) error {
+		if len(msg.UserIDs) == 0 {
+			return nil
+		}
+		payload, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		msg.Data = payload
+		return broker.Publish(msg)
+	}
+	gone := func(userIDs []int, taskID int) error {
+		msg := realtime.Message{UserIDs: userIDs, Type: events.TaskDeleted, IDs: []int{taskID}}
+		return send(msg, gin.H{"id": taskID})
+	}
+
+	taskChanged := func(e events.Event) error {
+		userIDs, err := taskAudience(db, e.Task)
+		if err != nil {
+			return err
+		}
+		if e.Type == events.TaskDeleted {
+			return gone(userIDs, e.Task.ID)
+		}
+		msg := realtime.Message{UserIDs: userIDs, Type: e.Type, IDs: []int{e.Task.ID}}
+		if err := send(msg, e.Task); err != nil {
+			return err
+		}
+
+		// A task moved out of a workspace is gone for the members who can't
+		// see it anymore
+		if e.Before == nil || sameWorkspace(e.Before.WorkspaceID, e.Task.WorkspaceID) {
+			return nil
+		}
+		before, err := taskAudience(db, *e.Before)
+		if err != nil {
+			return err
+		}
+		return gone(withoutUsers(before, userIDs), e.Task.ID)
+	}
+	bus.Subscribe(events.TaskCreated, taskChanged)
+	bus.Subscribe(events.TaskUpdated, taskChanged)
+	bus.Subscribe(events.TaskDeleted, taskChanged)
+
+	// Reorganized orders are personal, so only the user's other clients get them
+	bus.Subscribe(events.TasksReorganized, func(e events.Event) error {
+		ids := make([]int, len(e.Tasks))
+		for i, task := range e.Tasks {
+			ids[i] = task.ID
+		}
+		msg := realtime.Message{UserIDs: []int{e.ActorID}, Type: e.Type, IDs: ids, Mood: e.Mood}
+		return send(msg, gin.H{"mood": e.Mood, "tasks": e.Tasks})
+	})
+
+	bus.Subscribe(events.NotificationCreated, func(e events.Event) error {
+		msg := realtime.Message{UserIDs: []int{e.Notification.UserID}, Type: "notification",
+			IDs: []int{e.Notification.ID}}
+		return send(msg, e.Notification)
+	})
+}
+
+// RealtimeLoader loads the data of messages relayed from other processes the
+// way RegisterRealtime sends it. Task messages only go to the users who can
+// still see the task.
+func RealtimeLoader(db *sql.DB) realtime.Loader {
+	return func(msg *realtime.Message) error {
+		if msg.Type == events.TasksReorganized {
+			return loadReorganized(db, msg)
+		}
+		if len(msg.IDs) != 1 {
+			return fmt.Errorf("%s message with %d IDs", msg.Type, len(msg.IDs))
+		}
+		id := msg.IDs[0]
+
+		var data interface{}
+		switch msg.Type {
+		case events.TaskCreated, events.TaskUpdated:
+			task, err := loadTask(db, id)
+			if err != nil || task == nil {
+				return err
+			}
+			audience, err := taskAudience(db, *task)
+			if err != nil {
+				return err
+			}
+			msg.UserIDs = keepUsers(msg.UserIDs, audience)
+			data = task
+
+		case events.TaskDeleted:
+			data = gin.H{"id": id}
+
+		case "notification":
+			var n models.Notification
+			err := db.QueryRow(`
+				SELECT id, type, message, task_id, comment_id, actor_id, read_at, created_at
+				FROM notifications WHERE id = $1`, id).Scan(&n.ID, &n.Type, &n.Message, &n.TaskID,
+				&n.CommentID, &n.ActorID, &n.ReadAt, &n.CreatedAt)
+			if err == sql.ErrNoRows {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			data = n
+
+		default:
+			return fmt.Errorf("unknown message type %q", msg.Type)
+		}
+
+		payload, err := json.Marshal(data)
+		msg.Data = payload
+		return err
+	}
+}
+
+// loadReorganized loads the tasks of a reorganize in the order the actor
+// got, leaving out tasks the actor can no longer see.
+func loadReorganized(db *sql.DB, msg *realtime.Message) error {
+	if len(msg.UserIDs) != 1 {
+		return fmt.Errorf("reorganize message for %d users", len(msg.UserIDs))
+	}
+	userID := msg.UserIDs[0]
+
+	rows, err := db.Query("SELECT "+taskColumns+" FROM tasks WHERE "+visibleTasks("", "$1"), userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	byID := make(map[int]models.Task)
+	for rows.Next() {
+		var task models.Task
+		if err := scanTask(rows, &task); err != nil {
+			return err
+		}
+		byID[task.ID] = task
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	deps, err := loadUnfinishedDependencies(db, userID)
+	if err != nil {
+		return err
+	}
+
+	tasks := make([]models.Task, 0, len(msg.IDs))
+	for _, id := range msg.IDs {
+		if task, ok := byID[id]; ok {
+			tasks = append(tasks, task)
+		}
+	}
+	markBlocked(tasks, deps)
+
+	payload, err := json.Marshal(gin.H{"mood": msg.Mood, "tasks": tasks})
+	msg.Data = payload
+	return err
+}
+
+// taskAudience returns the users who can see a task: its creator for a
+// personal task, every member for a workspace task.
+func taskAudience(q querier, task models.Task) ([]int, error) {
+	if task.WorkspaceID == nil {
+		return []int{task.UserID}, nil
+	}
+
+	rows, err := q.Query("SELECT user_id FROM workspace_members WHERE workspace_id = $1", *task.WorkspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var userIDs []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, rows.Err()
+}
+
+func sameWorkspace(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// keepUsers returns the users in userIDs that are also in others.
+func keepUsers(userIDs, others []int) []int {
+	return filterUsers(userIDs, others, true)
+}
+
+// withoutUsers returns the users in userIDs that aren't in others.
+func withoutUsers(userIDs, others []int) []int {
+	return filterUsers(userIDs, others, false)
+}
+
+func filterUsers(userIDs, others []int, in bool) []int {
+	set := make(map[int]bool, len(others))
+	for _, id := range others {
+		set[id] = true
+	}
+	var kept []int
+	for _, id := range userIDs {
+		if set[id] == in {
+			kept = append(kept, id)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"mmtm/models"
+	"mmtm/recurrence"
+)
+
+const (
+	// maxExpandedOccurrences caps how many virtual occurrences a single
+	// recurring task contributes to an expanded listing.
+	maxExpandedOccurrences = 366
+	// maxExpandWindow is the longest window occurrences are expanded over
+	maxExpandWindow = 366 * 24 * time.Hour
+	// maxExpandDistance is how far from now an expanded window may start
+	maxExpandDistance = 10 * 366 * 24 * time.Hour
+)
+
+// normalizeRecurrenceRule validates a recurrence rule and returns it in
+// canonical form. An empty rule means the task does not repeat.
+func normalizeRecurrenceRule(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	rule, err := recurrence.Parse(value)
+	if err != nil {
+		return "", err
+	}
+	return rule.String(), nil
+}
+
+// scheduleNextOccurrence creates the occurrence following a completed
+// recurring task. It is idempotent: each task has at most one successor.
+func scheduleNextOccurrence(tx *sql.Tx, task models.Task) error {
+	rule, err := recurrence.Parse(task.RecurrenceRule)
+	if err != nil {
+		return err
+	}
+
+	next, ok := rule.Next(task.DueDate, task.Occurrence)
+	if !ok {
+		return nil
+	}
+
+	id, err := nextID(tx, "tasks")
+	if err != nil {
+		return err
+	}
+	description, notes, err := encryptTaskFields(id, task.Description, task.Notes)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO tasks (id, user_id, title, description, category, priority, status,
+		                  due_date, importance, progress, reorganizable, strict, notes,
+		                  recurrence_rule, occurrence, recurrence_parent_id, workspace_id, assignee_id,
+		                  estimated_minutes)
+		VALUES ($1, $2, $3, $4, $5, $6, 'Todo', $7, $8, 0, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+		ON CONFLICT (recurrence_parent_id) DO NOTHING`,
+		id, task.UserID, task.Title, description, task.Category, task.Priority,
+		next, task.Importance, task.Reorganizable, task.Strict, notes,
+		task.RecurrenceRule, task.Occurrence+1, task.ID, task.WorkspaceID, task.AssigneeID,
+		task.EstimatedMinutes)
+	return err
+}
+
+// taskWindow restricts a task listing to due dates within [from, to] and can
+// expand recurring tasks into their upcoming occurrences.
+type taskWindow struct {
+	from   time.Time
+	to     time.Time
+	expand bool
+}
+
+func parseTaskWindow(c *gin.Context) (*taskWindow, error) {
+	fromParam, toParam := c.Query("from"), c.Query("to")
+	expand := c.Query("expand") == "true"
+
+	if fromParam == "" && toParam == "" {
+		if expand {
+			return nil, fmt.Errorf("from and to are required to expand occurrences")
+		}
+		return nil, nil
+	}
+	if fromParam == "" || toParam == "" {
+		return nil, fmt.Errorf("from and to must be given together")
+	}
+
+	from, err := parseWindowBound(fromParam, false)
+	if err != nil {
+		return nil, fmt.Errorf("invalid from date")
+	}
+	to, err := parseWindowBound(toParam, true)
+	if err != nil {
+		return nil, fmt.Errorf("invalid to date")
+	}
+	if to.Before(from) {
+		return nil, fmt.Errorf("to must not be before from")
+	}
+	if expand {
+		if to.Sub(from) > maxExpandWindow {
+			return nil, fmt.Errorf("to must be at most a year after from to expand occurrences")
+		}
+		if now := time.Now(); from.Before(now.Add(-maxExpandDistance)) || from.After(now.Add(maxExpandDistance)) {
+			return nil, fmt.Errorf("from must be within ten years of today to expand occurrences")
+		}
+	}
+
+	return &taskWindow{from: from, to: to, expand: expand}, nil
+}
+
+// parseWindowBound accepts RFC 3339 timestamps or plain dates; a plain date
+// used as the end of a window includes the whole day.
+func parseWindowBound(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, nil
+}
+
+func (w *taskWindow) contains(t time.Time) bool {
+	return !t.Before(w.from) && !t.After(w.to)
+}
+
+// apply filters tasks to the window and, when expanding, adds virtual
+// occurrences for the open end of each recurring series.
+func (w *taskWindow) apply(tasks []models.Task) []models.Task {
+	hasSuccessor := make(map[int]bool)
+	for _, task := range tasks {
+		if task.RecurrenceParentID != nil {
+			hasSuccessor[*task.RecurrenceParentID] = true
+		}
+	}
+
+	result := []models.Task{}
+	for _, task := range tasks {
+		if w.contains(task.DueDate) {
+			result = append(result, task)
+		}
+
+		if !w.expand || task.RecurrenceRule == "" || hasSuccessor[task.ID] {
+			continue
+		}
+		rule, err := recurrence.Parse(task.RecurrenceRule)
+		if err != nil {
+			continue
+		}
+
+		for _, occ := range rule.Between(task.DueDate, task.Occurrence, w.from, w.to, maxExpandedOccurrences) {
+			virtual := task
+			virtual.Status = "Todo"
+			virtual.Progress = 0
+			virtual.DueDate = occ.Due
+			virtual.Occurrence = occ.Number
+			virtual.RecurrenceParentID = nil
+			virtual.Overdue = false
+			virtual.TrackedMinutes = 0
+			virtual.Blocked = false
+			virtual.Virtual = true
+			result = append(result, virtual)
+		}
+	}
+	return result
+}
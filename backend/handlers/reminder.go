@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"database/sql"
+	"time"
+
+	"mmtm/events"
+	"mmtm/models"
+)
+
+// DefaultDueSoonWindow is how long before its due date a task counts as due
+// soon, unless configured otherwise.
+const DefaultDueSoonWindow = 24 * time.Hour
+
+const (
+	// atRiskWindow is how long before its due date a strict task is checked
+	// for being behind
+	atRiskWindow = 48 * time.Hour
+	// overdueLookback limits overdue reminders to recently missed due dates,
+	// so long forgotten tasks don't all remind at once
+	overdueLookback = 7 * 24 * time.Hour
+)
+
+// CheckDueTasks publishes due soon, overdue and at risk events for open
+// tasks and returns how many it published. Tasks are due soon within
+// dueSoon of their due date. It is meant to run periodically; the
+// notifications the events produce are deduplicated per due date, so
+// running it again does not notify twice.
+func CheckDueTasks(db *sql.DB, bus *events.Bus, dueSoon time.Duration) (int, error) {
+	now := time.Now()
+	ahead := atRiskWindow
+	if dueSoon > ahead {
+		ahead = dueSoon
+	}
+	rows, err := db.Query(`
+		SELECT `+taskColumns+` FROM tasks
+		WHERE status != 'Completed' AND due_date > $1 AND due_date <= $2
+		ORDER BY due_date, id`, now.Add(-overdueLookback), now.Add(ahead))
+	if err != nil {
+		return 0, err
+	}
+
+	var pending []events.Event
+	for rows.Next() {
+		var task models.Task
+		if err := scanTask(rows, &task); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		for _, eventType := range dueEvents(task, now, dueSoon) {
+			pending = append(pending, events.Event{Type: eventType, Task: task})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// Publish after the rows are closed, as handlers use the database too
+	for _, event := range pending {
+		bus.Publish(event)
+	}
+	return len(pending), nil
+}
+
+// dueEvents returns the due date events an open task calls for at now.
+func dueEvents(task models.Task, now time.Time, dueSoon time.Duration) []string {
+	left := task.DueDate.Sub(now)
+	if left <= 0 {
+		return []string{events.TaskOverdue}
+	}
+
+	var types []string
+	if left <= dueSoon {
+		types = append(types, events.TaskDueSoon)
+	}
+	if task.Strict && left <= atRiskWindow && behindSchedule(task, now) {
+		types = append(types, events.TaskAtRisk)
+	}
+	return types
+}
+
+// behindSchedule reports whether a task's progress trails the share of the
+// time between its creation and due date that has passed.
+func behindSchedule(task models.Task, now time.Time) bool {
+	total := task.DueDate.Sub(task.CreatedAt)
+	if total <= 0 {
+		return task.Progress < 100
+	}
+	elapsed := float64(now.Sub(task.CreatedAt)) / float64(total) * 100
+	return float64(task.Progress) < elapsed
+}
+
+// MarkOverdueTasks flags open tasks whose due date has passed and unflags
+// tasks that were completed or moved since. It returns how many tasks it
+// flagged and unflagged.
+func MarkOverdueTasks(db *sql.DB) (int64, int64, error) {
+	result, err := db.Exec(`
+		UPDATE tasks SET overdue = true
+		WHERE NOT overdue AND status != 'Completed' AND due_date < NOW()`)
+	if err != nil {
+		return 0, 0, err
+	}
+	marked, _ := result.RowsAffected()
+
+	result, err = db.Exec(`
+		UPDATE tasks SET overdue = false
+		WHERE overdue AND (status = 'Completed' OR due_date >= NOW())`)
+	if err != nil {
+		return marked, 0, err
+	}
+	cleared, _ := result.RowsAffected()
+	return marked, cleared, nil
+}
+
+// SendDailyDigests publishes a digest of the current UTC day for every
+// active user with tasks due today, overdue or completed yesterday, and
+// returns how many it published. Digests are deduplicated per day.
+func SendDailyDigests(db *sql.DB, bus *events.Bus) (int, error) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	rows, err := db.Query(`
+		SELECT u.id,
+		       COUNT(*) FILTER (WHERE t.status != 'Completed' AND t.due_date >= $1 AND t.due_date < $2),
+		       COUNT(*) FILTER (WHERE t.status != 'Completed' AND t.due_date < $1),
+		       COUNT(*) FILTER (WHERE t.status = 'Completed' AND t.updated_at >= $3 AND t.updated_at < $1)
+		FROM tasks t
+		JOIN users u ON u.id = COALESCE(t.assignee_id, t.user_id)
+		WHERE u.deleted_at IS NULL
+		GROUP BY u.id`, today, today.AddDate(0, 0, 1), today.AddDate(0, 0, -1))
+	if err != nil {
+		return 0, err
+	}
+
+	var digests []models.Digest
+	for rows.Next() {
+		digest := models.Digest{Date: today.Format("2006-01-02")}
+		if err := rows.Scan(&digest.UserID, &digest.DueToday, &digest.Overdue, &digest.CompletedYesterday); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if digest.DueToday+digest.Overdue+digest.CompletedYesterday > 0 {
+			digests = append(digests, digest)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, digest := range digests {
+		bus.Publish(events.Event{Type: events.DailyDigest, Digest: digest})
+	}
+	return len(digests), nil
+}
@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"mmtm/auth"
+	"mmtm/models"
+)
+
+// refreshTokenTTL is how long a session stays usable without a refresh. Each
+// refresh rotates the token and extends the session.
+const refreshTokenTTL = 30 * 24 * time.Hour
+
+// createSession starts a new login session and issues its first access and
+// refresh tokens.
+func createSession(c *gin.Context, q queryRower, userID int) (models.TokenResponse, error) {
+	refreshToken, err := generateToken()
+	if err != nil {
+		return models.TokenResponse{}, err
+	}
+
+	var sessionID int
+	err = q.QueryRow(`
+		INSERT INTO sessions (user_id, refresh_token_hash, expires_at, user_agent, ip)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id`,
+		userID, hashToken(refreshToken), time.Now().Add(refreshTokenTTL),
+		c.Request.UserAgent(), c.ClientIP()).Scan(&sessionID)
+	if err != nil {
+		return models.TokenResponse{}, err
+	}
+
+	accessToken, expiresAt, err := auth.IssueAccessToken(userID, sessionID)
+	if err != nil {
+		return models.TokenResponse{}, err
+	}
+
+	return models.TokenResponse{Token: accessToken, ExpiresAt: expiresAt, RefreshToken: refreshToken}, nil
+}
+
+// Refresh exchanges a refresh token for a new access token and a new refresh
+// token. Presenting a refresh token that was already rotated means it leaked,
+// so the whole session is revoked.
+func (h *AuthHandler) Refresh(c *gin.Context) {
+	var req models.RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	tokenHash := hashToken(req.RefreshToken)
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var sessionID, userID int
+	var expiresAt time.Time
+	var revokedAt sql.NullTime
+	err = tx.QueryRow(`
+		SELECT id, user_id, expires_at, revoked_at
+		FROM sessions WHERE refresh_token_hash = $1
+		FOR UPDATE`, tokenHash).Scan(&sessionID, &userID, &expiresAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		result, err := tx.Exec(`
+			UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP
+			WHERE previous_token_hash = $1 AND revoked_at IS NULL`, tokenHash)
+		if err == nil {
+			if reused, _ := result.RowsAffected(); reused > 0 {
+				tx.Commit()
+			}
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if revokedAt.Valid || time.Now().After(expiresAt) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Session expired"})
+		return
+	}
+
+	refreshToken, err := generateToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE sessions
+		SET refresh_token_hash = $1, previous_token_hash = $2, expires_at = $3,
+		    last_used_at = CURRENT_TIMESTAMP, user_agent = $4, ip = $5
+		WHERE id = $6`,
+		hashToken(refreshToken), tokenHash, time.Now().Add(refreshTokenTTL),
+		c.Request.UserAgent(), c.ClientIP(), sessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh session"})
+		return
+	}
+
+	accessToken, accessExpiresAt, err := auth.IssueAccessToken(userID, sessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.TokenResponse{
+		Token:        accessToken,
+		ExpiresAt:    accessExpiresAt,
+		RefreshToken: refreshToken,
+	})
+}
+
+// Logout revokes the session a refresh token belongs to. Access tokens of that
+// session stop working immediately because the middleware checks the session.
+func (h *AuthHandler) Logout(c *gin.Context) {
+	var req models.RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err := h.db.Exec(`
+		UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP
+		WHERE refresh_token_hash = $1 AND revoked_at IS NULL`, hashToken(req.RefreshToken))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+
+	// Unknown or already revoked tokens are not an error: the session is gone either way
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
+}
+
+// ListSessions returns the user's active logins.
+func (h *UserHandler) ListSessions(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	currentID := c.GetInt("session_id")
+
+	rows, err := h.db.Query(`
+		SELECT id, user_agent, ip, created_at, last_used_at, expires_at
+		FROM sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > NOW()
+		ORDER BY last_used_at DESC`, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sessions"})
+		return
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		var session models.Session
+		if err := rows.Scan(&session.ID, &session.UserAgent, &session.IP, &session.CreatedAt,
+			&session.LastUsedAt, &session.ExpiresAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan session"})
+			return
+		}
+		session.Current = session.ID == currentID
+		sessions = append(sessions, session)
+	}
+
+	c.JSON(http.StatusOK, sessions)
+}
+
+// RevokeSession signs one of the user's sessions out.
+func (h *UserHandler) RevokeSession(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	sessionID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
+		return
+	}
+
+	result, err := h.db.Exec(`
+		UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL`, sessionID, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+		return
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check revocation"})
+		return
+	}
+
+	if rowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked successfully"})
+}
+
+// RevokeOtherSessions signs out everywhere except the current session.
+func (h *UserHandler) RevokeOtherSessions(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	revoked, err := revokeOtherSessions(h.db, userID, c.GetInt("session_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Signed out of all other sessions", "revoked": revoked})
+}
+
+func revokeOtherSessions(e execer, userID, currentID int) (int64, error) {
+	result, err := e.Exec(`
+		UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND id != $2 AND revoked_at IS NULL`, userID, currentID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
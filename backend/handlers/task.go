@@ -2,31 +2,97 @@ package handlers
 
 import (
 	"database/sql"
+	"fmt"
 	"net/http"
 	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 
+	"mmtm/encryption"
+	"mmtm/events"
 	"mmtm/models"
 )
 
 type TaskHandler struct {
-	db *sql.DB
+	db  *sql.DB
+	bus *events.Bus
 }
 
-func NewTaskHandler(db *sql.DB) *TaskHandler {
-	return &TaskHandler{db: db}
+// taskColumns is the column list scanned by scanTask. It ends with the
+// minutes tracked on the task, so queries must name the table tasks.
+const taskColumns = `id, user_id, workspace_id, assignee_id, title, description, category, priority, status,
+	due_date, importance, progress, estimated_minutes, reorganizable, strict, notes,
+	recurrence_rule, occurrence, recurrence_parent_id, overdue, created_at, updated_at,
+	(SELECT ` + trackedSeconds + ` / 60 FROM time_entries e WHERE e.task_id = tasks.id)`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanTask reads a task and decrypts its free text.
+func scanTask(row rowScanner, task *models.Task) error {
+	err := row.Scan(&task.ID, &task.UserID, &task.WorkspaceID, &task.AssigneeID, &task.Title, &task.Description,
+		&task.Category, &task.Priority, &task.Status, &task.DueDate,
+		&task.Importance, &task.Progress, &task.EstimatedMinutes, &task.Reorganizable, &task.Strict,
+		&task.Notes, &task.RecurrenceRule, &task.Occurrence, &task.RecurrenceParentID,
+		&task.Overdue, &task.CreatedAt, &task.UpdatedAt, &task.TrackedMinutes)
+	if err != nil {
+		return err
+	}
+	return decryptTask(task)
+}
+
+func NewTaskHandler(db *sql.DB, bus *events.Bus) *TaskHandler {
+	return &TaskHandler{db: db, bus: bus}
 }
 
 func (h *TaskHandler) GetTasks(c *gin.Context) {
 	userID := c.GetInt("user_id")
 
-	rows, err := h.db.Query(`
-		SELECT id, user_id, title, description, category, priority, status, 
-		       due_date, importance, progress, reorganizable, strict, notes,
-		       created_at, updated_at
-		FROM tasks WHERE user_id = $1 ORDER BY created_at DESC`, userID)
+	window, err := parseTaskWindow(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// ?workspace=<id> narrows the list to one workspace, ?workspace=personal
+	// to the user's own tasks
+	query := `SELECT ` + taskColumns + ` FROM tasks WHERE ` + visibleTasks("", "$1")
+	args := []interface{}{userID}
+	switch workspace := c.Query("workspace"); workspace {
+	case "":
+	case "personal":
+		query += " AND workspace_id IS NULL"
+	default:
+		workspaceID, err := strconv.Atoi(workspace)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid workspace ID"})
+			return
+		}
+		query += " AND workspace_id = $2"
+		args = append(args, workspaceID)
+	}
+
+	// ?assignee=me, ?assignee=<user id> or ?assignee=none
+	switch assignee := c.Query("assignee"); assignee {
+	case "":
+	case "none":
+		query += " AND assignee_id IS NULL"
+	case "me":
+		query += " AND assignee_id = $1"
+	default:
+		assigneeID, err := strconv.Atoi(assignee)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid assignee"})
+			return
+		}
+		args = append(args, assigneeID)
+		query += " AND assignee_id = $" + strconv.Itoa(len(args))
+	}
+
+	rows, err := h.db.Query(query+" ORDER BY created_at DESC", args...)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tasks"})
 		return
@@ -36,20 +102,47 @@ func (h *TaskHandler) GetTasks(c *gin.Context) {
 	var tasks []models.Task
 	for rows.Next() {
 		var task models.Task
-		err := rows.Scan(&task.ID, &task.UserID, &task.Title, &task.Description,
-			&task.Category, &task.Priority, &task.Status, &task.DueDate,
-			&task.Importance, &task.Progress, &task.Reorganizable, &task.Strict,
-			&task.Notes, &task.CreatedAt, &task.UpdatedAt)
-		if err != nil {
+		if err := scanTask(rows, &task); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan task"})
 			return
 		}
 		tasks = append(tasks, task)
 	}
 
+	deps, err := loadUnfinishedDependencies(h.db, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch dependencies"})
+		return
+	}
+	markBlocked(tasks, deps)
+
+	if window != nil {
+		tasks = window.apply(tasks)
+	}
+
+	if query := strings.TrimSpace(c.Query("q")); query != "" {
+		tasks = searchTasks(tasks, query)
+	}
+
 	c.JSON(http.StatusOK, tasks)
 }
 
+// searchTasks keeps the tasks whose title, description or notes contain the
+// query, ignoring case. It runs after decryption since the database only
+// holds ciphertext for descriptions and notes.
+func searchTasks(tasks []models.Task, query string) []models.Task {
+	query = strings.ToLower(query)
+	matches := []models.Task{}
+	for _, task := range tasks {
+		if strings.Contains(strings.ToLower(task.Title), query) ||
+			strings.Contains(strings.ToLower(task.Description), query) ||
+			strings.Contains(strings.ToLower(task.Notes), query) {
+			matches = append(matches, task)
+		}
+	}
+	return matches
+}
+
 func (h *TaskHandler) CreateTask(c *gin.Context) {
 	userID := c.GetInt("user_id")
 
@@ -59,27 +152,82 @@ func (h *TaskHandler) CreateTask(c *gin.Context) {
 		return
 	}
 
-	var task models.Task
-	err := h.db.QueryRow(`
-		INSERT INTO tasks (user_id, title, description, category, priority, status,
-		                  due_date, importance, progress, reorganizable, strict, notes)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
-		RETURNING id, user_id, title, description, category, priority, status,
-		          due_date, importance, progress, reorganizable, strict, notes,
-		          created_at, updated_at`,
-		userID, req.Title, req.Description, req.Category, req.Priority, req.Status,
-		req.DueDate, req.Importance, req.Progress, req.Reorganizable, req.Strict, req.Notes).Scan(
-		&task.ID, &task.UserID, &task.Title, &task.Description, &task.Category,
-		&task.Priority, &task.Status, &task.DueDate, &task.Importance, &task.Progress,
-		&task.Reorganizable, &task.Strict, &task.Notes, &task.CreatedAt, &task.UpdatedAt)
+	recurrenceRule, err := normalizeRecurrenceRule(req.RecurrenceRule)
 	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recurrence rule: " + err.Error()})
+		return
+	}
+	req.RecurrenceRule = recurrenceRule
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	task, err := insertTask(tx, userID, req)
+	if err != nil {
+		respondTaskError(c, err, "Failed to create task")
+		return
+	}
+	pending := taskEvents(userID, nil, task)
+	if err := enqueueWebhooks(tx, pending); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create task"})
 		return
 	}
 
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create task"})
+		return
+	}
+	for _, event := range pending {
+		h.bus.Publish(event)
+	}
+
 	c.JSON(http.StatusCreated, task)
 }
 
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// insertTask creates a task from an already validated request. It runs on
+// either the database or an open transaction. Adding a task to a workspace
+// takes an editor or owner of it.
+func insertTask(q queryRower, userID int, req models.CreateTaskRequest) (models.Task, error) {
+	var task models.Task
+	if req.WorkspaceID != nil {
+		if err := authorizeWorkspaceTasks(q, userID, *req.WorkspaceID); err != nil {
+			return task, err
+		}
+	}
+	if req.AssigneeID != nil {
+		if err := checkAssignee(q, userID, req.WorkspaceID, *req.AssigneeID); err != nil {
+			return task, err
+		}
+	}
+
+	id, err := nextID(q, "tasks")
+	if err != nil {
+		return task, err
+	}
+	description, notes, err := encryptTaskFields(id, req.Description, req.Notes)
+	if err != nil {
+		return task, err
+	}
+	err = scanTask(q.QueryRow(`
+		INSERT INTO tasks (id, user_id, title, description, category, priority, status,
+		                  due_date, importance, progress, reorganizable, strict, notes,
+		                  recurrence_rule, workspace_id, assignee_id, estimated_minutes)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+		RETURNING `+taskColumns,
+		id, userID, req.Title, description, req.Category, req.Priority, req.Status,
+		req.DueDate, req.Importance, req.Progress, req.Reorganizable, req.Strict, notes,
+		req.RecurrenceRule, req.WorkspaceID, req.AssigneeID, req.EstimatedMinutes), &task)
+	return task, err
+}
+
 func (h *TaskHandler) GetTask(c *gin.Context) {
 	userID := c.GetInt("user_id")
 	taskID, err := strconv.Atoi(c.Param("id"))
@@ -89,14 +237,9 @@ func (h *TaskHandler) GetTask(c *gin.Context) {
 	}
 
 	var task models.Task
-	err = h.db.QueryRow(`
-		SELECT id, user_id, title, description, category, priority, status,
-		       due_date, importance, progress, reorganizable, strict, notes,
-		       created_at, updated_at
-		FROM tasks WHERE id = $1 AND user_id = $2`, taskID, userID).Scan(
-		&task.ID, &task.UserID, &task.Title, &task.Description, &task.Category,
-		&task.Priority, &task.Status, &task.DueDate, &task.Importance, &task.Progress,
-		&task.Reorganizable, &task.Strict, &task.Notes, &task.CreatedAt, &task.UpdatedAt)
+	err = scanTask(h.db.QueryRow(`
+		SELECT `+taskColumns+`
+		FROM tasks WHERE id = $1 AND `+visibleTasks("", "$2"), taskID, userID), &task)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
@@ -106,6 +249,13 @@ func (h *TaskHandler) GetTask(c *gin.Context) {
 		return
 	}
 
+	deps, err := loadUnfinishedDependencies(h.db, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch dependencies"})
+		return
+	}
+	task.Blocked = task.Status != "Completed" && len(deps[task.ID]) > 0
+
 	c.JSON(http.StatusOK, task)
 }
 
@@ -122,6 +272,66 @@ func (h *TaskHandler) UpdateTask(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if err := normalizeTaskUpdate(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	before, err := loadTask(tx, taskID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update task"})
+		return
+	}
+
+	task, err := updateTask(tx, userID, taskID, req)
+	if err != nil {
+		respondTaskError(c, err, "Failed to update task")
+		return
+	}
+	pending := taskEvents(userID, before, task)
+	if err := enqueueWebhooks(tx, pending); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update task"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update task"})
+		return
+	}
+	for _, event := range pending {
+		h.bus.Publish(event)
+	}
+
+	c.JSON(http.StatusOK, task)
+}
+
+// normalizeTaskUpdate validates the parts of a patch that binding tags can't
+// express and puts them in canonical form.
+func normalizeTaskUpdate(req *models.UpdateTaskRequest) error {
+	if req.RecurrenceRule != nil {
+		recurrenceRule, err := normalizeRecurrenceRule(*req.RecurrenceRule)
+		if err != nil {
+			return fmt.Errorf("Invalid recurrence rule: %v", err)
+		}
+		req.RecurrenceRule = &recurrenceRule
+	}
+	return nil
+}
+
+// updateTask applies a normalized patch inside tx and returns sql.ErrNoRows
+// if the user can't see the task and errTaskForbidden if they may only view
+// it. Completing an occurrence of a recurring task schedules the next one.
+func updateTask(tx *sql.Tx, userID, taskID int, req models.UpdateTaskRequest) (models.Task, error) {
+	if err := authorizeTaskEdit(tx, userID, taskID); err != nil {
+		return models.Task{}, err
+	}
 
 	// Build dynamic update query
 	query := "UPDATE tasks SET updated_at = CURRENT_TIMESTAMP"
@@ -134,8 +344,12 @@ func (h *TaskHandler) UpdateTask(c *gin.Context) {
 		argIndex++
 	}
 	if req.Description != nil {
+		description, err := encryption.Encrypt(*req.Description, fieldTaskDescription, taskID)
+		if err != nil {
+			return models.Task{}, err
+		}
 		query += ", description = $" + strconv.Itoa(argIndex)
-		args = append(args, *req.Description)
+		args = append(args, description)
 		argIndex++
 	}
 	if req.Category != nil {
@@ -168,6 +382,15 @@ func (h *TaskHandler) UpdateTask(c *gin.Context) {
 		args = append(args, *req.Progress)
 		argIndex++
 	}
+	if req.EstimatedMinutes != nil {
+		var estimate *int
+		if *req.EstimatedMinutes != 0 {
+			estimate = req.EstimatedMinutes
+		}
+		query += ", estimated_minutes = $" + strconv.Itoa(argIndex)
+		args = append(args, estimate)
+		argIndex++
+	}
 	if req.Reorganizable != nil {
 		query += ", reorganizable = $" + strconv.Itoa(argIndex)
 		args = append(args, *req.Reorganizable)
@@ -179,33 +402,72 @@ func (h *TaskHandler) UpdateTask(c *gin.Context) {
 		argIndex++
 	}
 	if req.Notes != nil {
+		notes, err := encryption.Encrypt(*req.Notes, fieldTaskNotes, taskID)
+		if err != nil {
+			return models.Task{}, err
+		}
 		query += ", notes = $" + strconv.Itoa(argIndex)
-		args = append(args, *req.Notes)
+		args = append(args, notes)
+		argIndex++
+	}
+	if req.RecurrenceRule != nil {
+		query += ", recurrence_rule = $" + strconv.Itoa(argIndex)
+		args = append(args, *req.RecurrenceRule)
+		argIndex++
+	}
+	// A new due date or completion lifts the overdue mark until the next
+	// overnight check
+	if req.DueDate != nil || (req.Status != nil && *req.Status == "Completed") {
+		query += ", overdue = false"
+	}
+
+	moved := false
+	if req.WorkspaceID != nil {
+		workspaceID, changed, err := taskMoveTarget(tx, userID, taskID, *req.WorkspaceID)
+		if err != nil {
+			return models.Task{}, err
+		}
+		query += ", workspace_id = $" + strconv.Itoa(argIndex)
+		args = append(args, workspaceID)
 		argIndex++
+		moved = changed
+	}
+	if req.AssigneeID != nil {
+		var assigneeID *int
+		if *req.AssigneeID != 0 {
+			workspaceID, err := taskWorkspace(tx, taskID, req.WorkspaceID)
+			if err != nil {
+				return models.Task{}, err
+			}
+			if err := checkAssignee(tx, userID, workspaceID, *req.AssigneeID); err != nil {
+				return models.Task{}, err
+			}
+			assigneeID = req.AssigneeID
+		}
+		query += ", assignee_id = $" + strconv.Itoa(argIndex)
+		args = append(args, assigneeID)
+		argIndex++
+	} else if moved {
+		query += ", assignee_id = NULL"
 	}
 
-	query += " WHERE id = $" + strconv.Itoa(argIndex) + " AND user_id = $" + strconv.Itoa(argIndex+1)
-	args = append(args, taskID, userID)
+	query += " WHERE id = $" + strconv.Itoa(argIndex)
+	args = append(args, taskID)
 
-	query += ` RETURNING id, user_id, title, description, category, priority, status,
-	           due_date, importance, progress, reorganizable, strict, notes,
-	           created_at, updated_at`
+	query += " RETURNING " + taskColumns
 
 	var task models.Task
-	err = h.db.QueryRow(query, args...).Scan(
-		&task.ID, &task.UserID, &task.Title, &task.Description, &task.Category,
-		&task.Priority, &task.Status, &task.DueDate, &task.Importance, &task.Progress,
-		&task.Reorganizable, &task.Strict, &task.Notes, &task.CreatedAt, &task.UpdatedAt)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
-			return
+	if err := scanTask(tx.QueryRow(query, args...), &task); err != nil {
+		return task, err
+	}
+
+	if task.Status == "Completed" && task.RecurrenceRule != "" {
+		if err := scheduleNextOccurrence(tx, task); err != nil {
+			return task, err
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update task"})
-		return
 	}
 
-	c.JSON(http.StatusOK, task)
+	return task, nil
 }
 
 func (h *TaskHandler) DeleteTask(c *gin.Context) {
@@ -216,26 +478,55 @@ func (h *TaskHandler) DeleteTask(c *gin.Context) {
 		return
 	}
 
-	result, err := h.db.Exec("DELETE FROM tasks WHERE id = $1 AND user_id = $2", taskID, userID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete task"})
-		return
-	}
-
-	rowsAffected, err := result.RowsAffected()
+	deleted, err := deleteTask(h.db, userID, taskID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check deletion"})
+		respondTaskError(c, err, "Failed to delete task")
 		return
 	}
 
-	if rowsAffected == 0 {
+	if deleted == nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
 		return
 	}
+	h.bus.Publish(events.Event{Type: events.TaskDeleted, ActorID: userID, Task: *deleted})
 
 	c.JSON(http.StatusOK, gin.H{"message": "Task deleted successfully"})
 }
 
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// querier runs queries on either the database or an open transaction.
+type querier interface {
+	queryRower
+	execer
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// deleteTask deletes a task the user may edit and returns it as it was, or
+// nil if it didn't exist. It returns errTaskForbidden for tasks the user can
+// only view.
+func deleteTask(q queryRower, userID, taskID int) (*models.Task, error) {
+	err := authorizeTaskEdit(q, userID, taskID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var task models.Task
+	err = scanTask(q.QueryRow("DELETE FROM tasks WHERE id = $1 RETURNING "+taskColumns, taskID), &task)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
 func (h *TaskHandler) ReorganizeTasks(c *gin.Context) {
 	userID := c.GetInt("user_id")
 
@@ -245,13 +536,13 @@ func (h *TaskHandler) ReorganizeTasks(c *gin.Context) {
 		return
 	}
 
-	// Get all reorganizable tasks for the user
+	// Get all reorganizable tasks the user can see. The new order is only
+	// returned, never stored, so each member of a workspace gets their own
+	// order of its shared tasks.
 	rows, err := h.db.Query(`
-		SELECT id, user_id, title, description, category, priority, status,
-		       due_date, importance, progress, reorganizable, strict, notes,
-		       created_at, updated_at
-		FROM tasks 
-		WHERE user_id = $1 AND reorganizable = true AND status != 'Completed'
+		SELECT `+taskColumns+`
+		FROM tasks
+		WHERE `+visibleTasks("", "$1")+` AND reorganizable = true AND status != 'Completed'
 		ORDER BY created_at`, userID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tasks"})
@@ -262,50 +553,74 @@ func (h *TaskHandler) ReorganizeTasks(c *gin.Context) {
 	var tasks []models.Task
 	for rows.Next() {
 		var task models.Task
-		err := rows.Scan(&task.ID, &task.UserID, &task.Title, &task.Description,
-			&task.Category, &task.Priority, &task.Status, &task.DueDate,
-			&task.Importance, &task.Progress, &task.Reorganizable, &task.Strict,
-			&task.Notes, &task.CreatedAt, &task.UpdatedAt)
-		if err != nil {
+		if err := scanTask(rows, &task); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan task"})
 			return
 		}
 		tasks = append(tasks, task)
 	}
 
-	// Reorganize tasks based on mood
-	reorganizeTasks(tasks, req.Mood)
+	deps, err := loadUnfinishedDependencies(h.db, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch dependencies"})
+		return
+	}
+
+	var focus map[string]float64
+	if req.Mood == "Focused" {
+		if focus, err = focusPerformance(h.db, userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch focus sessions"})
+			return
+		}
+	}
+
+	// Reorganize tasks based on mood, then make sure no task is placed
+	// ahead of its unfinished prerequisites
+	reorganizeTasks(tasks, req.Mood, focus)
+	orderByDependencies(tasks, deps)
 
 	// Get all tasks (including non-reorganizable ones) to return
 	allRows, err := h.db.Query(`
-		SELECT id, user_id, title, description, category, priority, status,
-		       due_date, importance, progress, reorganizable, strict, notes,
-		       created_at, updated_at
-		FROM tasks WHERE user_id = $1 ORDER BY created_at DESC`, userID)
+		SELECT `+taskColumns+`
+		FROM tasks WHERE `+visibleTasks("", "$1")+` ORDER BY created_at DESC`, userID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch all tasks"})
 		return
 	}
 	defer allRows.Close()
 
-	var allTasks []models.Task
+	reorganized := make(map[int]bool, len(tasks))
+	for _, task := range tasks {
+		reorganized[task.ID] = true
+	}
+
+	// Reorganized tasks come first in their new order, followed by the rest
+	allTasks := tasks
 	for allRows.Next() {
 		var task models.Task
-		err := allRows.Scan(&task.ID, &task.UserID, &task.Title, &task.Description,
-			&task.Category, &task.Priority, &task.Status, &task.DueDate,
-			&task.Importance, &task.Progress, &task.Reorganizable, &task.Strict,
-			&task.Notes, &task.CreatedAt, &task.UpdatedAt)
-		if err != nil {
+		if err := scanTask(allRows, &task); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan task"})
 			return
 		}
-		allTasks = append(allTasks, task)
+		if !reorganized[task.ID] {
+			allTasks = append(allTasks, task)
+		}
+	}
+	markBlocked(allTasks, deps)
+
+	// Reorganizing changes nothing stored, so there is no transaction to
+	// queue the webhooks in
+	event := events.Event{Type: events.TasksReorganized, ActorID: userID, Tasks: allTasks, Mood: req.Mood}
+	if err := enqueueWebhooks(h.db, []events.Event{event}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue webhooks"})
+		return
 	}
+	h.bus.Publish(event)
 
 	c.JSON(http.StatusOK, allTasks)
 }
 
-func reorganizeTasks(tasks []models.Task, mood string) {
+func reorganizeTasks(tasks []models.Task, mood string, focus map[string]float64) {
 	switch mood {
 	case "Tired":
 		// Prioritize easier (low priority) tasks first
@@ -320,9 +635,11 @@ func reorganizeTasks(tasks []models.Task, mood string) {
 			return priorityOrder[tasks[i].Priority] > priorityOrder[tasks[j].Priority]
 		})
 	case "Focused":
-		// Prioritize important tasks
+		// Prioritize important tasks, weighted by how well the user's focus
+		// sessions go in each category
 		sort.Slice(tasks, func(i, j int) bool {
-			return tasks[i].Importance > tasks[j].Importance
+			return float64(tasks[i].Importance)*focusWeight(focus, tasks[i].Category) >
+				float64(tasks[j].Importance)*focusWeight(focus, tasks[j].Category)
 		})
 	case "Stressed":
 		// Prioritize tasks with approaching deadlines
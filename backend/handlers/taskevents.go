@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"database/sql"
+
+	"mmtm/events"
+	"mmtm/models"
+)
+
+// taskEvents returns the events to publish once saving a task is committed.
+// before is the task as it was, nil for a new task. Assignments are only
+// announced when someone else is assigned.
+func taskEvents(actorID int, before *models.Task, task models.Task) []events.Event {
+	saved := events.Event{Type: events.TaskUpdated, ActorID: actorID, Task: task, Before: before}
+	if before == nil {
+		saved.Type = events.TaskCreated
+	}
+	list := []events.Event{saved}
+
+	if task.AssigneeID != nil && *task.AssigneeID != actorID &&
+		(before == nil || before.AssigneeID == nil || *before.AssigneeID != *task.AssigneeID) {
+		list = append(list, events.Event{Type: events.TaskAssigned, ActorID: actorID, Task: task})
+	}
+	if before != nil && before.Status != "Completed" && task.Status == "Completed" {
+		list = append(list, events.Event{Type: events.TaskCompleted, ActorID: actorID, Task: task})
+	}
+	return list
+}
+
+// loadTask returns a task regardless of who can see it, nil if it doesn't
+// exist.
+func loadTask(q queryRower, taskID int) (*models.Task, error) {
+	var task models.Task
+	err := scanTask(q.QueryRow("SELECT "+taskColumns+" FROM tasks WHERE id = $1", taskID), &task)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
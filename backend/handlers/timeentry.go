@@ -0,0 +1,318 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+
+	"mmtm/encryption"
+	"mmtm/models"
+)
+
+// maxTimeEntry is the longest time entry that can be added by hand.
+const maxTimeEntry = 24 * time.Hour
+
+// trackedSeconds sums the time entries e in whole seconds, counting running
+// timers up to now.
+const trackedSeconds = `COALESCE(SUM(EXTRACT(EPOCH FROM COALESCE(e.ended_at, NOW()) - e.started_at)), 0)::bigint`
+
+// timeEntryColumns is the column list scanned by scanTimeEntry, selected
+// from time_entries e joined to users u.
+const timeEntryColumns = `e.id, e.task_id, e.user_id, COALESCE(u.username, ''), e.started_at, e.ended_at,
+	EXTRACT(EPOCH FROM COALESCE(e.ended_at, NOW()) - e.started_at)::bigint, e.note, e.source, e.created_at`
+
+// scanTimeEntry reads a time entry and decrypts its note.
+func scanTimeEntry(row rowScanner, entry *models.TimeEntry) error {
+	err := row.Scan(&entry.ID, &entry.TaskID, &entry.UserID, &entry.Username, &entry.StartedAt,
+		&entry.EndedAt, &entry.DurationSeconds, &entry.Note, &entry.Source, &entry.CreatedAt)
+	if err != nil {
+		return err
+	}
+	entry.Running = entry.EndedAt == nil
+	entry.Note, err = encryption.Decrypt(entry.Note, fieldTimeEntryNote, entry.ID)
+	return err
+}
+
+// runningTimer returns the user's running timer, or nil if none is running.
+func runningTimer(q queryRower, userID int) (*models.TimeEntry, error) {
+	var entry models.TimeEntry
+	err := scanTimeEntry(q.QueryRow(`
+		SELECT `+timeEntryColumns+`
+		FROM time_entries e LEFT JOIN users u ON u.id = e.user_id
+		WHERE e.user_id = $1 AND e.ended_at IS NULL`, userID), &entry)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// insertTimeEntry adds a time entry for the user, with ended nil for a
+// running timer.
+func insertTimeEntry(tx *sql.Tx, userID, taskID int, started time.Time, ended *time.Time, note, source string) (models.TimeEntry, error) {
+	var entry models.TimeEntry
+	id, err := nextID(tx, "time_entries")
+	if err != nil {
+		return entry, err
+	}
+	note, err = encryption.Encrypt(note, fieldTimeEntryNote, id)
+	if err != nil {
+		return entry, err
+	}
+	err = scanTimeEntry(tx.QueryRow(`
+		WITH e AS (
+			INSERT INTO time_entries (id, task_id, user_id, started_at, ended_at, note, source)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			RETURNING *)
+		SELECT `+timeEntryColumns+` FROM e LEFT JOIN users u ON u.id = e.user_id`,
+		id, taskID, userID, started, ended, note, source), &entry)
+	return entry, err
+}
+
+// runningTimerIndex is the unique index that allows each user one running
+// timer.
+const runningTimerIndex = "idx_time_entries_running"
+
+// isRunningTimerConflict reports whether err is the running timer index
+// rejecting a second running timer.
+func isRunningTimerConflict(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == runningTimerIndex
+}
+
+// lockTimeEntries serializes changes to the user's time entries, so checks
+// for overlapping entries hold until the transaction ends.
+func lockTimeEntries(tx *sql.Tx, userID int) error {
+	_, err := tx.Exec("SELECT id FROM users WHERE id = $1 FOR UPDATE", userID)
+	return err
+}
+
+// StartTimer starts timing the user's work on a task. A user has at most one
+// running timer, so starting one while another runs is a conflict. The
+// running timer index enforces that, even for concurrent requests.
+func (h *TaskHandler) StartTimer(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	// The body, with an optional note, may be left out
+	var req models.StartTimerRequest
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	taskID, role, ok := taskFromRoute(c, tx)
+	if !ok {
+		return
+	}
+	if !canEditTasks(role) {
+		respondTaskError(c, errTaskForbidden, "")
+		return
+	}
+
+	entry, err := insertTimeEntry(tx, userID, taskID, time.Now(), nil, req.Note, models.TimeEntryTimer)
+	if isRunningTimerConflict(err) {
+		tx.Rollback()
+		running, err := runningTimer(h.db, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check running timer"})
+			return
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": "A timer is already running", "timer": running})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start timer"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start timer"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, entry)
+}
+
+// StopTimer stops the user's running timer on a task.
+func (h *TaskHandler) StopTimer(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	taskID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid task ID"})
+		return
+	}
+
+	var entry models.TimeEntry
+	err = scanTimeEntry(h.db.QueryRow(`
+		WITH e AS (
+			UPDATE time_entries SET ended_at = NOW()
+			WHERE user_id = $1 AND task_id = $2 AND ended_at IS NULL
+			RETURNING *)
+		SELECT `+timeEntryColumns+` FROM e LEFT JOIN users u ON u.id = e.user_id`,
+		userID, taskID), &entry)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No timer is running on this task"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to stop timer"})
+		return
+	}
+
+	c.JSON(http.StatusOK, entry)
+}
+
+// GetTimer returns the user's running timer.
+func (h *TaskHandler) GetTimer(c *gin.Context) {
+	running, err := runningTimer(h.db, c.GetInt("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch timer"})
+		return
+	}
+	if running == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No timer is running"})
+		return
+	}
+
+	c.JSON(http.StatusOK, running)
+}
+
+// GetTimeEntries lists the time tracked on a task by everyone, newest first.
+func (h *TaskHandler) GetTimeEntries(c *gin.Context) {
+	taskID, _, ok := taskFromRoute(c, h.db)
+	if !ok {
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT `+timeEntryColumns+`
+		FROM time_entries e LEFT JOIN users u ON u.id = e.user_id
+		WHERE e.task_id = $1
+		ORDER BY e.started_at DESC, e.id DESC`, taskID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch time entries"})
+		return
+	}
+	defer rows.Close()
+
+	entries := []models.TimeEntry{}
+	for rows.Next() {
+		var entry models.TimeEntry
+		if err := scanTimeEntry(rows, &entry); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan time entry"})
+			return
+		}
+		entries = append(entries, entry)
+	}
+
+	c.JSON(http.StatusOK, entries)
+}
+
+// CreateTimeEntry records time spent on a task after the fact. It may not
+// overlap the user's other entries, so no time is counted twice.
+func (h *TaskHandler) CreateTimeEntry(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var req models.CreateTimeEntryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !req.EndedAt.After(req.StartedAt) || req.EndedAt.Sub(req.StartedAt) > maxTimeEntry {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "endedAt must be after startedAt and at most 24 hours later"})
+		return
+	}
+	if req.EndedAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Time entries can't end in the future"})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	taskID, role, ok := taskFromRoute(c, tx)
+	if !ok {
+		return
+	}
+	if !canEditTasks(role) {
+		respondTaskError(c, errTaskForbidden, "")
+		return
+	}
+
+	if err := lockTimeEntries(tx, userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	var overlaps bool
+	err = tx.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM time_entries
+		               WHERE user_id = $1 AND started_at < $3 AND COALESCE(ended_at, NOW()) > $2)`,
+		userID, req.StartedAt, req.EndedAt).Scan(&overlaps)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if overlaps {
+		c.JSON(http.StatusConflict, gin.H{"error": "The entry overlaps another of your time entries"})
+		return
+	}
+
+	entry, err := insertTimeEntry(tx, userID, taskID, req.StartedAt, &req.EndedAt, req.Note, models.TimeEntryManual)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add time entry"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add time entry"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, entry)
+}
+
+// DeleteTimeEntry deletes one of the user's own time entries, running
+// timers included.
+func (h *TaskHandler) DeleteTimeEntry(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	taskID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid task ID"})
+		return
+	}
+	entryID, err := strconv.Atoi(c.Param("entryId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid time entry ID"})
+		return
+	}
+
+	result, err := h.db.Exec("DELETE FROM time_entries WHERE id = $1 AND task_id = $2 AND user_id = $3",
+		entryID, taskID, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete time entry"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Time entry not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Time entry deleted successfully"})
+}
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"mmtm/models"
+)
+
+const (
+	// defaultReportWindow is how far back a time report goes by default
+	defaultReportWindow = 30 * 24 * time.Hour
+	// maxReportWindow is the longest window a time report covers
+	maxReportWindow = 366 * 24 * time.Hour
+)
+
+// GetTimeReport reports the time the user tracked in a window, by task and
+// category, and compares the time spent on tasks with their estimates.
+// ?from= and ?to= take dates or timestamps and default to the last 30 days.
+func (h *TaskHandler) GetTimeReport(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	report := models.TimeReport{To: time.Now(), Tasks: []models.TaskTime{}, Categories: []models.CategoryTime{}}
+	if to := c.Query("to"); to != "" {
+		t, err := parseWindowBound(to, true)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid to date"})
+			return
+		}
+		report.To = t
+	}
+	report.From = report.To.Add(-defaultReportWindow)
+	if from := c.Query("from"); from != "" {
+		t, err := parseWindowBound(from, false)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid from date"})
+			return
+		}
+		report.From = t
+	}
+	if report.To.Before(report.From) || report.To.Sub(report.From) > maxReportWindow {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "to must not be before from, and at most a year later"})
+		return
+	}
+
+	// Entries count towards the window they started in
+	rows, err := h.db.Query(`
+		SELECT t.id, t.title, t.category, t.status, t.estimated_minutes, `+trackedSeconds+` / 60,
+		       (SELECT `+trackedSeconds+` / 60 FROM time_entries e WHERE e.task_id = t.id)
+		FROM time_entries e
+		JOIN tasks t ON t.id = e.task_id
+		WHERE e.user_id = $1 AND e.started_at >= $2 AND e.started_at <= $3 AND `+visibleTasks("t.", "$1")+`
+		GROUP BY t.id
+		ORDER BY 6 DESC, t.id`, userID, report.From, report.To)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch time entries"})
+		return
+	}
+	defer rows.Close()
+
+	categories := make(map[string]*models.CategoryTime)
+	for rows.Next() {
+		var task models.TaskTime
+		if err := rows.Scan(&task.TaskID, &task.Title, &task.Category, &task.Status,
+			&task.EstimatedMinutes, &task.TrackedMinutes, &task.TotalMinutes); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan time report"})
+			return
+		}
+		if task.EstimatedMinutes != nil {
+			task.EstimateRatio = estimateRatio(task.TotalMinutes, *task.EstimatedMinutes)
+		}
+		report.Tasks = append(report.Tasks, task)
+		report.TrackedMinutes += task.TrackedMinutes
+
+		category, ok := categories[task.Category]
+		if !ok {
+			category = &models.CategoryTime{Category: task.Category}
+			categories[task.Category] = category
+		}
+		category.Tasks++
+		category.TrackedMinutes += task.TrackedMinutes
+		if task.Status == "Completed" && task.EstimatedMinutes != nil {
+			category.EstimatedTasks++
+			category.EstimatedMinutes += *task.EstimatedMinutes
+			category.ActualMinutes += task.TotalMinutes
+		}
+	}
+
+	for _, category := range categories {
+		if category.EstimatedMinutes > 0 {
+			category.EstimateRatio = estimateRatio(category.ActualMinutes, category.EstimatedMinutes)
+		}
+		report.Categories = append(report.Categories, *category)
+	}
+	sort.Slice(report.Categories, func(i, j int) bool {
+		a, b := report.Categories[i], report.Categories[j]
+		if a.TrackedMinutes != b.TrackedMinutes {
+			return a.TrackedMinutes > b.TrackedMinutes
+		}
+		return a.Category < b.Category
+	})
+
+	c.JSON(http.StatusOK, report)
+}
+
+// estimateRatio is actual over estimated time, rounded to two decimals.
+func estimateRatio(actual, estimated int) *float64 {
+	ratio := math.Round(float64(actual)/float64(estimated)*100) / 100
+	return &ratio
+}
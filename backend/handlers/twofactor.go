@@ -0,0 +1,496 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+
+	"mmtm/encryption"
+	"mmtm/models"
+	"mmtm/ratelimit"
+	"mmtm/totp"
+)
+
+const (
+	totpIssuer = "mmtm"
+
+	// loginChallengeTTL is how long a user has to enter the second factor
+	// after the password.
+	loginChallengeTTL = 5 * time.Minute
+
+	recoveryCodeCount = 10
+)
+
+var (
+	twoFactorLimit   = ratelimit.Every(12*time.Second, 5)
+	twoFactorLockout = ratelimit.LockoutPolicy{
+		Threshold: 5, Base: time.Minute, Max: time.Hour, Window: time.Hour,
+	}
+)
+
+var recoveryEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+func twoFactorKey(userID int) string {
+	return "2fa:user:" + strconv.Itoa(userID)
+}
+
+// twoFactorEnabled reports whether the user has finished 2FA enrollment.
+func twoFactorEnabled(q queryRower, userID int) (bool, error) {
+	var enabled bool
+	err := q.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM user_totp WHERE user_id = $1 AND enabled_at IS NOT NULL)`,
+		userID).Scan(&enabled)
+	return enabled, err
+}
+
+// checkSecondFactor accepts a current TOTP code or an unused recovery code.
+// Recovery codes are used up, and a TOTP code is not accepted twice.
+func checkSecondFactor(tx *sql.Tx, userID int, code string) (bool, error) {
+	var secret string
+	var lastStep int64
+	err := tx.QueryRow(`
+		SELECT secret, last_step FROM user_totp
+		WHERE user_id = $1 AND enabled_at IS NOT NULL
+		FOR UPDATE`, userID).Scan(&secret, &lastStep)
+	if err != nil {
+		return false, err
+	}
+	if secret, err = encryption.Decrypt(secret, fieldTOTPSecret, userID); err != nil {
+		return false, err
+	}
+
+	if step, ok := totp.ValidateOnce(secret, code, time.Now(), lastStep); ok {
+		_, err := tx.Exec("UPDATE user_totp SET last_step = $1 WHERE user_id = $2", step, userID)
+		return err == nil, err
+	}
+
+	result, err := tx.Exec(`
+		UPDATE user_recovery_codes SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`,
+		userID, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+	used, err := result.RowsAffected()
+	return used > 0, err
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// replaceRecoveryCodes generates a fresh set of recovery codes, invalidating
+// the old ones. The codes are only stored hashed, so this is the one time
+// they can be shown.
+func replaceRecoveryCodes(e execer, userID int) ([]string, error) {
+	if _, err := e.Exec("DELETE FROM user_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		raw := recoveryEncoding.EncodeToString(b)[:10]
+		codes[i] = raw[:5] + "-" + raw[5:]
+
+		_, err := e.Exec("INSERT INTO user_recovery_codes (user_id, code_hash) VALUES ($1, $2)",
+			userID, hashToken(raw))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// VerifyTwoFactor finishes a login that was answered with a challenge token.
+func (h *AuthHandler) VerifyTwoFactor(c *gin.Context) {
+	var req models.VerifyTwoFactorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var tokenID, userID int
+	err = tx.QueryRow(`
+		SELECT id, user_id FROM user_tokens
+		WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > NOW()
+		FOR UPDATE`, hashToken(req.ChallengeToken), purposeLoginChallenge).Scan(&tokenID, &userID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge, please log in again"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	key := twoFactorKey(userID)
+	if wait := secondFactorBlocked(c, h.limiter, key); wait > 0 {
+		tooManyAttempts(c, wait)
+		return
+	}
+
+	ok, err := checkSecondFactor(tx, userID, req.Code)
+	if err == sql.ErrNoRows {
+		// 2FA was turned off after the challenge was issued
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge, please log in again"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !ok {
+		secondFactorFailed(c, h.limiter, key)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+	secondFactorPassed(c, h.limiter, key)
+
+	if _, err := tx.Exec("UPDATE user_tokens SET used_at = CURRENT_TIMESTAMP WHERE id = $1", tokenID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	// A deleted account is only restored once both factors are proven. If
+	// it isn't, the rollback leaves the challenge usable to retry with
+	// "restore": true
+	if !checkDeletedAccount(c, tx, userID, req.Restore) {
+		return
+	}
+
+	var user models.User
+	if err := scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = $1", userID), &user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	tokens, err := createSession(c, tx, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign in"})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.AuthResponse{
+		Token:        tokens.Token,
+		ExpiresAt:    tokens.ExpiresAt,
+		RefreshToken: tokens.RefreshToken,
+		User:         user,
+	})
+}
+
+// secondFactorBlocked takes a token from the user's 2FA bucket and checks the
+// user's 2FA lockout. Every check of a second factor goes through it, so
+// guesses count the same wherever they are made.
+func secondFactorBlocked(c *gin.Context, limiter ratelimit.Limiter, key string) time.Duration {
+	ctx := c.Request.Context()
+
+	result, err := limiter.Allow(ctx, key, twoFactorLimit)
+	if err != nil {
+		log.Printf("Rate limiter error: %v", err)
+		return 0
+	}
+	if !result.Allowed {
+		return result.RetryAfter
+	}
+
+	locked, err := limiter.LockedFor(ctx, key)
+	if err != nil {
+		log.Printf("Rate limiter error: %v", err)
+		return 0
+	}
+	return locked
+}
+
+// secondFactorFailed counts a wrong code or password towards the user's 2FA
+// lockout.
+func secondFactorFailed(c *gin.Context, limiter ratelimit.Limiter, key string) {
+	if _, err := limiter.RecordFailure(c.Request.Context(), key, twoFactorLockout); err != nil {
+		log.Printf("Rate limiter error: %v", err)
+	}
+}
+
+// secondFactorPassed clears the user's failed attempts.
+func secondFactorPassed(c *gin.Context, limiter ratelimit.Limiter, key string) {
+	if err := limiter.Reset(c.Request.Context(), key); err != nil {
+		log.Printf("Rate limiter error: %v", err)
+	}
+}
+
+// GetTwoFactor returns the user's 2FA status.
+func (h *UserHandler) GetTwoFactor(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var status models.TwoFactorStatus
+	err := h.db.QueryRow(`
+		SELECT t.enabled_at,
+		       (SELECT COUNT(*) FROM user_recovery_codes r WHERE r.user_id = $1 AND r.used_at IS NULL)
+		FROM users u LEFT JOIN user_totp t ON t.user_id = u.id
+		WHERE u.id = $1`, userID).Scan(&status.EnabledAt, &status.RecoveryCodesRemaining)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	status.Enabled = status.EnabledAt != nil
+
+	c.JSON(http.StatusOK, status)
+}
+
+// SetupTwoFactor starts enrollment with a new secret. 2FA stays off until
+// EnableTwoFactor confirms a code generated from it.
+func (h *UserHandler) SetupTwoFactor(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	enabled, err := twoFactorEnabled(h.db, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	var email string
+	if err := h.db.QueryRow("SELECT email FROM users WHERE id = $1", userID).Scan(&email); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate secret"})
+		return
+	}
+	sealed, err := encryption.Encrypt(secret, fieldTOTPSecret, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start enrollment"})
+		return
+	}
+
+	_, err = h.db.Exec(`
+		INSERT INTO user_totp (user_id, secret) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET secret = $2, last_step = 0, created_at = CURRENT_TIMESTAMP
+		WHERE user_totp.enabled_at IS NULL`, userID, sealed)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start enrollment"})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.TwoFactorSetupResponse{
+		Secret:     secret,
+		OTPAuthURI: totp.URI(totpIssuer, email, secret),
+	})
+}
+
+// EnableTwoFactor finishes enrollment with a code from the authenticator app
+// and returns the recovery codes.
+func (h *UserHandler) EnableTwoFactor(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var req models.TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var secret string
+	var enabledAt sql.NullTime
+	err = tx.QueryRow(`
+		SELECT secret, enabled_at FROM user_totp WHERE user_id = $1
+		FOR UPDATE`, userID).Scan(&secret, &enabledAt)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Start two-factor setup first"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if enabledAt.Valid {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+	if secret, err = encryption.Decrypt(secret, fieldTOTPSecret, userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt secret"})
+		return
+	}
+
+	step, ok := totp.Validate(secret, req.Code, time.Now())
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE user_totp SET enabled_at = CURRENT_TIMESTAMP, last_step = $1
+		WHERE user_id = $2`, step, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable two-factor authentication"})
+		return
+	}
+
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery codes"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable two-factor authentication"})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// DisableTwoFactor turns 2FA off. It takes a current code and, for accounts
+// with a password, the password.
+func (h *UserHandler) DisableTwoFactor(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var req models.DisableTwoFactorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	key := twoFactorKey(userID)
+	if wait := secondFactorBlocked(c, h.limiter, key); wait > 0 {
+		tooManyAttempts(c, wait)
+		return
+	}
+
+	var passwordHash string
+	if err := tx.QueryRow("SELECT password_hash FROM users WHERE id = $1", userID).Scan(&passwordHash); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if passwordHash != "" && bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(req.Password)) != nil {
+		secondFactorFailed(c, h.limiter, key)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid password"})
+		return
+	}
+
+	ok, err := checkSecondFactor(tx, userID, req.Code)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !ok {
+		secondFactorFailed(c, h.limiter, key)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+	secondFactorPassed(c, h.limiter, key)
+
+	if _, err := tx.Exec("DELETE FROM user_totp WHERE user_id = $1", userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor authentication"})
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM user_recovery_codes WHERE user_id = $1", userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor authentication"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor authentication"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes after checking a
+// current code.
+func (h *UserHandler) RegenerateRecoveryCodes(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var req models.TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	key := twoFactorKey(userID)
+	if wait := secondFactorBlocked(c, h.limiter, key); wait > 0 {
+		tooManyAttempts(c, wait)
+		return
+	}
+
+	ok, err := checkSecondFactor(tx, userID, req.Code)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !ok {
+		secondFactorFailed(c, h.limiter, key)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+	secondFactorPassed(c, h.limiter, key)
+
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery codes"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery codes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.RecoveryCodesResponse{RecoveryCodes: codes})
+}
@@ -2,30 +2,43 @@ package handlers
 
 import (
 	"database/sql"
+	"log"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"golang.org/x/crypto/bcrypt"
 
+	"mmtm/mail"
 	"mmtm/models"
+	"mmtm/ratelimit"
 )
 
+const userColumns = "id, username, email, email_verified_at, created_at, updated_at"
+
+func scanUser(row rowScanner, user *models.User) error {
+	return row.Scan(&user.ID, &user.Username, &user.Email, &user.EmailVerifiedAt,
+		&user.CreatedAt, &user.UpdatedAt)
+}
+
 type UserHandler struct {
-	db *sql.DB
+	db            *sql.DB
+	mailer        mail.Mailer
+	limiter       ratelimit.Limiter
+	deletionGrace time.Duration
 }
 
-func NewUserHandler(db *sql.DB) *UserHandler {
-	return &UserHandler{db: db}
+// NewUserHandler creates a UserHandler. Deleted accounts are kept for
+// deletionGrace before they are purged; zero purges them right away.
+func NewUserHandler(db *sql.DB, mailer mail.Mailer, limiter ratelimit.Limiter, deletionGrace time.Duration) *UserHandler {
+	return &UserHandler{db: db, mailer: mailer, limiter: limiter, deletionGrace: deletionGrace}
 }
 
 func (h *UserHandler) GetProfile(c *gin.Context) {
 	userID := c.GetInt("user_id")
 
 	var user models.User
-	err := h.db.QueryRow(`
-		SELECT id, username, email, created_at, updated_at 
-		FROM users WHERE id = $1`, userID).Scan(
-		&user.ID, &user.Username, &user.Email, &user.CreatedAt, &user.UpdatedAt)
+	err := scanUser(h.db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = $1", userID), &user)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
@@ -64,6 +77,9 @@ func (h *UserHandler) UpdateProfile(c *gin.Context) {
 		argIndex++
 	}
 	if req.Email != nil {
+		// A new address has to be verified again
+		query += ", email_verified_at = CASE WHEN email = $" + string(rune(argIndex+'0')) +
+			" THEN email_verified_at END"
 		query += ", email = $" + string(rune(argIndex+'0'))
 		args = append(args, *req.Email)
 		argIndex++
@@ -82,11 +98,17 @@ func (h *UserHandler) UpdateProfile(c *gin.Context) {
 	query += " WHERE id = $" + string(rune(argIndex+'0'))
 	args = append(args, userID)
 
-	query += " RETURNING id, username, email, created_at, updated_at"
+	query += " RETURNING " + userColumns
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
 
 	var user models.User
-	err := h.db.QueryRow(query, args...).Scan(
-		&user.ID, &user.Username, &user.Email, &user.CreatedAt, &user.UpdatedAt)
+	err = scanUser(tx.QueryRow(query, args...), &user)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
@@ -96,5 +118,25 @@ func (h *UserHandler) UpdateProfile(c *gin.Context) {
 		return
 	}
 
+	// A password change signs out every other device
+	if req.Password != nil {
+		if _, err := revokeOtherSessions(tx, userID, c.GetInt("session_id")); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update profile"})
+		return
+	}
+
+	// Only mail the new address once the change is committed
+	if user.EmailVerifiedAt == nil && req.Email != nil {
+		if err := sendVerificationEmail(h.db, h.mailer, user); err != nil {
+			log.Printf("Failed to send verification email to user %d: %v", user.ID, err)
+		}
+	}
+
 	c.JSON(http.StatusOK, user)
 }
@@ -0,0 +1,267 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+
+	"mmtm/mail"
+	"mmtm/models"
+)
+
+// Purposes of single-use tokens in user_tokens.
+const (
+	purposeEmailVerification = "email_verification"
+	purposePasswordReset     = "password_reset"
+	purposeLoginChallenge    = "login_challenge"
+)
+
+const (
+	emailVerificationTTL = 48 * time.Hour
+	passwordResetTTL     = time.Hour
+	mailTimeout          = 30 * time.Second
+)
+
+// issueUserToken creates a single-use token for the user and invalidates
+// older unused tokens with the same purpose.
+func issueUserToken(e execer, userID int, purpose string, ttl time.Duration) (string, error) {
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = e.Exec(`
+		UPDATE user_tokens SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL`, userID, purpose)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = e.Exec(`
+		INSERT INTO user_tokens (user_id, purpose, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4)`,
+		userID, purpose, hashToken(token), time.Now().Add(ttl))
+	return token, err
+}
+
+// consumeUserToken marks a token as used and returns its user. It returns
+// sql.ErrNoRows for unknown, used or expired tokens.
+func consumeUserToken(q queryRower, token, purpose string) (int, error) {
+	var userID int
+	err := q.QueryRow(`
+		UPDATE user_tokens SET used_at = CURRENT_TIMESTAMP
+		WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_id`, hashToken(token), purpose).Scan(&userID)
+	return userID, err
+}
+
+// appLink builds a link to a frontend page, taking the base from APP_URL.
+func appLink(path, token string) string {
+	base := os.Getenv("APP_URL")
+	if base == "" {
+		base = "http://localhost:3000"
+	}
+	return strings.TrimSuffix(base, "/") + path + "?token=" + url.QueryEscape(token)
+}
+
+// deliver sends mail in the background so slow mail servers don't hold up
+// requests and response times don't reveal whether an account exists.
+func deliver(mailer mail.Mailer, msg mail.Message) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+		defer cancel()
+		if err := mailer.Send(ctx, msg); err != nil {
+			log.Printf("Failed to send %q mail: %v", msg.Subject, err)
+		}
+	}()
+}
+
+func sendVerificationEmail(e execer, mailer mail.Mailer, user models.User) error {
+	token, err := issueUserToken(e, user.ID, purposeEmailVerification, emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	deliver(mailer, mail.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm your email address for mmtm by opening this link:\n\n%s\n\n"+
+			"The link expires in %d hours. If you didn't create an account, you can ignore this email.\n",
+			user.Username, appLink("/verify-email", token), int(emailVerificationTTL.Hours())),
+	})
+	return nil
+}
+
+// VerifyEmail confirms the email address a verification token was sent to.
+func (h *AuthHandler) VerifyEmail(c *gin.Context) {
+	var req models.VerifyEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	userID, err := consumeUserToken(tx, req.Token, purposeEmailVerification)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE users SET email_verified_at = COALESCE(email_verified_at, CURRENT_TIMESTAMP)
+		WHERE id = $1`, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email verified successfully"})
+}
+
+// ResendVerificationEmail sends a new verification link to the current user.
+func (h *UserHandler) ResendVerificationEmail(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var user models.User
+	err := scanUser(h.db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = $1", userID), &user)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if user.EmailVerifiedAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email already verified"})
+		return
+	}
+
+	if err := sendVerificationEmail(h.db, h.mailer, user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send verification email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Verification email sent"})
+}
+
+// ForgotPassword emails a password reset link. It answers the same way
+// whether or not the account exists.
+func (h *AuthHandler) ForgotPassword(c *gin.Context) {
+	var req models.ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user models.User
+	err := h.db.QueryRow(`
+		SELECT id, username, email, password_hash
+		FROM users WHERE email = $1 AND deleted_at IS NULL`, req.Email).Scan(
+		&user.ID, &user.Username, &user.Email, &user.PasswordHash)
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	// Accounts without a password sign in through single sign-on only
+	if err == nil && user.PasswordHash != "" {
+		token, err := issueUserToken(h.db, user.ID, purposePasswordReset, passwordResetTTL)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start password reset"})
+			return
+		}
+
+		deliver(h.mailer, mail.Message{
+			To:      user.Email,
+			Subject: "Reset your password",
+			Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password of your mmtm account. "+
+				"To choose a new password, open this link:\n\n%s\n\n"+
+				"The link expires in %d minutes and can be used once. If you didn't ask for this, you can ignore this email.\n",
+				user.Username, appLink("/reset-password", token), int(passwordResetTTL.Minutes())),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "If an account with that email exists, a password reset link has been sent"})
+}
+
+// ResetPassword sets a new password with a reset token and signs the user
+// out everywhere.
+func (h *AuthHandler) ResetPassword(c *gin.Context) {
+	var req models.ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	userID, err := consumeUserToken(tx, req.Token, purposePasswordReset)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	// Receiving the reset link proves the user controls the mailbox
+	_, err = tx.Exec(`
+		UPDATE users
+		SET password_hash = $1, email_verified_at = COALESCE(email_verified_at, CURRENT_TIMESTAMP),
+		    updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2`, string(hashedPassword), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+
+	if _, err := revokeOtherSessions(tx, userID, 0); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset successfully"})
+}
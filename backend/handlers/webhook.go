@@ -0,0 +1,451 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"mmtm/encryption"
+	"mmtm/events"
+	"mmtm/models"
+)
+
+const (
+	// maxWebhooksPerUser caps how many endpoints one user can register
+	maxWebhooksPerUser = 10
+	// webhookSecretPrefix marks webhook signing secrets
+	webhookSecretPrefix  = "whsec_"
+	defaultDeliveryLimit = 50
+	maxDeliveryLimit     = 200
+)
+
+type WebhookHandler struct {
+	db *sql.DB
+}
+
+func NewWebhookHandler(db *sql.DB) *WebhookHandler {
+	return &WebhookHandler{db: db}
+}
+
+// ListWebhooks returns the user's webhooks without their secrets.
+func (h *WebhookHandler) ListWebhooks(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	rows, err := h.db.Query(`
+		SELECT id, url, events, active, created_at, updated_at
+		FROM webhooks WHERE user_id = $1
+		ORDER BY created_at`, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch webhooks"})
+		return
+	}
+	defer rows.Close()
+
+	webhooks := []models.Webhook{}
+	for rows.Next() {
+		var webhook models.Webhook
+		var subscribed string
+		if err := rows.Scan(&webhook.ID, &webhook.URL, &subscribed, &webhook.Active,
+			&webhook.CreatedAt, &webhook.UpdatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan webhook"})
+			return
+		}
+		webhook.Events = strings.Fields(subscribed)
+		webhooks = append(webhooks, webhook)
+	}
+
+	c.JSON(http.StatusOK, webhooks)
+}
+
+// CreateWebhook registers an endpoint for the given events. The signing
+// secret is returned once.
+func (h *WebhookHandler) CreateWebhook(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var req models.CreateWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !validWebhookURL(req.URL) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Webhook URL must be http or https"})
+		return
+	}
+
+	var count int
+	if err := h.db.QueryRow("SELECT COUNT(*) FROM webhooks WHERE user_id = $1", userID).Scan(&count); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if count >= maxWebhooksPerUser {
+		c.JSON(http.StatusConflict, gin.H{"error": "You can register at most 10 webhooks"})
+		return
+	}
+
+	webhookID, err := nextID(h.db, "webhooks")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	secret, sealed, err := newWebhookSecret(webhookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate secret"})
+		return
+	}
+
+	resp := models.WebhookSecretResponse{Secret: secret}
+	subscribed := dedupeEvents(req.Events)
+	err = h.db.QueryRow(`
+		INSERT INTO webhooks (id, user_id, url, secret, events)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, url, active, created_at, updated_at`,
+		webhookID, userID, req.URL, sealed, strings.Join(subscribed, " ")).Scan(
+		&resp.ID, &resp.URL, &resp.Active, &resp.CreatedAt, &resp.UpdatedAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create webhook"})
+		return
+	}
+	resp.Events = subscribed
+
+	c.JSON(http.StatusCreated, resp)
+}
+
+// UpdateWebhook changes a webhook's URL or events, or pauses it with
+// "active": false. Deliveries queued while paused are sent once it is
+// active again.
+func (h *WebhookHandler) UpdateWebhook(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	webhookID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook ID"})
+		return
+	}
+
+	var req models.UpdateWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.URL != nil && !validWebhookURL(*req.URL) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Webhook URL must be http or https"})
+		return
+	}
+
+	var subscribed *string
+	if req.Events != nil {
+		joined := strings.Join(dedupeEvents(req.Events), " ")
+		subscribed = &joined
+	}
+
+	var webhook models.Webhook
+	var eventList string
+	err = h.db.QueryRow(`
+		UPDATE webhooks SET url = COALESCE($1, url), events = COALESCE($2, events),
+		       active = COALESCE($3, active), updated_at = CURRENT_TIMESTAMP
+		WHERE id = $4 AND user_id = $5
+		RETURNING id, url, events, active, created_at, updated_at`,
+		req.URL, subscribed, req.Active, webhookID, userID).Scan(
+		&webhook.ID, &webhook.URL, &eventList, &webhook.Active, &webhook.CreatedAt, &webhook.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update webhook"})
+		return
+	}
+	webhook.Events = strings.Fields(eventList)
+
+	c.JSON(http.StatusOK, webhook)
+}
+
+// DeleteWebhook removes a webhook along with its queued deliveries and log.
+func (h *WebhookHandler) DeleteWebhook(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	webhookID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook ID"})
+		return
+	}
+
+	result, err := h.db.Exec("DELETE FROM webhooks WHERE id = $1 AND user_id = $2", webhookID, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete webhook"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted successfully"})
+}
+
+// RotateWebhookSecret replaces a webhook's signing secret and returns the
+// new one. Deliveries sent from now on are signed with it.
+func (h *WebhookHandler) RotateWebhookSecret(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	webhookID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook ID"})
+		return
+	}
+
+	secret, sealed, err := newWebhookSecret(webhookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate secret"})
+		return
+	}
+
+	resp := models.WebhookSecretResponse{Secret: secret}
+	var eventList string
+	err = h.db.QueryRow(`
+		UPDATE webhooks SET secret = $1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2 AND user_id = $3
+		RETURNING id, url, events, active, created_at, updated_at`,
+		sealed, webhookID, userID).Scan(
+		&resp.ID, &resp.URL, &eventList, &resp.Active, &resp.CreatedAt, &resp.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate secret"})
+		return
+	}
+	resp.Events = strings.Fields(eventList)
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// ListDeliveries returns a webhook's delivery log, newest first.
+// ?status=pending|delivered|failed filters it and ?limit= caps it.
+func (h *WebhookHandler) ListDeliveries(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	webhookID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook ID"})
+		return
+	}
+
+	limit := defaultDeliveryLimit
+	if l := c.Query("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > maxDeliveryLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 200"})
+			return
+		}
+		limit = n
+	}
+
+	var exists bool
+	err = h.db.QueryRow("SELECT EXISTS (SELECT 1 FROM webhooks WHERE id = $1 AND user_id = $2)",
+		webhookID, userID).Scan(&exists)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+
+	query := `
+		SELECT id, event, status, attempts, response_status, last_error,
+		       CASE WHEN status = 'pending' THEN next_attempt_at END, last_attempt_at, delivered_at, created_at
+		FROM webhook_deliveries WHERE webhook_id = $1`
+	args := []interface{}{webhookID}
+	switch status := c.Query("status"); status {
+	case "":
+	case "pending", "delivered", "failed":
+		args = append(args, status)
+		query += " AND status = $2"
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be pending, delivered or failed"})
+		return
+	}
+	args = append(args, limit)
+	query += " ORDER BY id DESC LIMIT $" + strconv.Itoa(len(args))
+
+	rows, err := h.db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch deliveries"})
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []models.WebhookDelivery{}
+	for rows.Next() {
+		var d models.WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.Event, &d.Status, &d.Attempts, &d.ResponseStatus, &d.LastError,
+			&d.NextAttemptAt, &d.LastAttemptAt, &d.DeliveredAt, &d.CreatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan delivery"})
+			return
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	c.JSON(http.StatusOK, deliveries)
+}
+
+// RedeliverWebhook queues a delivery of the webhook to be sent again with a
+// fresh set of attempts.
+func (h *WebhookHandler) RedeliverWebhook(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	webhookID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook ID"})
+		return
+	}
+	deliveryID, err := strconv.Atoi(c.Param("deliveryId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid delivery ID"})
+		return
+	}
+
+	result, err := h.db.Exec(`
+		UPDATE webhook_deliveries d
+		SET status = 'pending', attempts = 0, next_attempt_at = CURRENT_TIMESTAMP, delivered_at = NULL
+		FROM webhooks w
+		WHERE d.id = $1 AND d.webhook_id = $2 AND w.id = d.webhook_id AND w.user_id = $3
+		  AND d.status != 'pending'`, deliveryID, webhookID, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue delivery"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Delivery not found or already pending"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Delivery queued"})
+}
+
+func validWebhookURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// newWebhookSecret returns a new signing secret and its encrypted form to
+// store for a webhook. Unlike API tokens the secret itself is kept, since it
+// signs every delivery.
+func newWebhookSecret(webhookID int) (string, string, error) {
+	token, err := generateToken()
+	if err != nil {
+		return "", "", err
+	}
+	secret := webhookSecretPrefix + token
+	sealed, err := encryption.Encrypt(secret, fieldWebhookSecret, webhookID)
+	return secret, sealed, err
+}
+
+func dedupeEvents(subscribed []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, event := range subscribed {
+		if !seen[event] {
+			seen[event] = true
+			unique = append(unique, event)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
+
+// enqueueWebhooks queues a delivery in the outbox for every active webhook
+// subscribed to one of the events a change is about to publish, among those
+// of the users who can see it. It runs in the change's transaction, so a
+// delivery is queued exactly when the change commits.
+func enqueueWebhooks(q querier, list []events.Event) error {
+	for _, e := range list {
+		var (
+			event   string
+			userIDs = []int{e.ActorID}
+			data    interface{}
+		)
+		switch e.Type {
+		case events.TaskCreated, events.TaskCompleted:
+			event = models.WebhookTaskCreated
+			if e.Type == events.TaskCompleted {
+				event = models.WebhookTaskCompleted
+			}
+			audience, err := taskAudience(q, e.Task)
+			if err != nil {
+				return err
+			}
+			userIDs, data = audience, e.Task
+		case events.MoodAnalyzed:
+			// The journal text stays private; only the result of the analysis is sent
+			event = models.WebhookMoodAnalyzed
+			data = gin.H{
+				"id":         e.MoodLog.ID,
+				"mood":       e.MoodLog.Mood,
+				"confidence": e.MoodLog.Confidence,
+				"createdAt":  e.MoodLog.CreatedAt,
+			}
+		case events.TasksReorganized:
+			event = models.WebhookTasksReorganized
+			data = gin.H{"mood": e.Mood, "tasks": e.Tasks}
+		default:
+			continue
+		}
+		if err := enqueueWebhook(q, userIDs, event, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func enqueueWebhook(q querier, userIDs []int, event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	for _, userID := range userIDs {
+		rows, err := q.Query(`
+			SELECT id FROM webhooks
+			WHERE user_id = $1 AND active AND $2 = ANY (string_to_array(events, ' '))`,
+			userID, event)
+		if err != nil {
+			return err
+		}
+		var webhookIDs []int
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			webhookIDs = append(webhookIDs, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		// Each delivery gets its own copy of the payload, sealed for its row
+		for _, webhookID := range webhookIDs {
+			id, err := nextID(q, "webhook_deliveries")
+			if err != nil {
+				return err
+			}
+			sealed, err := encryption.Encrypt(string(payload), fieldWebhookPayload, id)
+			if err != nil {
+				return err
+			}
+			_, err = q.Exec(`
+				INSERT INTO webhook_deliveries (id, webhook_id, event, payload)
+				SELECT $1, id, $3, $4 FROM webhooks WHERE id = $2`, id, webhookID, event, sealed)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
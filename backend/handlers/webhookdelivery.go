@@ -0,0 +1,290 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"syscall"
+	"time"
+
+	"mmtm/encryption"
+)
+
+const (
+	// webhookBatchSize is how many deliveries one dispatch pass claims at a time
+	webhookBatchSize = 20
+	// webhookLease is how long a claimed delivery is held before another
+	// instance may retry it, in case the instance sending it dies
+	webhookLease = time.Minute
+	// webhookTimeout bounds a single delivery attempt
+	webhookTimeout = 10 * time.Second
+	// webhookBackoff is the delay after the first failed attempt; it doubles
+	// with every further failure
+	webhookBackoff = time.Minute
+	// maxWebhookAttempts is how many attempts a delivery gets before it fails
+	maxWebhookAttempts = 8
+	// webhookDeliveryRetention is how long finished deliveries are logged
+	webhookDeliveryRetention = 30 * 24 * time.Hour
+)
+
+// SignWebhook returns the X-Mmtm-Signature header value for a payload sent
+// at timestamp: the hex HMAC-SHA256 of "<timestamp>.<payload>" keyed with
+// the webhook secret. Receivers compute the same value to verify a delivery.
+func SignWebhook(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// blockedWebhookNetworks are the address ranges webhooks can't connect to
+// while private networks are blocked. Besides private, loopback, link-local
+// and multicast ranges they cover shared carrier-grade NAT space, "this
+// network" and the IPv6 prefixes that embed an IPv4 address, which would
+// otherwise reach the IPv4 ranges through a NAT64 or 6to4 gateway.
+var blockedWebhookNetworks = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // this network
+	netip.MustParsePrefix("10.0.0.0/8"),     // private
+	netip.MustParsePrefix("100.64.0.0/10"),  // shared address space (CGNAT)
+	netip.MustParsePrefix("127.0.0.0/8"),    // loopback
+	netip.MustParsePrefix("169.254.0.0/16"), // link-local, incl. cloud metadata
+	netip.MustParsePrefix("172.16.0.0/12"),  // private
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("192.168.0.0/16"), // private
+	netip.MustParsePrefix("198.18.0.0/15"),  // benchmarking
+	netip.MustParsePrefix("224.0.0.0/4"),    // multicast
+	netip.MustParsePrefix("240.0.0.0/4"),    // reserved, incl. broadcast
+	netip.MustParsePrefix("::/128"),         // unspecified
+	netip.MustParsePrefix("::1/128"),        // loopback
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64
+	netip.MustParsePrefix("64:ff9b:1::/48"), // local-use NAT64
+	netip.MustParsePrefix("2002::/16"),      // 6to4
+	netip.MustParsePrefix("fc00::/7"),       // unique local
+	netip.MustParsePrefix("fe80::/10"),      // link-local
+	netip.MustParsePrefix("ff00::/8"),       // multicast
+}
+
+// webhookAddressAllowed reports whether a webhook may connect to addr while
+// private networks are blocked. IPv4-mapped IPv6 addresses are checked as
+// the IPv4 address they carry.
+func webhookAddressAllowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, network := range blockedWebhookNetworks {
+		if network.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// NewWebhookClient returns the HTTP client deliveries are sent with. It does
+// not follow redirects. With blockPrivate set it refuses to connect to the
+// blockedWebhookNetworks, so webhooks can't be pointed at internal services.
+// The check runs on the address being dialed, after DNS resolution, so a
+// hostname can't resolve its way past it.
+func NewWebhookClient(blockPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if blockPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !webhookAddressAllowed(addrPort.Addr()) {
+				return fmt.Errorf("address %s is not allowed", addrPort.Addr())
+			}
+			return nil
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Transport: transport,
+		Timeout:   webhookTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+type webhookDelivery struct {
+	id        int
+	webhookID int
+	event     string
+	payload   string
+	attempts  int
+	createdAt time.Time
+	url       string
+	secret    string
+}
+
+// DeliverWebhooks sends the deliveries that are due and returns how many it
+// attempted. It claims them in batches with SKIP LOCKED, so several
+// instances can dispatch at once without sending a delivery twice.
+func DeliverWebhooks(ctx context.Context, db *sql.DB, client *http.Client) (int, error) {
+	total := 0
+	for ctx.Err() == nil {
+		batch, err := claimDeliveries(ctx, db)
+		if err != nil {
+			return total, err
+		}
+		for _, d := range batch {
+			if err := sendDelivery(ctx, db, client, d); err != nil {
+				return total, err
+			}
+			total++
+		}
+		if len(batch) < webhookBatchSize {
+			break
+		}
+	}
+	return total, nil
+}
+
+// claimDeliveries leases a batch of due deliveries to active webhooks by
+// pushing their next attempt past the lease and counting the attempt.
+func claimDeliveries(ctx context.Context, db *sql.DB) ([]webhookDelivery, error) {
+	rows, err := db.QueryContext(ctx, `
+		UPDATE webhook_deliveries d
+		SET attempts = d.attempts + 1, last_attempt_at = CURRENT_TIMESTAMP,
+		    next_attempt_at = CURRENT_TIMESTAMP + make_interval(secs => $1)
+		FROM webhooks w
+		WHERE w.id = d.webhook_id AND d.id IN (
+			SELECT d2.id FROM webhook_deliveries d2
+			JOIN webhooks w2 ON w2.id = d2.webhook_id
+			WHERE d2.status = 'pending' AND d2.next_attempt_at <= CURRENT_TIMESTAMP AND w2.active
+			ORDER BY d2.next_attempt_at, d2.id
+			LIMIT $2
+			FOR UPDATE OF d2 SKIP LOCKED)
+		RETURNING d.id, d.webhook_id, d.event, d.payload, d.attempts, d.created_at, w.url, w.secret`,
+		webhookLease.Seconds(), webhookBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []webhookDelivery
+	for rows.Next() {
+		var d webhookDelivery
+		if err := rows.Scan(&d.id, &d.webhookID, &d.event, &d.payload, &d.attempts, &d.createdAt, &d.url, &d.secret); err != nil {
+			return nil, err
+		}
+		batch = append(batch, d)
+	}
+	return batch, rows.Err()
+}
+
+// sendDelivery makes one attempt at a claimed delivery and records the
+// outcome. It only returns an error if the outcome couldn't be recorded.
+func sendDelivery(ctx context.Context, db *sql.DB, client *http.Client, d webhookDelivery) error {
+	status, attemptErr := attemptDelivery(ctx, client, d)
+
+	var responseStatus *int
+	if status != 0 {
+		responseStatus = &status
+	}
+	if attemptErr == nil {
+		_, err := db.Exec(`
+			UPDATE webhook_deliveries
+			SET status = 'delivered', response_status = $1, last_error = '', delivered_at = CURRENT_TIMESTAMP
+			WHERE id = $2`, responseStatus, d.id)
+		return err
+	}
+
+	// Shutting down is not the receiver's fault; the lease expires and the
+	// delivery is retried, possibly by another instance
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if d.attempts >= maxWebhookAttempts {
+		_, err := db.Exec(`
+			UPDATE webhook_deliveries SET status = 'failed', response_status = $1, last_error = $2
+			WHERE id = $3`, responseStatus, attemptErr.Error(), d.id)
+		return err
+	}
+	_, err := db.Exec(`
+		UPDATE webhook_deliveries SET response_status = $1, last_error = $2, next_attempt_at = $3
+		WHERE id = $4`, responseStatus, attemptErr.Error(), time.Now().Add(webhookRetryDelay(d.attempts)), d.id)
+	return err
+}
+
+// attemptDelivery posts a delivery to its webhook and returns the response
+// status, or 0 if there was no response. Any status outside 2xx is an error.
+func attemptDelivery(ctx context.Context, client *http.Client, d webhookDelivery) (int, error) {
+	secret, err := encryption.Decrypt(d.secret, fieldWebhookSecret, d.webhookID)
+	if err != nil {
+		return 0, errors.New("webhook secret can't be decrypted")
+	}
+	data, err := encryption.Decrypt(d.payload, fieldWebhookPayload, d.id)
+	if err != nil {
+		return 0, errors.New("payload can't be decrypted")
+	}
+
+	body, err := json.Marshal(struct {
+		ID        int             `json:"id"`
+		Event     string          `json:"event"`
+		CreatedAt time.Time       `json:"createdAt"`
+		Data      json.RawMessage `json:"data"`
+	}{d.id, d.event, d.createdAt, json.RawMessage(data)})
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "MMTM-Webhooks/1.0")
+	req.Header.Set("X-Mmtm-Event", d.event)
+	req.Header.Set("X-Mmtm-Delivery", strconv.Itoa(d.id))
+	req.Header.Set("X-Mmtm-Timestamp", timestamp)
+	req.Header.Set("X-Mmtm-Signature", SignWebhook(secret, timestamp, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// webhookRetryDelay is the backoff after a delivery's given failed attempt.
+func webhookRetryDelay(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+	return webhookBackoff << (attempts - 1)
+}
+
+// PurgeWebhookDeliveries deletes finished deliveries past the retention
+// period and returns how many it deleted.
+func PurgeWebhookDeliveries(db *sql.DB) (int64, error) {
+	result, err := db.Exec(`
+		DELETE FROM webhook_deliveries
+		WHERE status != 'pending' AND created_at < $1`, time.Now().Add(-webhookDeliveryRetention))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
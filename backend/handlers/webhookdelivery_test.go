@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mmtm/encryption"
+)
+
+// execLog is a database that accepts any statement and records it, for
+// checking what sendDelivery writes.
+type execLog struct {
+	mu    sync.Mutex
+	execs []loggedExec
+}
+
+type loggedExec struct {
+	query string
+	args  []driver.Value
+}
+
+type execLogConn struct{ log *execLog }
+
+func (c *execLogConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements not supported")
+}
+func (c *execLogConn) Close() error { return nil }
+func (c *execLogConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions not supported")
+}
+
+func (c *execLogConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	exec := loggedExec{query: query}
+	for _, arg := range args {
+		exec.args = append(exec.args, arg.Value)
+	}
+	c.log.mu.Lock()
+	defer c.log.mu.Unlock()
+	c.log.execs = append(c.log.execs, exec)
+	return driver.RowsAffected(1), nil
+}
+
+type execLogDriver struct{}
+
+var (
+	registerExecLog sync.Once
+	execLogs        sync.Map
+)
+
+func (execLogDriver) Open(name string) (driver.Conn, error) {
+	log, ok := execLogs.Load(name)
+	if !ok {
+		return nil, errors.New("no exec log named " + name)
+	}
+	return &execLogConn{log.(*execLog)}, nil
+}
+
+// openExecLog returns a database recording its statements in log.
+func openExecLog(t *testing.T, log *execLog) *sql.DB {
+	t.Helper()
+	registerExecLog.Do(func() { sql.Register("execlog", execLogDriver{}) })
+	execLogs.Store(t.Name(), log)
+	db, err := sql.Open("execlog", t.Name())
+	if err != nil {
+		t.Fatalf("opening the exec log: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// testDelivery returns a delivery to url with its secret and payload sealed
+// as they are stored.
+func testDelivery(t *testing.T, url, secret string, attempts int) webhookDelivery {
+	t.Helper()
+	d := webhookDelivery{
+		id:        42,
+		webhookID: 7,
+		event:     "task.created",
+		attempts:  attempts,
+		createdAt: time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC),
+		url:       url,
+	}
+	var err error
+	if d.secret, err = encryption.Encrypt(secret, fieldWebhookSecret, d.webhookID); err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	if d.payload, err = encryption.Encrypt(`{"title":"Buy milk"}`, fieldWebhookPayload, d.id); err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	return d
+}
+
+func TestAttemptDeliverySignsPayload(t *testing.T) {
+	useEncryptionKeys(t, "k", "k")
+	const secret = "whsec_test"
+
+	var got *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	status, err := attemptDelivery(context.Background(), server.Client(), testDelivery(t, server.URL, secret, 1))
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("attemptDelivery = %d, %v, want 204", status, err)
+	}
+
+	timestamp := got.Header.Get("X-Mmtm-Timestamp")
+	if want := SignWebhook(secret, timestamp, body); got.Header.Get("X-Mmtm-Signature") != want {
+		t.Errorf("X-Mmtm-Signature = %q, want %q", got.Header.Get("X-Mmtm-Signature"), want)
+	}
+	if got.Header.Get("X-Mmtm-Event") != "task.created" || got.Header.Get("X-Mmtm-Delivery") != "42" {
+		t.Errorf("event headers = %q, %q", got.Header.Get("X-Mmtm-Event"), got.Header.Get("X-Mmtm-Delivery"))
+	}
+
+	var sent struct {
+		ID    int             `json:"id"`
+		Event string          `json:"event"`
+		Data  json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &sent); err != nil {
+		t.Fatalf("body %s: %v", body, err)
+	}
+	if sent.ID != 42 || sent.Event != "task.created" || string(sent.Data) != `{"title":"Buy milk"}` {
+		t.Errorf("body = %s", body)
+	}
+}
+
+func TestSendDeliveryRecordsOutcome(t *testing.T) {
+	useEncryptionKeys(t, "k", "k")
+
+	tests := []struct {
+		name     string
+		status   int
+		attempts int
+		// want is part of the statement recording the outcome
+		want  string
+		retry bool
+	}{
+		{"delivered", http.StatusOK, 1, "status = 'delivered'", false},
+		{"retried after an error status", http.StatusInternalServerError, 3, "next_attempt_at = $3", true},
+		{"redirects are not followed", http.StatusFound, 1, "next_attempt_at = $3", true},
+		{"failed after the last attempt", http.StatusServiceUnavailable, maxWebhookAttempts, "status = 'failed'", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.status == http.StatusFound {
+					w.Header().Set("Location", "/elsewhere")
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+			log := &execLog{}
+			db := openExecLog(t, log)
+
+			before := time.Now()
+			err := sendDelivery(context.Background(), db, NewWebhookClient(false), testDelivery(t, server.URL, "whsec_test", tt.attempts))
+			after := time.Now()
+			if err != nil {
+				t.Fatalf("sendDelivery: %v", err)
+			}
+
+			if len(log.execs) != 1 {
+				t.Fatalf("got %d statements, want 1", len(log.execs))
+			}
+			exec := log.execs[0]
+			if !strings.Contains(exec.query, tt.want) {
+				t.Errorf("statement = %q, want it to set %q", exec.query, tt.want)
+			}
+			if exec.args[0] != int64(tt.status) {
+				t.Errorf("response status = %v, want %d", exec.args[0], tt.status)
+			}
+			if tt.retry {
+				next := exec.args[2].(time.Time)
+				delay := webhookRetryDelay(tt.attempts)
+				if next.Before(before.Add(delay)) || next.After(after.Add(delay)) {
+					t.Errorf("next attempt in %v, want %v", next.Sub(before), delay)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	tests := map[int]time.Duration{
+		0: time.Minute,
+		1: time.Minute,
+		2: 2 * time.Minute,
+		3: 4 * time.Minute,
+		7: 64 * time.Minute,
+	}
+	for attempts, want := range tests {
+		if got := webhookRetryDelay(attempts); got != want {
+			t.Errorf("webhookRetryDelay(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+func TestWebhookAddressAllowed(t *testing.T) {
+	tests := []struct {
+		addr    string
+		allowed bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"100.64.0.1", false},
+		{"169.254.169.254", false},
+		{"192.168.1.1", false},
+		{"0.0.0.0", false},
+		{"255.255.255.255", false},
+		{"::1", false},
+		{"::", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		// IPv4-mapped addresses are checked as the IPv4 address they carry
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+		{"::ffff:93.184.216.34", true},
+		// NAT64 and 6to4 reach IPv4 through a gateway, so no embedded address is trusted
+		{"64:ff9b::a9fe:a9fe", false},
+		{"64:ff9b::5db8:d822", false},
+		{"64:ff9b:1::a00:1", false},
+		{"2002:7f00:1::", false},
+		{"2002:5db8:d822::1", false},
+	}
+	for _, tt := range tests {
+		if got := webhookAddressAllowed(netip.MustParseAddr(tt.addr)); got != tt.allowed {
+			t.Errorf("webhookAddressAllowed(%s) = %v, want %v", tt.addr, got, tt.allowed)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"mmtm/models"
+)
+
+const (
+	// upcomingPerMember is how many of the next due tasks a workload lists
+	upcomingPerMember = 5
+	// overloadedFactor is how far above the average load a member counts as
+	// overloaded
+	overloadedFactor = 1.5
+	defaultMoodDays  = 7
+	maxMoodDays      = 30
+)
+
+var priorityWeight = map[string]int{"Low": 1, "Medium": 2, "High": 3}
+
+// GetWorkload sums the open tasks of each member of a workspace. Owners can
+// add ?moods=true to include the dominant mood over the last ?days=7 days of
+// each member who chose to share it, so they can spot who is both overloaded
+// and stressed; only the mood itself is shared, never the journal text.
+func (h *WorkspaceHandler) GetWorkload(c *gin.Context) {
+	workspace, ok := h.loadWorkspace(c, false)
+	if !ok {
+		return
+	}
+
+	withMoods := c.Query("moods") == "true"
+	moodDays := defaultMoodDays
+	if withMoods {
+		if workspace.Role != models.WorkspaceRoleOwner {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only workspace owners can see members' moods"})
+			return
+		}
+		if days := c.Query("days"); days != "" {
+			d, err := strconv.Atoi(days)
+			if err != nil || d < 1 || d > maxMoodDays {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "days must be between 1 and 30"})
+				return
+			}
+			moodDays = d
+		}
+	}
+
+	rows, err := h.db.Query(`
+		SELECT m.user_id, u.username, m.role, m.share_mood
+		FROM workspace_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.workspace_id = $1
+		ORDER BY m.created_at, m.user_id`, workspace.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch members"})
+		return
+	}
+	defer rows.Close()
+
+	response := models.WorkloadResponse{WorkspaceID: workspace.ID, Members: []models.MemberWorkload{}}
+	index := make(map[int]int)
+	for rows.Next() {
+		var member models.MemberWorkload
+		if err := rows.Scan(&member.UserID, &member.Username, &member.Role, &member.ShareMood); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan member"})
+			return
+		}
+		member.Upcoming = []models.UpcomingTask{}
+		index[member.UserID] = len(response.Members)
+		response.Members = append(response.Members, member)
+	}
+	rows.Close()
+	response.Unassigned.Upcoming = []models.UpcomingTask{}
+
+	taskRows, err := h.db.Query(`
+		SELECT id, title, priority, importance, due_date, assignee_id
+		FROM tasks
+		WHERE workspace_id = $1 AND status != 'Completed'
+		ORDER BY due_date, id`, workspace.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tasks"})
+		return
+	}
+	defer taskRows.Close()
+
+	now := time.Now()
+	weekAhead := now.AddDate(0, 0, 7)
+	for taskRows.Next() {
+		var task models.UpcomingTask
+		var importance int
+		var assigneeID *int
+		if err := taskRows.Scan(&task.ID, &task.Title, &task.Priority, &importance,
+			&task.DueDate, &assigneeID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan task"})
+			return
+		}
+
+		workload := &response.Unassigned
+		if assigneeID != nil {
+			if i, ok := index[*assigneeID]; ok {
+				workload = &response.Members[i].Workload
+			}
+		}
+
+		workload.OpenTasks++
+		workload.Load += priorityWeight[task.Priority] * importance
+		if task.DueDate.Before(now) {
+			workload.Overdue++
+		} else if task.DueDate.Before(weekAhead) {
+			workload.DueThisWeek++
+		}
+		// Tasks arrive by due date, so the first ones are the most pressing
+		if len(workload.Upcoming) < upcomingPerMember {
+			workload.Upcoming = append(workload.Upcoming, task)
+		}
+	}
+	if err := taskRows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tasks"})
+		return
+	}
+
+	markOverloaded(response.Members)
+
+	if withMoods {
+		if err := h.addDominantMoods(response.Members, index, workspace.ID, moodDays); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch moods"})
+			return
+		}
+		response.MoodDays = moodDays
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// markOverloaded compares each member's load with the average over the
+// members who can be assigned tasks.
+func markOverloaded(members []models.MemberWorkload) {
+	total, assignable := 0, 0
+	for _, member := range members {
+		if canEditTasks(member.Role) {
+			total += member.Load
+			assignable++
+		}
+	}
+	if total == 0 {
+		return
+	}
+
+	average := float64(total) / float64(assignable)
+	for i := range members {
+		members[i].RelativeLoad = float64(members[i].Load) / average
+		members[i].Overloaded = members[i].RelativeLoad >= overloadedFactor
+	}
+}
+
+// addDominantMoods sets the most frequent mood over the last days of each
+// member who shares their mood; ties go to the mood logged most recently.
+func (h *WorkspaceHandler) addDominantMoods(members []models.MemberWorkload, index map[int]int, workspaceID, days int) error {
+	rows, err := h.db.Query(`
+		SELECT user_id, mood, COUNT(*), MAX(created_at)
+		FROM mood_logs
+		WHERE user_id IN (SELECT user_id FROM workspace_members WHERE workspace_id = $1 AND share_mood)
+		  AND created_at >= $2
+		GROUP BY user_id, mood`, workspaceID, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type dominant struct {
+		count  int
+		latest time.Time
+	}
+	best := make(map[int]dominant)
+	for rows.Next() {
+		var userID, count int
+		var mood string
+		var latest time.Time
+		if err := rows.Scan(&userID, &mood, &count, &latest); err != nil {
+			return err
+		}
+		i, ok := index[userID]
+		if !ok {
+			continue
+		}
+
+		members[i].MoodLogs += count
+		current, seen := best[userID]
+		if !seen || count > current.count || (count == current.count && latest.After(current.latest)) {
+			best[userID] = dominant{count: count, latest: latest}
+			members[i].DominantMood = mood
+		}
+	}
+	return rows.Err()
+}
+
+// SetMoodSharing lets the user choose whether the owners of a workspace may
+// see their dominant mood in its workload. Nobody shares it by default.
+func (h *WorkspaceHandler) SetMoodSharing(c *gin.Context) {
+	workspace, ok := h.loadWorkspace(c, false)
+	if !ok {
+		return
+	}
+
+	var req models.MoodSharingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err := h.db.Exec("UPDATE workspace_members SET share_mood = $1 WHERE workspace_id = $2 AND user_id = $3",
+		*req.ShareMood, workspace.ID, c.GetInt("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update mood sharing"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"shareMood": *req.ShareMood})
+}
@@ -0,0 +1,603 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"mmtm/models"
+)
+
+// Access errors of the task helpers. Each has a fixed status and message,
+// see respondTaskError.
+var (
+	errTaskForbidden       = errors.New("You don't have permission to change this task")
+	errWorkspaceNotFound   = errors.New("Workspace not found")
+	errWorkspaceForbidden  = errors.New("Only workspace editors and owners can add tasks to it")
+	errTaskHasDependencies = errors.New("Remove the task's dependencies before moving it to another workspace")
+	errInvalidAssignee     = errors.New("Tasks can only be assigned to editors and owners of their workspace, or to yourself for personal tasks")
+)
+
+type WorkspaceHandler struct {
+	db *sql.DB
+}
+
+func NewWorkspaceHandler(db *sql.DB) *WorkspaceHandler {
+	return &WorkspaceHandler{db: db}
+}
+
+// visibleTasks is an SQL condition matching the tasks a user can see: their
+// personal tasks and the tasks of workspaces they belong to. prefix
+// qualifies the task columns (e.g. "t.") and param is the placeholder
+// holding the user ID.
+func visibleTasks(prefix, param string) string {
+	return fmt.Sprintf(`((%[1]sworkspace_id IS NULL AND %[1]suser_id = %[2]s) OR
+		%[1]sworkspace_id IN (SELECT workspace_id FROM workspace_members WHERE user_id = %[2]s))`, prefix, param)
+}
+
+// taskRole returns the user's role for a task: owner of their personal
+// tasks and their membership role for workspace tasks. It returns
+// sql.ErrNoRows if the user can't see the task.
+func taskRole(q queryRower, userID, taskID int) (string, error) {
+	var role string
+	err := q.QueryRow(`
+		SELECT CASE WHEN t.workspace_id IS NULL THEN 'owner' ELSE m.role END
+		FROM tasks t
+		LEFT JOIN workspace_members m ON m.workspace_id = t.workspace_id AND m.user_id = $2
+		WHERE t.id = $1 AND `+visibleTasks("t.", "$2"), taskID, userID).Scan(&role)
+	return role, err
+}
+
+// workspaceRole returns the user's role in a workspace, or sql.ErrNoRows if
+// they are not a member.
+func workspaceRole(q queryRower, userID, workspaceID int) (string, error) {
+	var role string
+	err := q.QueryRow("SELECT role FROM workspace_members WHERE workspace_id = $1 AND user_id = $2",
+		workspaceID, userID).Scan(&role)
+	return role, err
+}
+
+func canEditTasks(role string) bool {
+	return role == models.WorkspaceRoleOwner || role == models.WorkspaceRoleEditor
+}
+
+// authorizeTaskEdit checks that the user may change a task. It returns
+// sql.ErrNoRows for tasks they can't see and errTaskForbidden for tasks they
+// can only view.
+func authorizeTaskEdit(q queryRower, userID, taskID int) error {
+	role, err := taskRole(q, userID, taskID)
+	if err != nil {
+		return err
+	}
+	if !canEditTasks(role) {
+		return errTaskForbidden
+	}
+	return nil
+}
+
+// authorizeWorkspaceTasks checks that the user may add tasks to a workspace.
+func authorizeWorkspaceTasks(q queryRower, userID, workspaceID int) error {
+	role, err := workspaceRole(q, userID, workspaceID)
+	if err == sql.ErrNoRows {
+		return errWorkspaceNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if !canEditTasks(role) {
+		return errWorkspaceForbidden
+	}
+	return nil
+}
+
+// taskMoveTarget validates moving a task to workspaceID, or back to its
+// creator's personal tasks when it is 0, and returns the new workspace_id
+// and whether it changes. Dependencies can't span workspaces, so tasks with
+// dependencies can't move.
+func taskMoveTarget(tx *sql.Tx, userID, taskID, workspaceID int) (sql.NullInt64, bool, error) {
+	var creatorID int
+	var current sql.NullInt64
+	var linked bool
+	err := tx.QueryRow(`
+		SELECT user_id, workspace_id,
+		       EXISTS(SELECT 1 FROM task_dependencies WHERE task_id = $1 OR depends_on_id = $1)
+		FROM tasks WHERE id = $1`, taskID).Scan(&creatorID, &current, &linked)
+	if err != nil {
+		return current, false, err
+	}
+
+	if int(current.Int64) == workspaceID {
+		return current, false, nil
+	}
+	if linked {
+		return current, false, errTaskHasDependencies
+	}
+	if workspaceID == 0 {
+		// Only the creator can take a task private, as it becomes theirs
+		if creatorID != userID {
+			return current, false, errTaskForbidden
+		}
+		return sql.NullInt64{}, true, nil
+	}
+	if err := authorizeWorkspaceTasks(tx, userID, workspaceID); err != nil {
+		return current, false, err
+	}
+	return sql.NullInt64{Int64: int64(workspaceID), Valid: true}, true, nil
+}
+
+// taskWorkspace returns the workspace a task is in once an update moving it
+// to moveTo (0 for personal, nil for no move) is applied.
+func taskWorkspace(q queryRower, taskID int, moveTo *int) (*int, error) {
+	if moveTo != nil {
+		if *moveTo == 0 {
+			return nil, nil
+		}
+		return moveTo, nil
+	}
+	var workspaceID *int
+	err := q.QueryRow("SELECT workspace_id FROM tasks WHERE id = $1", taskID).Scan(&workspaceID)
+	return workspaceID, err
+}
+
+// checkAssignee checks that a task in workspaceID (nil for a personal task
+// of userID) can be assigned to assigneeID. Viewers can't work on tasks, so
+// only editors and owners can be assigned.
+func checkAssignee(q queryRower, userID int, workspaceID *int, assigneeID int) error {
+	if workspaceID == nil {
+		if assigneeID != userID {
+			return errInvalidAssignee
+		}
+		return nil
+	}
+	role, err := workspaceRole(q, assigneeID, *workspaceID)
+	if err == sql.ErrNoRows || (err == nil && !canEditTasks(role)) {
+		return errInvalidAssignee
+	}
+	return err
+}
+
+// isTaskAccessError reports whether err is one of the access errors, whose
+// message can be shown to the client.
+func isTaskAccessError(err error) bool {
+	switch err {
+	case errTaskForbidden, errWorkspaceNotFound, errWorkspaceForbidden, errTaskHasDependencies, errInvalidAssignee:
+		return true
+	}
+	return false
+}
+
+// respondTaskError answers with the status of an access error, 404 for
+// sql.ErrNoRows and 500 with fallback for anything else.
+func respondTaskError(c *gin.Context, err error, fallback string) {
+	switch err {
+	case sql.ErrNoRows:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
+	case errWorkspaceNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errTaskForbidden, errWorkspaceForbidden:
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errTaskHasDependencies:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errInvalidAssignee:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+	}
+}
+
+// loadWorkspace returns a workspace with the user's role in it. It writes
+// the error response and returns false if the workspace doesn't exist, the
+// user isn't a member or, when ownerOnly is set, isn't an owner.
+func (h *WorkspaceHandler) loadWorkspace(c *gin.Context, ownerOnly bool) (models.Workspace, bool) {
+	var workspace models.Workspace
+	workspaceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid workspace ID"})
+		return workspace, false
+	}
+
+	err = h.db.QueryRow(`
+		SELECT w.id, w.name, m.role, w.created_at, w.updated_at
+		FROM workspaces w
+		JOIN workspace_members m ON m.workspace_id = w.id AND m.user_id = $2
+		WHERE w.id = $1`, workspaceID, c.GetInt("user_id")).Scan(
+		&workspace.ID, &workspace.Name, &workspace.Role, &workspace.CreatedAt, &workspace.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Workspace not found"})
+			return workspace, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return workspace, false
+	}
+
+	if ownerOnly && workspace.Role != models.WorkspaceRoleOwner {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only workspace owners can do this"})
+		return workspace, false
+	}
+	return workspace, true
+}
+
+func (h *WorkspaceHandler) ListWorkspaces(c *gin.Context) {
+	rows, err := h.db.Query(`
+		SELECT w.id, w.name, m.role, w.created_at, w.updated_at
+		FROM workspaces w
+		JOIN workspace_members m ON m.workspace_id = w.id
+		WHERE m.user_id = $1
+		ORDER BY w.name, w.id`, c.GetInt("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch workspaces"})
+		return
+	}
+	defer rows.Close()
+
+	workspaces := []models.Workspace{}
+	for rows.Next() {
+		var workspace models.Workspace
+		if err := rows.Scan(&workspace.ID, &workspace.Name, &workspace.Role,
+			&workspace.CreatedAt, &workspace.UpdatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan workspace"})
+			return
+		}
+		workspaces = append(workspaces, workspace)
+	}
+
+	c.JSON(http.StatusOK, workspaces)
+}
+
+// CreateWorkspace creates a workspace owned by the current user.
+func (h *WorkspaceHandler) CreateWorkspace(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var req models.WorkspaceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	workspace := models.Workspace{Name: req.Name, Role: models.WorkspaceRoleOwner}
+	err = tx.QueryRow(`
+		INSERT INTO workspaces (name) VALUES ($1)
+		RETURNING id, created_at, updated_at`, req.Name).Scan(
+		&workspace.ID, &workspace.CreatedAt, &workspace.UpdatedAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create workspace"})
+		return
+	}
+
+	_, err = tx.Exec("INSERT INTO workspace_members (workspace_id, user_id, role) VALUES ($1, $2, $3)",
+		workspace.ID, userID, models.WorkspaceRoleOwner)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create workspace"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create workspace"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, workspace)
+}
+
+// GetWorkspace returns a workspace with its members.
+func (h *WorkspaceHandler) GetWorkspace(c *gin.Context) {
+	workspace, ok := h.loadWorkspace(c, false)
+	if !ok {
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT m.user_id, u.username, m.role, m.share_mood, m.created_at
+		FROM workspace_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.workspace_id = $1
+		ORDER BY m.created_at, m.user_id`, workspace.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch members"})
+		return
+	}
+	defer rows.Close()
+
+	workspace.Members = []models.WorkspaceMember{}
+	for rows.Next() {
+		var member models.WorkspaceMember
+		if err := rows.Scan(&member.UserID, &member.Username, &member.Role, &member.ShareMood, &member.CreatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan member"})
+			return
+		}
+		workspace.Members = append(workspace.Members, member)
+	}
+
+	c.JSON(http.StatusOK, workspace)
+}
+
+func (h *WorkspaceHandler) UpdateWorkspace(c *gin.Context) {
+	workspace, ok := h.loadWorkspace(c, true)
+	if !ok {
+		return
+	}
+
+	var req models.WorkspaceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := h.db.QueryRow(`
+		UPDATE workspaces SET name = $1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2 RETURNING name, updated_at`, req.Name, workspace.ID).Scan(
+		&workspace.Name, &workspace.UpdatedAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update workspace"})
+		return
+	}
+
+	c.JSON(http.StatusOK, workspace)
+}
+
+// DeleteWorkspace deletes a workspace together with its tasks.
+func (h *WorkspaceHandler) DeleteWorkspace(c *gin.Context) {
+	workspace, ok := h.loadWorkspace(c, true)
+	if !ok {
+		return
+	}
+
+	if _, err := h.db.Exec("DELETE FROM workspaces WHERE id = $1", workspace.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete workspace"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Workspace deleted successfully"})
+}
+
+// AddMember adds an existing user to the workspace.
+func (h *WorkspaceHandler) AddMember(c *gin.Context) {
+	workspace, ok := h.loadWorkspace(c, true)
+	if !ok {
+		return
+	}
+
+	var req models.AddWorkspaceMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	member := models.WorkspaceMember{Role: req.Role}
+	err := h.db.QueryRow(`
+		SELECT id, username FROM users
+		WHERE (email = $1 OR username = $2) AND deleted_at IS NULL`, req.Email, req.Username).Scan(
+		&member.UserID, &member.Username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	err = h.db.QueryRow(`
+		INSERT INTO workspace_members (workspace_id, user_id, role)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (workspace_id, user_id) DO NOTHING
+		RETURNING created_at`, workspace.ID, member.UserID, member.Role).Scan(&member.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusConflict, gin.H{"error": "User is already a member"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add member"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, member)
+}
+
+// UpdateMember changes a member's role. A workspace always keeps at least
+// one owner.
+func (h *WorkspaceHandler) UpdateMember(c *gin.Context) {
+	workspace, ok := h.loadWorkspace(c, true)
+	if !ok {
+		return
+	}
+	memberID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var req models.UpdateWorkspaceMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	if req.Role != models.WorkspaceRoleOwner {
+		if ok := keepsAnOwner(c, tx, workspace.ID, memberID); !ok {
+			return
+		}
+	}
+	if req.Role == models.WorkspaceRoleViewer {
+		if err := unassignMember(tx, workspace.ID, memberID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update member"})
+			return
+		}
+	}
+
+	var member models.WorkspaceMember
+	err = tx.QueryRow(`
+		UPDATE workspace_members m SET role = $1
+		FROM users u
+		WHERE u.id = m.user_id AND m.workspace_id = $2 AND m.user_id = $3
+		RETURNING m.user_id, u.username, m.role, m.created_at`, req.Role, workspace.ID, memberID).Scan(
+		&member.UserID, &member.Username, &member.Role, &member.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update member"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update member"})
+		return
+	}
+
+	c.JSON(http.StatusOK, member)
+}
+
+// RemoveMember removes a member from the workspace. Owners can remove
+// anyone and every member can leave. The tasks they created stay, the tasks
+// assigned to them are unassigned.
+func (h *WorkspaceHandler) RemoveMember(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	memberID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	workspace, ok := h.loadWorkspace(c, memberID != userID)
+	if !ok {
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	if ok := keepsAnOwner(c, tx, workspace.ID, memberID); !ok {
+		return
+	}
+
+	result, err := tx.Exec("DELETE FROM workspace_members WHERE workspace_id = $1 AND user_id = $2",
+		workspace.ID, memberID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove member"})
+		return
+	}
+	if removed, _ := result.RowsAffected(); removed == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+		return
+	}
+	if err := unassignMember(tx, workspace.ID, memberID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove member"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove member"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member removed successfully"})
+}
+
+// keepsAnOwner checks that the workspace still has an owner once memberID
+// stops being one. The owners are locked so concurrent changes can't remove
+// the last two at once.
+func keepsAnOwner(c *gin.Context, tx *sql.Tx, workspaceID, memberID int) bool {
+	rows, err := tx.Query(`
+		SELECT user_id FROM workspace_members
+		WHERE workspace_id = $1 AND role = $2
+		FOR UPDATE`, workspaceID, models.WorkspaceRoleOwner)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	defer rows.Close()
+
+	others := 0
+	for rows.Next() {
+		var ownerID int
+		if err := rows.Scan(&ownerID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return false
+		}
+		if ownerID != memberID {
+			others++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+
+	if others == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "A workspace needs at least one owner. Make someone else an owner or delete the workspace"})
+		return false
+	}
+	return true
+}
+
+// unassignMember unassigns the workspace's tasks from a member who can no
+// longer work on them.
+func unassignMember(tx *sql.Tx, workspaceID, memberID int) error {
+	_, err := tx.Exec("UPDATE tasks SET assignee_id = NULL WHERE workspace_id = $1 AND assignee_id = $2",
+		workspaceID, memberID)
+	return err
+}
+
+// handOverWorkspaces prepares a user's workspaces for the user to be
+// erased: where they are the last owner the longest-standing member is
+// promoted, workspaces left without members are deleted and the tasks they
+// created are handed to an owner, so shared work survives the account.
+func handOverWorkspaces(tx *sql.Tx, userID int) error {
+	_, err := tx.Exec(`
+		UPDATE workspace_members m SET role = 'owner'
+		WHERE (m.workspace_id, m.user_id) IN (
+			SELECT DISTINCT ON (o.workspace_id) o.workspace_id, o.user_id
+			FROM workspace_members o
+			JOIN workspace_members leaving ON leaving.workspace_id = o.workspace_id
+			     AND leaving.user_id = $1 AND leaving.role = 'owner'
+			WHERE o.user_id <> $1
+			  AND NOT EXISTS (SELECT 1 FROM workspace_members w
+			                  WHERE w.workspace_id = o.workspace_id AND w.role = 'owner' AND w.user_id <> $1)
+			ORDER BY o.workspace_id, o.created_at, o.user_id
+		)`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM workspaces w
+		WHERE EXISTS (SELECT 1 FROM workspace_members m WHERE m.workspace_id = w.id AND m.user_id = $1)
+		  AND NOT EXISTS (SELECT 1 FROM workspace_members m WHERE m.workspace_id = w.id AND m.user_id <> $1)`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE tasks t SET user_id = (
+			SELECT m.user_id FROM workspace_members m
+			WHERE m.workspace_id = t.workspace_id AND m.role = 'owner' AND m.user_id <> $1
+			ORDER BY m.created_at, m.user_id LIMIT 1
+		)
+		WHERE t.user_id = $1 AND t.workspace_id IS NOT NULL`, userID)
+	return err
+}
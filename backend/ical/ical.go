@@ -0,0 +1,252 @@
+package ical
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Property is a single content line such as "DUE;TZID=Europe/Paris:20240101T090000".
+type Property struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// Component is a BEGIN/END block such as VCALENDAR, VTODO or VEVENT.
+type Component struct {
+	Name       string
+	Properties []Property
+	Components []*Component
+}
+
+// Get returns the first property with the given name, or nil.
+func (c *Component) Get(name string) *Property {
+	for i := range c.Properties {
+		if c.Properties[i].Name == name {
+			return &c.Properties[i]
+		}
+	}
+	return nil
+}
+
+// Text returns the unescaped value of the named property, or "".
+func (c *Component) Text(name string) string {
+	if p := c.Get(name); p != nil {
+		return Unescape(p.Value)
+	}
+	return ""
+}
+
+// Add appends a property with no parameters.
+func (c *Component) Add(name, value string) {
+	c.Properties = append(c.Properties, Property{Name: name, Value: value})
+}
+
+// AddText appends a property whose value is escaped as TEXT.
+func (c *Component) AddText(name, value string) {
+	c.Add(name, Escape(value))
+}
+
+// Encode writes the component in RFC 5545 format with CRLF line endings and
+// lines folded at 75 octets.
+func (c *Component) Encode(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if err := c.encode(bw); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func (c *Component) encode(w *bufio.Writer) error {
+	if err := writeLine(w, "BEGIN:"+c.Name); err != nil {
+		return err
+	}
+	for _, p := range c.Properties {
+		line := p.Name
+		for k, v := range p.Params {
+			line += ";" + k + "=" + v
+		}
+		if err := writeLine(w, line+":"+p.Value); err != nil {
+			return err
+		}
+	}
+	for _, child := range c.Components {
+		if err := child.encode(w); err != nil {
+			return err
+		}
+	}
+	return writeLine(w, "END:"+c.Name)
+}
+
+func writeLine(w *bufio.Writer, line string) error {
+	// Continuation lines start with a space, leaving 74 octets of content
+	limit := 75
+	for len(line) > limit {
+		// Never split a multi-byte UTF-8 sequence
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		if _, err := w.WriteString(line[:cut] + "\r\n "); err != nil {
+			return err
+		}
+		line = line[cut:]
+		limit = 74
+	}
+	_, err := w.WriteString(line + "\r\n")
+	return err
+}
+
+// Escape escapes a TEXT value.
+func Escape(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+	return r.Replace(s)
+}
+
+// Unescape reverses Escape.
+func Unescape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+			switch s[i] {
+			case 'n', 'N':
+				b.WriteByte('\n')
+			default:
+				b.WriteByte(s[i])
+			}
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// FormatTime formats t as a UTC DATE-TIME value.
+func FormatTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// ParseTime parses a DATE or DATE-TIME property, honouring TZID. Floating
+// times without a zone are read as UTC.
+func (p *Property) ParseTime() (time.Time, error) {
+	loc := time.UTC
+	if tzid := p.Params["TZID"]; tzid != "" {
+		if l, err := time.LoadLocation(strings.Trim(tzid, `"`)); err == nil {
+			loc = l
+		}
+	}
+
+	if t, err := time.Parse("20060102T150405Z", p.Value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"20060102T150405", "20060102"} {
+		if t, err := time.ParseInLocation(layout, p.Value, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", p.Value)
+}
+
+// Parse reads an iCalendar stream and returns its top-level component.
+func Parse(r io.Reader) (*Component, error) {
+	lines, err := unfold(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var root *Component
+	var stack []*Component
+	for n, line := range lines {
+		if line == "" {
+			continue
+		}
+		prop, err := parseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n+1, err)
+		}
+
+		switch prop.Name {
+		case "BEGIN":
+			comp := &Component{Name: strings.ToUpper(prop.Value)}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.Components = append(parent.Components, comp)
+			} else if root == nil {
+				root = comp
+			}
+			stack = append(stack, comp)
+		case "END":
+			if len(stack) == 0 || stack[len(stack)-1].Name != strings.ToUpper(prop.Value) {
+				return nil, fmt.Errorf("line %d: unexpected END:%s", n+1, prop.Value)
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("line %d: property outside of a component", n+1)
+			}
+			cur := stack[len(stack)-1]
+			cur.Properties = append(cur.Properties, prop)
+		}
+	}
+
+	if root == nil {
+		return nil, fmt.Errorf("no calendar found")
+	}
+	if len(stack) > 0 {
+		return nil, fmt.Errorf("unterminated component %s", stack[len(stack)-1].Name)
+	}
+	return root, nil
+}
+
+// unfold joins continuation lines (those starting with a space or tab).
+func unfold(r io.Reader) ([]string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	var lines []string
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+func parseLine(line string) (Property, error) {
+	// The value starts at the first colon outside a quoted parameter value
+	inQuotes := false
+	colon := -1
+	for i, ch := range line {
+		if ch == '"' {
+			inQuotes = !inQuotes
+		} else if ch == ':' && !inQuotes {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return Property{}, fmt.Errorf("missing ':' in %q", line)
+	}
+
+	head, value := line[:colon], line[colon+1:]
+	parts := strings.Split(head, ";")
+	prop := Property{Name: strings.ToUpper(parts[0]), Value: value}
+	for _, param := range parts[1:] {
+		k, v, ok := strings.Cut(param, "=")
+		if !ok {
+			continue
+		}
+		if prop.Params == nil {
+			prop.Params = make(map[string]string)
+		}
+		prop.Params[strings.ToUpper(k)] = v
+	}
+	return prop, nil
+}
@@ -0,0 +1,214 @@
+package ical
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseUnfoldsLines(t *testing.T) {
+	input := "BEGIN:VCALENDAR\r\n" +
+		"BEGIN:VTODO\r\n" +
+		"SUMMARY:A long\r\n" +
+		"  summary\r\n" +
+		"DESCRIPTION:tab\r\n" +
+		"\tcontinued\n" + // bare LF line endings are accepted too
+		"END:VTODO\r\n" +
+		"END:VCALENDAR\r\n"
+
+	cal, err := Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if len(cal.Components) != 1 {
+		t.Fatalf("got %d components, want 1", len(cal.Components))
+	}
+	todo := cal.Components[0]
+	if got := todo.Text("SUMMARY"); got != "A long summary" {
+		t.Errorf("SUMMARY = %q, want %q", got, "A long summary")
+	}
+	if got := todo.Text("DESCRIPTION"); got != "tabcontinued" {
+		t.Errorf("DESCRIPTION = %q, want %q", got, "tabcontinued")
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want Property
+	}{
+		{"summary:Buy milk", Property{Name: "SUMMARY", Value: "Buy milk"}},
+		{"DUE;TZID=Europe/Paris:20240101T090000", Property{
+			Name: "DUE", Params: map[string]string{"TZID": "Europe/Paris"}, Value: "20240101T090000",
+		}},
+		{`ATTENDEE;CN="Doe: Jane":mailto:jane@example.com`, Property{
+			Name: "ATTENDEE", Params: map[string]string{"CN": `"Doe: Jane"`}, Value: "mailto:jane@example.com",
+		}},
+		{"DESCRIPTION:", Property{Name: "DESCRIPTION", Value: ""}},
+	}
+	for _, tt := range tests {
+		got, err := parseLine(tt.line)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseLine(%q) = %+v, %v, want %+v", tt.line, got, err, tt.want)
+		}
+	}
+
+	if _, err := parseLine("no colon here"); err == nil {
+		t.Error("parseLine without a colon succeeded, want an error")
+	}
+}
+
+func TestParseRejectsMalformed(t *testing.T) {
+	tests := map[string]string{
+		"empty":          "",
+		"unterminated":   "BEGIN:VCALENDAR\r\nBEGIN:VTODO\r\nEND:VTODO\r\n",
+		"mismatched end": "BEGIN:VCALENDAR\r\nBEGIN:VTODO\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n",
+		"outside":        "SUMMARY:Stray\r\nBEGIN:VCALENDAR\r\nEND:VCALENDAR\r\n",
+	}
+	for name, input := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Parse(strings.NewReader(input)); err == nil {
+				t.Error("Parse succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestTextEscaping(t *testing.T) {
+	tests := []struct {
+		text    string
+		escaped string
+	}{
+		{"plain", "plain"},
+		{"a, b; c", `a\, b\; c`},
+		{`back\slash`, `back\\slash`},
+		{"two\nlines", `two\nlines`},
+		{"crlf\r\nline", `crlf\nline`},
+	}
+	for _, tt := range tests {
+		if got := Escape(tt.text); got != tt.escaped {
+			t.Errorf("Escape(%q) = %q, want %q", tt.text, got, tt.escaped)
+		}
+		want := strings.ReplaceAll(tt.text, "\r\n", "\n")
+		if got := Unescape(tt.escaped); got != want {
+			t.Errorf("Unescape(%q) = %q, want %q", tt.escaped, got, want)
+		}
+	}
+
+	// Other clients write \N for newlines
+	if got := Unescape(`one\Ntwo`); got != "one\ntwo" {
+		t.Errorf("Unescape of \\N = %q", got)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skipf("time zone data unavailable: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		prop Property
+		want time.Time
+	}{
+		{
+			name: "UTC date-time",
+			prop: Property{Value: "20240315T143000Z"},
+			want: time.Date(2024, time.March, 15, 14, 30, 0, 0, time.UTC),
+		},
+		{
+			name: "date-time with TZID",
+			prop: Property{Params: map[string]string{"TZID": "Europe/Paris"}, Value: "20240715T090000"},
+			want: time.Date(2024, time.July, 15, 9, 0, 0, 0, paris),
+		},
+		{
+			name: "quoted TZID",
+			prop: Property{Params: map[string]string{"TZID": `"Europe/Paris"`}, Value: "20240115T090000"},
+			want: time.Date(2024, time.January, 15, 9, 0, 0, 0, paris),
+		},
+		{
+			name: "date with TZID",
+			prop: Property{Params: map[string]string{"TZID": "Europe/Paris", "VALUE": "DATE"}, Value: "20240315"},
+			want: time.Date(2024, time.March, 15, 0, 0, 0, 0, paris),
+		},
+		{
+			name: "floating date-time",
+			prop: Property{Value: "20240315T090000"},
+			want: time.Date(2024, time.March, 15, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "date",
+			prop: Property{Params: map[string]string{"VALUE": "DATE"}, Value: "20240315"},
+			want: time.Date(2024, time.March, 15, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "unknown TZID falls back to UTC",
+			prop: Property{Params: map[string]string{"TZID": "Nowhere/Special"}, Value: "20240315T090000"},
+			want: time.Date(2024, time.March, 15, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "UTC ignores TZID",
+			prop: Property{Params: map[string]string{"TZID": "Europe/Paris"}, Value: "20240315T090000Z"},
+			want: time.Date(2024, time.March, 15, 9, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.prop.ParseTime()
+			if err != nil {
+				t.Fatalf("ParseTime: %v", err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("ParseTime = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := (&Property{Value: "2024-03-15"}).ParseTime(); err == nil {
+		t.Error("ParseTime of an ISO date succeeded, want an error")
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	due := time.Date(2024, time.March, 15, 14, 30, 0, 0, time.UTC)
+	description := strings.Repeat("Ünïcödé, with; special\\chars\nand lines. ", 5)
+
+	todo := &Component{Name: "VTODO"}
+	todo.Add("UID", "task-1@mmtm")
+	todo.AddText("SUMMARY", "Buy milk, eggs; bread")
+	todo.AddText("DESCRIPTION", description)
+	todo.Add("DUE", FormatTime(due))
+	cal := &Component{Name: "VCALENDAR", Components: []*Component{todo}}
+	cal.Add("VERSION", "2.0")
+
+	var buf bytes.Buffer
+	if err := cal.Encode(&buf); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	for _, line := range strings.SplitAfter(buf.String(), "\r\n") {
+		if len(line) > 75+len("\r\n") {
+			t.Errorf("line longer than 75 octets: %q", line)
+		}
+		if !strings.HasSuffix(line, "\r\n") && line != "" {
+			t.Errorf("line without CRLF: %q", line)
+		}
+	}
+
+	parsed, err := Parse(&buf)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if !reflect.DeepEqual(parsed, cal) {
+		t.Fatalf("Parse(Encode(cal)) = %+v, want %+v", parsed, cal)
+	}
+	got := parsed.Components[0]
+	if got.Text("DESCRIPTION") != description {
+		t.Errorf("DESCRIPTION = %q, want %q", got.Text("DESCRIPTION"), description)
+	}
+	if dueTime, err := got.Get("DUE").ParseTime(); err != nil || !dueTime.Equal(due) {
+		t.Errorf("DUE = %v, %v, want %v", dueTime, err, due)
+	}
+}
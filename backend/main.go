@@ -1,16 +1,34 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 
+	"mmtm/auth"
 	"mmtm/db"
+	"mmtm/encryption"
+	"mmtm/events"
 	"mmtm/handlers"
+	"mmtm/mail"
 	"mmtm/middleware"
+	"mmtm/models"
+	"mmtm/oidc"
+	"mmtm/ratelimit"
+	"mmtm/realtime"
+	"mmtm/scheduler"
 )
 
 func main() {
@@ -19,6 +37,63 @@ func main() {
 		log.Println("No .env file found")
 	}
 
+	// Refuse to start without usable token signing keys
+	if err := auth.Configure(); err != nil {
+		log.Fatal("Invalid JWT configuration: ", err)
+	}
+
+	if err := encryption.Configure(); err != nil {
+		log.Fatal("Invalid encryption configuration: ", err)
+	}
+	if !encryption.Enabled() {
+		log.Println("ENCRYPTION_KEYS not set: mood logs and task notes are stored unencrypted")
+	}
+
+	oidcConfig, err := oidc.ConfigFromEnv()
+	if err != nil {
+		log.Fatal("Invalid OIDC configuration: ", err)
+	}
+
+	mailer, err := mail.FromEnv()
+	if err != nil {
+		log.Fatal("Invalid mail configuration: ", err)
+	}
+
+	verificationPolicy, err := middleware.VerificationPolicyFromEnv()
+	if err != nil {
+		log.Fatal("Invalid email verification configuration: ", err)
+	}
+
+	var deletionGrace time.Duration
+	if grace := os.Getenv("ACCOUNT_DELETION_GRACE_PERIOD"); grace != "" {
+		if deletionGrace, err = time.ParseDuration(grace); err != nil || deletionGrace < 0 {
+			log.Fatal("Invalid ACCOUNT_DELETION_GRACE_PERIOD: ", grace)
+		}
+	}
+
+	var moodRetention time.Duration
+	if retention := os.Getenv("MOOD_LOG_RETENTION"); retention != "" {
+		if moodRetention, err = time.ParseDuration(retention); err != nil || moodRetention < 0 {
+			log.Fatal("Invalid MOOD_LOG_RETENTION: ", retention)
+		}
+	}
+
+	dueSoon := handlers.DefaultDueSoonWindow
+	if window := os.Getenv("DUE_SOON_WINDOW"); window != "" {
+		if dueSoon, err = time.ParseDuration(window); err != nil || dueSoon <= 0 {
+			log.Fatal("Invalid DUE_SOON_WINDOW: ", window)
+		}
+	}
+
+	// Webhooks can't reach private networks unless explicitly allowed, e.g.
+	// for a local receiver in development
+	blockPrivateWebhooks := true
+	if block := os.Getenv("WEBHOOK_BLOCK_PRIVATE_NETWORKS"); block != "" {
+		if blockPrivateWebhooks, err = strconv.ParseBool(block); err != nil {
+			log.Fatal("Invalid WEBHOOK_BLOCK_PRIVATE_NETWORKS: ", block)
+		}
+	}
+
 	// Initialize database
 	database, err := db.InitDB()
 	if err != nil {
@@ -26,9 +101,26 @@ func main() {
 	}
 	defer database.Close()
 
+	limiter, err := ratelimit.FromEnv(database)
+	if err != nil {
+		log.Fatal("Invalid rate limit configuration: ", err)
+	}
+
 	// Initialize Gin router
 	r := gin.Default()
 
+	// Client IPs key rate limits and login lockouts, so X-Forwarded-For is
+	// only believed from the proxies in TRUSTED_PROXIES
+	var trustedProxies []string
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			trustedProxies = append(trustedProxies, proxy)
+		}
+	}
+	if err := r.SetTrustedProxies(trustedProxies); err != nil {
+		log.Fatal("Invalid TRUSTED_PROXIES: ", err)
+	}
+
 	// CORS middleware
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"http://localhost:3000", "https://your-frontend-domain.com"},
@@ -38,51 +130,293 @@ func main() {
 		AllowCredentials: true,
 	}))
 
+	// Rate limits for endpoints that send mail, check tokens or are expensive to serve
+	accountLimit := ratelimit.Every(time.Minute, 5)
+	tokenLimit := ratelimit.Every(6*time.Second, 10)
+	moodLimit := ratelimit.Every(3*time.Minute, 10) // calls a paid API
+	importLimit := ratelimit.Every(time.Minute, 5)
+
+	broker, err := realtime.FromEnv(database, db.ConnString(), handlers.RealtimeLoader(database))
+	if err != nil {
+		log.Fatal("Failed to start realtime broker: ", err)
+	}
+	defer broker.Close()
+
+	// Notifications and live updates are produced from events published by
+	// the handlers. Webhook deliveries are queued with the change itself
+	bus := events.NewBus()
+	handlers.RegisterNotifications(bus, database)
+	handlers.RegisterRealtime(bus, database, broker)
+
 	// Initialize handlers
-	authHandler := handlers.NewAuthHandler(database)
-	taskHandler := handlers.NewTaskHandler(database)
-	userHandler := handlers.NewUserHandler(database)
-	moodHandler := handlers.NewMoodHandler(database)
+	authHandler := handlers.NewAuthHandler(database, mailer, limiter)
+	taskHandler := handlers.NewTaskHandler(database, bus)
+	userHandler := handlers.NewUserHandler(database, mailer, limiter, deletionGrace)
+	moodHandler := handlers.NewMoodHandler(database, bus)
+	calendarHandler := handlers.NewCalendarHandler(database, bus)
+	dataHandler := handlers.NewDataHandler(database, bus)
+	workspaceHandler := handlers.NewWorkspaceHandler(database)
+	notificationHandler := handlers.NewNotificationHandler(database)
+	eventsHandler := handlers.NewEventsHandler(database, broker)
+	webhookHandler := handlers.NewWebhookHandler(database)
 
 	// Public routes
 	api := r.Group("/api")
 	{
-		api.POST("/auth/register", authHandler.Register)
+		api.POST("/auth/register", middleware.RateLimitByIP(limiter, "register", accountLimit), authHandler.Register)
 		api.POST("/auth/login", authHandler.Login)
+		api.POST("/auth/refresh", authHandler.Refresh)
+		api.POST("/auth/logout", authHandler.Logout)
+		api.POST("/auth/2fa/verify", authHandler.VerifyTwoFactor)
+		api.POST("/auth/verify-email", middleware.RateLimitByIP(limiter, "verify_email", tokenLimit), authHandler.VerifyEmail)
+		api.POST("/auth/forgot-password", middleware.RateLimitByIP(limiter, "forgot_password", accountLimit), authHandler.ForgotPassword)
+		api.POST("/auth/reset-password", middleware.RateLimitByIP(limiter, "reset_password", tokenLimit), authHandler.ResetPassword)
+
+		// Single sign-on, only when an identity provider is configured
+		if oidcConfig != nil {
+			oidcHandler := handlers.NewOIDCHandler(database, oidc.NewProvider(*oidcConfig))
+			api.GET("/auth/oidc/authorize", oidcHandler.Authorize)
+			api.POST("/auth/oidc/callback", middleware.RateLimitByIP(limiter, "oidc_callback", tokenLimit), oidcHandler.Callback)
+		}
+
+		// Calendar feed, authenticated by its own feed token
+		api.GET("/calendar.ics", calendarHandler.Feed)
 	}
 
-	// Protected routes
-	protected := api.Group("/")
-	protected.Use(middleware.AuthMiddleware())
+	// Routes that personal API tokens can use too, each with the scope tokens need
+	scoped := api.Group("/")
+	scoped.Use(middleware.APITokenAuthMiddleware(database), middleware.RequireVerifiedEmail(database, verificationPolicy))
 	{
+		tasksRead := middleware.RequireScope(models.ScopeTasksRead)
+		tasksWrite := middleware.RequireScope(models.ScopeTasksWrite)
+
 		// Task routes
-		protected.GET("/tasks", taskHandler.GetTasks)
-		protected.POST("/tasks", taskHandler.CreateTask)
-		protected.GET("/tasks/:id", taskHandler.GetTask)
-		protected.PUT("/tasks/:id", taskHandler.UpdateTask)
-		protected.DELETE("/tasks/:id", taskHandler.DeleteTask)
-		protected.POST("/tasks/reorganize", taskHandler.ReorganizeTasks)
+		scoped.GET("/tasks", tasksRead, taskHandler.GetTasks)
+		scoped.POST("/tasks", tasksWrite, taskHandler.CreateTask)
+		scoped.GET("/tasks/:id", tasksRead, taskHandler.GetTask)
+		scoped.PUT("/tasks/:id", tasksWrite, taskHandler.UpdateTask)
+		scoped.DELETE("/tasks/:id", tasksWrite, taskHandler.DeleteTask)
+		scoped.POST("/tasks/reorganize", tasksRead, taskHandler.ReorganizeTasks)
+		scoped.POST("/plan/today", tasksRead, taskHandler.PlanToday)
+		scoped.POST("/tasks/bulk", tasksWrite, taskHandler.BulkTasks)
+		scoped.GET("/tasks/:id/dependencies", tasksRead, taskHandler.GetDependencies)
+		scoped.POST("/tasks/:id/dependencies", tasksWrite, taskHandler.AddDependency)
+		scoped.DELETE("/tasks/:id/dependencies/:dependsOnId", tasksWrite, taskHandler.RemoveDependency)
+		scoped.GET("/tasks/:id/comments", tasksRead, taskHandler.GetComments)
+		scoped.POST("/tasks/:id/comments", tasksWrite, taskHandler.CreateComment)
+		scoped.PUT("/tasks/:id/comments/:commentId", tasksWrite, taskHandler.UpdateComment)
+		scoped.DELETE("/tasks/:id/comments/:commentId", tasksWrite, taskHandler.DeleteComment)
+		scoped.POST("/tasks/:id/timer/start", tasksWrite, taskHandler.StartTimer)
+		scoped.POST("/tasks/:id/timer/stop", tasksWrite, taskHandler.StopTimer)
+		scoped.GET("/tasks/:id/time-entries", tasksRead, taskHandler.GetTimeEntries)
+		scoped.POST("/tasks/:id/time-entries", tasksWrite, taskHandler.CreateTimeEntry)
+		scoped.DELETE("/tasks/:id/time-entries/:entryId", tasksWrite, taskHandler.DeleteTimeEntry)
+		scoped.GET("/timer", tasksRead, taskHandler.GetTimer)
+		scoped.GET("/reports/time", tasksRead, taskHandler.GetTimeReport)
+		scoped.GET("/focus/sessions", tasksRead, taskHandler.ListFocusSessions)
+		scoped.POST("/focus/sessions", tasksWrite, taskHandler.StartFocusSession)
+		scoped.GET("/focus/sessions/current", tasksRead, taskHandler.GetFocusSession)
+		scoped.POST("/focus/sessions/:id/pause", tasksWrite, taskHandler.PauseFocusSession)
+		scoped.POST("/focus/sessions/:id/resume", tasksWrite, taskHandler.ResumeFocusSession)
+		scoped.POST("/focus/sessions/:id/complete", tasksWrite, taskHandler.CompleteFocusSession)
+		scoped.POST("/focus/sessions/:id/interrupt", tasksWrite, taskHandler.InterruptFocusSession)
+		scoped.GET("/focus/stats", tasksRead, taskHandler.GetFocusStats)
+		scoped.POST("/tasks/import/ics", tasksWrite, middleware.RateLimitByUser(limiter, "import", importLimit), calendarHandler.ImportICS)
 
+		// Mood routes
+		scoped.POST("/mood/analyze", middleware.RequireScope(models.ScopeMoodWrite),
+			middleware.RateLimitByUser(limiter, "mood_analyze", moodLimit), moodHandler.AnalyzeMood)
+	}
+
+	// Protected routes, for login sessions only
+	protected := api.Group("/")
+	protected.Use(middleware.AuthMiddleware(database), middleware.RequireVerifiedEmail(database, verificationPolicy))
+	{
 		// User routes
 		protected.GET("/user", userHandler.GetProfile)
 		protected.PUT("/user", userHandler.UpdateProfile)
+		protected.DELETE("/user", userHandler.DeleteAccount)
+		protected.POST("/user/verification-email", userHandler.ResendVerificationEmail)
+		protected.GET("/user/2fa", userHandler.GetTwoFactor)
+		protected.POST("/user/2fa/setup", userHandler.SetupTwoFactor)
+		protected.POST("/user/2fa/enable", middleware.RateLimitByUser(limiter, "2fa_manage", tokenLimit), userHandler.EnableTwoFactor)
+		protected.POST("/user/2fa/disable", middleware.RateLimitByUser(limiter, "2fa_manage", tokenLimit), userHandler.DisableTwoFactor)
+		protected.POST("/user/2fa/recovery-codes", middleware.RateLimitByUser(limiter, "2fa_manage", tokenLimit), userHandler.RegenerateRecoveryCodes)
+		protected.GET("/user/sessions", userHandler.ListSessions)
+		protected.DELETE("/user/sessions", userHandler.RevokeOtherSessions)
+		protected.DELETE("/user/sessions/:id", userHandler.RevokeSession)
+		protected.GET("/user/tokens", userHandler.ListAPITokens)
+		protected.POST("/user/tokens", userHandler.CreateAPIToken)
+		protected.DELETE("/user/tokens/:id", userHandler.DeleteAPIToken)
+		protected.POST("/user/calendar-token", calendarHandler.CreateFeedToken)
+		protected.DELETE("/user/calendar-token", calendarHandler.RevokeFeedToken)
 
-		// Mood routes
-		protected.POST("/mood/analyze", moodHandler.AnalyzeMood)
+		// Workspace routes
+		protected.GET("/workspaces", workspaceHandler.ListWorkspaces)
+		protected.POST("/workspaces", workspaceHandler.CreateWorkspace)
+		protected.GET("/workspaces/:id", workspaceHandler.GetWorkspace)
+		protected.PUT("/workspaces/:id", workspaceHandler.UpdateWorkspace)
+		protected.DELETE("/workspaces/:id", workspaceHandler.DeleteWorkspace)
+		protected.GET("/workspaces/:id/workload", workspaceHandler.GetWorkload)
+		protected.PUT("/workspaces/:id/mood-sharing", workspaceHandler.SetMoodSharing)
+		protected.POST("/workspaces/:id/members", workspaceHandler.AddMember)
+		protected.PUT("/workspaces/:id/members/:userId", workspaceHandler.UpdateMember)
+		protected.DELETE("/workspaces/:id/members/:userId", workspaceHandler.RemoveMember)
+
+		// Notification routes
+		protected.GET("/notifications", notificationHandler.ListNotifications)
+		protected.POST("/notifications/:id/read", notificationHandler.MarkNotificationRead)
+		protected.POST("/notifications/read", notificationHandler.MarkAllNotificationsRead)
+
+		// Webhook routes
+		protected.GET("/webhooks", webhookHandler.ListWebhooks)
+		protected.POST("/webhooks", webhookHandler.CreateWebhook)
+		protected.PUT("/webhooks/:id", webhookHandler.UpdateWebhook)
+		protected.DELETE("/webhooks/:id", webhookHandler.DeleteWebhook)
+		protected.POST("/webhooks/:id/secret", webhookHandler.RotateWebhookSecret)
+		protected.GET("/webhooks/:id/deliveries", webhookHandler.ListDeliveries)
+		protected.POST("/webhooks/:id/deliveries/:deliveryId/redeliver", webhookHandler.RedeliverWebhook)
+
+		// Data portability routes
+		protected.GET("/export", middleware.RateLimitByUser(limiter, "export", importLimit), dataHandler.Export)
+		protected.POST("/import", middleware.RateLimitByUser(limiter, "import", importLimit), dataHandler.Import)
 	}
 
+	// Encrypt plaintext left from before encryption was enabled and move
+	// values off retired keys
+	go func() {
+		rewritten, err := handlers.ReencryptData(database)
+		if err != nil {
+			log.Printf("Re-encryption failed: %v", err)
+		} else if encryption.Enabled() {
+			log.Printf("Re-encryption finished: %d values rewritten with key %q", rewritten, encryption.ActiveKeyID())
+		}
+	}()
+
+	// Live event stream. Browsers' EventSource can't send headers, so it
+	// trades its access token for a single-use ticket and passes ?ticket=
+	api.POST("/events/ticket", middleware.AuthMiddleware(database),
+		middleware.RequireVerifiedEmail(database, verificationPolicy), eventsHandler.IssueTicket)
+	api.GET("/events", middleware.StreamTicketAuth(database),
+		middleware.RequireVerifiedEmail(database, verificationPolicy), eventsHandler.Stream)
+
 	// Health check
 	r.GET("/health", func(c *gin.Context) {
 		c.JSON(200, gin.H{"status": "ok"})
 	})
 
+	// Background jobs, run by one instance at a time
+	jobs := scheduler.New(database)
+	jobs.Add(scheduler.Job{
+		Name:     "due-reminders",
+		Schedule: scheduler.Every(5 * time.Minute),
+		Run: func(ctx context.Context) (string, error) {
+			published, err := handlers.CheckDueTasks(database, bus, dueSoon)
+			return fmt.Sprintf("%d reminder events", published), err
+		},
+	})
+	jobs.Add(scheduler.Job{
+		Name:     "mark-overdue",
+		Schedule: scheduler.Daily(2, 0),
+		Run: func(ctx context.Context) (string, error) {
+			marked, cleared, err := handlers.MarkOverdueTasks(database)
+			return fmt.Sprintf("%d tasks marked overdue, %d cleared", marked, cleared), err
+		},
+	})
+	jobs.Add(scheduler.Job{
+		Name:     "daily-digest",
+		Schedule: scheduler.Daily(6, 0),
+		Run: func(ctx context.Context) (string, error) {
+			sent, err := handlers.SendDailyDigests(database, bus)
+			return fmt.Sprintf("%d digests", sent), err
+		},
+	})
+	jobs.Add(scheduler.Job{
+		Name:     "purge-accounts",
+		Schedule: scheduler.Every(time.Hour),
+		Run: func(ctx context.Context) (string, error) {
+			purged, err := handlers.PurgeDeletedAccounts(database)
+			return fmt.Sprintf("%d accounts purged", purged), err
+		},
+	})
+	if moodRetention > 0 {
+		jobs.Add(scheduler.Job{
+			Name:     "mood-retention",
+			Schedule: scheduler.Daily(3, 0),
+			Run: func(ctx context.Context) (string, error) {
+				deleted, err := handlers.PurgeOldMoodLogs(database, moodRetention)
+				return fmt.Sprintf("%d mood logs deleted", deleted), err
+			},
+		})
+	}
+	jobs.Add(scheduler.Job{
+		Name:     "webhook-retention",
+		Schedule: scheduler.Daily(3, 30),
+		Run: func(ctx context.Context) (string, error) {
+			deleted, err := handlers.PurgeWebhookDeliveries(database)
+			return fmt.Sprintf("%d webhook deliveries deleted", deleted), err
+		},
+	})
+
+	// Stop on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	schedulerDone := make(chan struct{})
+	go func() {
+		jobs.Run(ctx)
+		close(schedulerDone)
+	}()
+
+	// Webhooks are sent from every instance; deliveries are claimed with
+	// SKIP LOCKED so none is sent twice
+	webhookClient := handlers.NewWebhookClient(blockPrivateWebhooks)
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := handlers.DeliverWebhooks(ctx, database, webhookClient); err != nil && ctx.Err() == nil {
+					log.Printf("Webhook delivery failed: %v", err)
+				}
+			}
+		}
+	}()
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
 
-	log.Printf("Server starting on port %s", port)
-	if err := r.Run(":" + port); err != nil {
-		log.Fatal("Failed to start server:", err)
+	// Requests aren't cancelled by the signal, so Shutdown lets them finish.
+	// Event streams never finish on their own and are closed when it starts.
+	server := &http.Server{
+		Addr:        ":" + port,
+		Handler:     r,
+		BaseContext: func(net.Listener) context.Context { return context.Background() },
+	}
+	server.RegisterOnShutdown(eventsHandler.Close)
+	go func() {
+		log.Printf("Server starting on port %s", port)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal("Failed to start server:", err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Server shutdown: %v", err)
+	}
+	// Let the job in progress finish
+	select {
+	case <-schedulerDone:
+	case <-shutdownCtx.Done():
+		log.Println("Scheduler did not stop in time")
 	}
 }
@@ -1,15 +1,99 @@
 package middleware
 
 import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
 	"net/http"
-	"os"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
+
+	"mmtm/auth"
 )
 
-func AuthMiddleware() gin.HandlerFunc {
+// AuthMiddleware authenticates requests with an access token from a login
+// session.
+func AuthMiddleware(db *sql.DB) gin.HandlerFunc {
+	return authenticate(db, false)
+}
+
+// APITokenAuthMiddleware also accepts personal API tokens. Routes behind it
+// must declare the scope tokens need with RequireScope.
+func APITokenAuthMiddleware(db *sql.DB) gin.HandlerFunc {
+	return authenticate(db, true)
+}
+
+// RequireScope restricts a route to API tokens granted scope. Requests from
+// login sessions have every scope.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if HasScope(c, scope) {
+			c.Next()
+			return
+		}
+
+		c.JSON(http.StatusForbidden, gin.H{"error": "API token is missing the " + scope + " scope"})
+		c.Abort()
+	}
+}
+
+// HasScope reports whether the request may act with scope, for handlers
+// whose need for a scope depends on the request. Login sessions may do
+// anything; API tokens only what they were granted.
+func HasScope(c *gin.Context, scope string) bool {
+	scopes, ok := c.Get("token_scopes")
+	if !ok {
+		return true
+	}
+	for _, granted := range scopes.([]string) {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// StreamTicketAuth authenticates event stream requests with a single-use
+// ticket passed as ?ticket=, for clients that can't set headers such as the
+// browser's EventSource. Tickets are short-lived and used up on the first
+// request, so they are harmless in access logs, unlike access tokens.
+// Requests without a ticket need an access token.
+func StreamTicketAuth(db *sql.DB) gin.HandlerFunc {
+	withToken := authenticate(db, false)
+	return func(c *gin.Context) {
+		ticket := c.Query("ticket")
+		if ticket == "" {
+			withToken(c)
+			return
+		}
+
+		sum := sha256.Sum256([]byte(ticket))
+		var userID, sessionID int
+		err := db.QueryRow(`
+			DELETE FROM stream_tickets t USING sessions s
+			WHERE t.ticket_hash = $1 AND t.expires_at > NOW()
+			  AND s.id = t.session_id AND s.revoked_at IS NULL AND s.expires_at > NOW()
+			RETURNING t.user_id, t.session_id`, hex.EncodeToString(sum[:])).Scan(&userID, &sessionID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired stream ticket"})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			}
+			c.Abort()
+			return
+		}
+
+		c.Set("user_id", userID)
+		c.Set("session_id", sessionID)
+		c.Next()
+	}
+}
+
+func authenticate(db *sql.DB, allowAPITokens bool) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
@@ -26,35 +110,82 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		// Parse and validate token
-		secret := os.Getenv("JWT_SECRET")
-		if secret == "" {
-			secret = "your-secret-key" // Use a secure secret in production
+		if strings.HasPrefix(tokenString, auth.APITokenPrefix) {
+			if !allowAPITokens {
+				c.JSON(http.StatusForbidden, gin.H{"error": "API tokens can't be used for this endpoint"})
+				c.Abort()
+				return
+			}
+			authenticateAPIToken(c, db, tokenString)
+			return
 		}
 
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, jwt.ErrSignatureInvalid
+		// Parse and validate token
+		claims, err := auth.ParseAccessToken(tokenString)
+		if err != nil {
+			if errors.Is(err, auth.ErrInvalidClaims) {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+			} else {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
 			}
-			return []byte(secret), nil
-		})
-
-		if err != nil || !token.Valid {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
 			c.Abort()
 			return
 		}
 
-		// Extract user ID from claims
-		if claims, ok := token.Claims.(jwt.MapClaims); ok {
-			if userID, ok := claims["user_id"].(float64); ok {
-				c.Set("user_id", int(userID))
-				c.Next()
-				return
+		// Reject tokens whose session was logged out or revoked
+		var lastUsedAt time.Time
+		err = db.QueryRow(`
+			SELECT last_used_at FROM sessions
+			WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL AND expires_at > NOW()`,
+			claims.SessionID, claims.UserID).Scan(&lastUsedAt)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Session revoked"})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 			}
+			c.Abort()
+			return
+		}
+
+		// Record activity at most once a minute to keep writes off the hot path
+		if time.Since(lastUsedAt) > time.Minute {
+			db.Exec("UPDATE sessions SET last_used_at = CURRENT_TIMESTAMP, ip = $1 WHERE id = $2",
+				c.ClientIP(), claims.SessionID)
 		}
 
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+		c.Set("user_id", claims.UserID)
+		c.Set("session_id", claims.SessionID)
+		c.Next()
+	}
+}
+
+func authenticateAPIToken(c *gin.Context, db *sql.DB, token string) {
+	sum := sha256.Sum256([]byte(token))
+
+	var tokenID, userID int
+	var scopes string
+	var lastUsedAt sql.NullTime
+	err := db.QueryRow(`
+		SELECT id, user_id, scopes, last_used_at FROM api_tokens
+		WHERE token_hash = $1 AND (expires_at IS NULL OR expires_at > NOW())`,
+		hex.EncodeToString(sum[:])).Scan(&tokenID, &userID, &scopes, &lastUsedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API token"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		}
 		c.Abort()
+		return
 	}
+
+	if !lastUsedAt.Valid || time.Since(lastUsedAt.Time) > time.Minute {
+		db.Exec("UPDATE api_tokens SET last_used_at = CURRENT_TIMESTAMP WHERE id = $1", tokenID)
+	}
+
+	c.Set("user_id", userID)
+	c.Set("api_token_id", tokenID)
+	c.Set("token_scopes", strings.Fields(scopes))
+	c.Next()
 }
@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"mmtm/ratelimit"
+)
+
+// RateLimitByIP limits requests to a route per client IP.
+func RateLimitByIP(limiter ratelimit.Limiter, name string, limit ratelimit.Limit) gin.HandlerFunc {
+	return rateLimit(limiter, limit, func(c *gin.Context) string {
+		return name + ":ip:" + c.ClientIP()
+	})
+}
+
+// RateLimitByUser limits requests to a route per authenticated user. It must
+// run after AuthMiddleware.
+func RateLimitByUser(limiter ratelimit.Limiter, name string, limit ratelimit.Limit) gin.HandlerFunc {
+	return rateLimit(limiter, limit, func(c *gin.Context) string {
+		return name + ":user:" + strconv.Itoa(c.GetInt("user_id"))
+	})
+}
+
+func rateLimit(limiter ratelimit.Limiter, limit ratelimit.Limit, key func(*gin.Context) string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		result, err := limiter.Allow(c.Request.Context(), key(c), limit)
+		if err != nil {
+			// Fail open: an unavailable limiter store shouldn't take the API down
+			log.Printf("Rate limiter error: %v", err)
+			c.Next()
+			return
+		}
+
+		if !result.Allowed {
+			c.Header("Retry-After", ratelimit.RetryAfter(result.RetryAfter))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests, please try again later"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
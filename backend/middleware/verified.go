@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Access levels for accounts whose email is not verified.
+const (
+	UnverifiedAccessFull     = "full"
+	UnverifiedAccessReadOnly = "read_only"
+	UnverifiedAccessNone     = "none"
+)
+
+// VerificationPolicy restricts accounts that have not verified their email
+// once their grace period is over.
+type VerificationPolicy struct {
+	Access      string
+	GracePeriod time.Duration
+}
+
+// VerificationPolicyFromEnv reads UNVERIFIED_ACCESS (full, read_only or none;
+// default full) and UNVERIFIED_GRACE_PERIOD (a duration such as 72h; default
+// 0).
+func VerificationPolicyFromEnv() (VerificationPolicy, error) {
+	policy := VerificationPolicy{Access: os.Getenv("UNVERIFIED_ACCESS")}
+	switch policy.Access {
+	case "":
+		policy.Access = UnverifiedAccessFull
+	case UnverifiedAccessFull, UnverifiedAccessReadOnly, UnverifiedAccessNone:
+	default:
+		return policy, fmt.Errorf("UNVERIFIED_ACCESS must be full, read_only or none, got %q", policy.Access)
+	}
+
+	if grace := os.Getenv("UNVERIFIED_GRACE_PERIOD"); grace != "" {
+		d, err := time.ParseDuration(grace)
+		if err != nil || d < 0 {
+			return policy, fmt.Errorf("invalid UNVERIFIED_GRACE_PERIOD %q", grace)
+		}
+		policy.GracePeriod = d
+	}
+	return policy, nil
+}
+
+// verificationExempt lists routes unverified users can always use, so they
+// can see their account, fix a mistyped address, ask for a new link and
+// delete the account.
+var verificationExempt = map[string]bool{
+	"GET /api/user":                     true,
+	"PUT /api/user":                     true,
+	"DELETE /api/user":                  true,
+	"POST /api/user/verification-email": true,
+	"GET /api/user/sessions":            true,
+	"DELETE /api/user/sessions":         true,
+	"DELETE /api/user/sessions/:id":     true,
+}
+
+// RequireVerifiedEmail applies the policy to authenticated requests. It must
+// run after AuthMiddleware.
+func RequireVerifiedEmail(db *sql.DB, policy VerificationPolicy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if policy.Access == UnverifiedAccessFull || verificationExempt[c.Request.Method+" "+c.FullPath()] {
+			c.Next()
+			return
+		}
+		if policy.Access == UnverifiedAccessReadOnly && (c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead) {
+			c.Next()
+			return
+		}
+
+		var verifiedAt sql.NullTime
+		var createdAt time.Time
+		err := db.QueryRow("SELECT email_verified_at, created_at FROM users WHERE id = $1",
+			c.GetInt("user_id")).Scan(&verifiedAt, &createdAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			c.Abort()
+			return
+		}
+
+		if !verifiedAt.Valid && time.Since(createdAt) > policy.GracePeriod {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Please verify your email address to continue"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+// Scopes a personal API token can be granted.
+const (
+	ScopeTasksRead  = "tasks:read"
+	ScopeTasksWrite = "tasks:write"
+	ScopeMoodWrite  = "mood:write"
+)
+
+type APIToken struct {
+	ID         int        `json:"id" db:"id"`
+	Name       string     `json:"name" db:"name"`
+	Prefix     string     `json:"prefix" db:"token_prefix"`
+	Scopes     []string   `json:"scopes" db:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt" db:"created_at"`
+	LastUsedAt *time.Time `json:"lastUsedAt" db:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expiresAt" db:"expires_at"`
+}
+
+type CreateAPITokenRequest struct {
+	Name          string   `json:"name" binding:"required,max=100"`
+	Scopes        []string `json:"scopes" binding:"required,min=1,dive,oneof=tasks:read tasks:write mood:write"`
+	ExpiresInDays *int     `json:"expiresInDays" binding:"omitempty,min=1,max=3650"`
+}
+
+// CreateAPITokenResponse is the only response that contains the token itself.
+type CreateAPITokenResponse struct {
+	APIToken
+	Token string `json:"token"`
+}
@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+type CalendarFeedResponse struct {
+	Token     string    `json:"token"`
+	URL       string    `json:"url"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type ImportError struct {
+	Index int    `json:"index"`
+	UID   string `json:"uid,omitempty"`
+	Error string `json:"error"`
+}
+
+type ICSImportResponse struct {
+	Imported int           `json:"imported"`
+	Tasks    []Task        `json:"tasks"`
+	Errors   []ImportError `json:"errors"`
+}
@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+// TaskComment is a comment on a task. Comments form threads through
+// ParentID. Content is Markdown and is returned as written, so clients must
+// render it safely.
+type TaskComment struct {
+	ID             int        `json:"id" db:"id"`
+	TaskID         int        `json:"taskId" db:"task_id"`
+	ParentID       *int       `json:"parentId,omitempty" db:"parent_id"`
+	AuthorID       *int       `json:"authorId" db:"user_id"`
+	AuthorUsername string     `json:"authorUsername" db:"-"`
+	Content        string     `json:"content" db:"content"`
+	Mentions       []string   `json:"mentions" db:"-"`
+	EditedAt       *time.Time `json:"editedAt,omitempty" db:"edited_at"`
+	Deleted        bool       `json:"deleted,omitempty" db:"-"`
+	CreatedAt      time.Time  `json:"createdAt" db:"created_at"`
+}
+
+type CreateCommentRequest struct {
+	Content  string `json:"content" binding:"required,max=10000"`
+	ParentID *int   `json:"parentId" binding:"omitempty,min=1"`
+}
+
+type UpdateCommentRequest struct {
+	Content string `json:"content" binding:"required,max=10000"`
+}
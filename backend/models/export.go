@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// ExportDocument is the JSON export format. Import accepts the same document;
+// the profile is informational and is not imported.
+type ExportDocument struct {
+	Version    int                  `json:"version"`
+	ExportedAt time.Time            `json:"exportedAt"`
+	Profile    *User                `json:"profile,omitempty"`
+	Tasks      *[]CreateTaskRequest `json:"tasks,omitempty"`
+	MoodLogs   *[]MoodLog           `json:"moodLogs,omitempty"`
+}
+
+type ImportRowError struct {
+	Dataset string `json:"dataset"`
+	Row     int    `json:"row"`
+	Error   string `json:"error"`
+}
+
+type ImportResponse struct {
+	Mode             string           `json:"mode"`
+	TasksCreated     int              `json:"tasksCreated"`
+	TasksUpdated     int              `json:"tasksUpdated"`
+	TasksDeleted     int              `json:"tasksDeleted"`
+	MoodLogsImported int              `json:"moodLogsImported"`
+	MoodLogsDeleted  int              `json:"moodLogsDeleted"`
+	Errors           []ImportRowError `json:"errors"`
+}
@@ -0,0 +1,66 @@
+package models
+
+import "time"
+
+// States of a focus session. Completed and interrupted sessions have ended.
+const (
+	FocusActive      = "active"
+	FocusPaused      = "paused"
+	FocusCompleted   = "completed"
+	FocusInterrupted = "interrupted"
+)
+
+// FocusSession is a stretch of focused work on a task. FocusedSeconds is the
+// time since it started, less the time spent paused, up to now for an open
+// session. CheckInMood is the mood the user reported when it ended, if any.
+type FocusSession struct {
+	ID             int        `json:"id" db:"id"`
+	TaskID         *int       `json:"taskId" db:"task_id"`
+	TaskTitle      string     `json:"taskTitle,omitempty" db:"-"`
+	PlannedMinutes int        `json:"plannedMinutes" db:"planned_minutes"`
+	Status         string     `json:"status" db:"status"`
+	StartMood      string     `json:"startMood,omitempty" db:"start_mood"`
+	StartedAt      time.Time  `json:"startedAt" db:"started_at"`
+	PausedAt       *time.Time `json:"pausedAt,omitempty" db:"paused_at"`
+	PausedSeconds  int        `json:"pausedSeconds" db:"paused_seconds"`
+	EndedAt        *time.Time `json:"endedAt,omitempty" db:"ended_at"`
+	FocusedSeconds int        `json:"focusedSeconds" db:"-"`
+	MoodLogID      *int       `json:"moodLogId,omitempty" db:"mood_log_id"`
+	CheckInMood    string     `json:"checkInMood,omitempty" db:"-"`
+}
+
+type StartFocusRequest struct {
+	TaskID int `json:"taskId" binding:"required,min=1"`
+	// PlannedMinutes defaults to 25
+	PlannedMinutes int `json:"plannedMinutes" binding:"omitempty,min=5,max=180"`
+}
+
+// EndFocusRequest ends a session, optionally with a quick mood check-in.
+type EndFocusRequest struct {
+	Mood string `json:"mood" binding:"omitempty,oneof=Happy Tired Stressed Focused Energetic"`
+	Note string `json:"note" binding:"max=1000"`
+}
+
+// FocusGroup sums the ended sessions sharing a task category or mood.
+type FocusGroup struct {
+	Sessions       int     `json:"sessions"`
+	Completed      int     `json:"completed"`
+	CompletionRate float64 `json:"completionRate"`
+	FocusedMinutes int     `json:"focusedMinutes"`
+}
+
+// FocusStats sums the user's ended focus sessions over the last Days days.
+// ByMood groups sessions by the mood the user was in when they started, and
+// CheckIns counts the moods reported when they ended.
+type FocusStats struct {
+	Days                  int                   `json:"days"`
+	Sessions              int                   `json:"sessions"`
+	Completed             int                   `json:"completed"`
+	Interrupted           int                   `json:"interrupted"`
+	CompletionRate        float64               `json:"completionRate"`
+	FocusedMinutes        int                   `json:"focusedMinutes"`
+	AverageFocusedMinutes int                   `json:"averageFocusedMinutes"`
+	ByCategory            map[string]FocusGroup `json:"byCategory"`
+	ByMood                map[string]FocusGroup `json:"byMood"`
+	CheckIns              map[string]int        `json:"checkIns"`
+}
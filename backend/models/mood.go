@@ -2,12 +2,19 @@ package models
 
 import "time"
 
+// Sources of mood logs.
+const (
+	MoodSourceAnalysis = "analysis"
+	MoodSourceCheckIn  = "check_in"
+)
+
 type MoodLog struct {
 	ID         int       `json:"id" db:"id"`
 	UserID     int       `json:"user_id" db:"user_id"`
 	Mood       string    `json:"mood" db:"mood"`
 	Confidence float64   `json:"confidence" db:"confidence"`
 	TextInput  string    `json:"text_input" db:"text_input"`
+	Source     string    `json:"source" db:"source"`
 	CreatedAt  time.Time `json:"created_at" db:"created_at"`
 }
 
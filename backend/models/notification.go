@@ -0,0 +1,43 @@
+package models
+
+import "time"
+
+// Notification types.
+const (
+	NotificationMention  = "mention"
+	NotificationAssigned = "assigned"
+	NotificationDueSoon  = "due_soon"
+	NotificationOverdue  = "overdue"
+	NotificationAtRisk   = "at_risk"
+	NotificationDigest   = "digest"
+)
+
+type Notification struct {
+	ID        int        `json:"id" db:"id"`
+	UserID    int        `json:"-" db:"user_id"`
+	Type      string     `json:"type" db:"type"`
+	Message   string     `json:"message" db:"message"`
+	TaskID    *int       `json:"taskId,omitempty" db:"task_id"`
+	CommentID *int       `json:"commentId,omitempty" db:"comment_id"`
+	ActorID   *int       `json:"actorId,omitempty" db:"actor_id"`
+	ReadAt    *time.Time `json:"readAt" db:"read_at"`
+	CreatedAt time.Time  `json:"createdAt" db:"created_at"`
+	// DedupeKey keeps a notification from being created twice for the same
+	// reason, e.g. the same task being overdue
+	DedupeKey string `json:"-" db:"dedupe_key"`
+}
+
+// Digest sums up a user's day for the daily digest. Counts cover the tasks
+// the user is responsible for.
+type Digest struct {
+	UserID             int
+	Date               string
+	DueToday           int
+	Overdue            int
+	CompletedYesterday int
+}
+
+type NotificationList struct {
+	Notifications []Notification `json:"notifications"`
+	UnreadCount   int            `json:"unreadCount"`
+}
@@ -0,0 +1,76 @@
+package models
+
+import "time"
+
+// Kinds of plan items.
+const (
+	PlanItemTask  = "task"
+	PlanItemBreak = "break"
+	PlanItemBusy  = "busy"
+)
+
+// Reasons a task is left out of a plan.
+const (
+	PlanBlocked       = "blocked"
+	PlanWouldMissDue  = "would_miss_due_date"
+	PlanNotEnoughTime = "not_enough_time"
+)
+
+type TimeBlock struct {
+	Start time.Time `json:"start" binding:"required"`
+	End   time.Time `json:"end" binding:"required"`
+	Title string    `json:"title" binding:"max=255"`
+}
+
+type PlanRequest struct {
+	// Start and End are the working hours to plan
+	Start time.Time `json:"start" binding:"required"`
+	End   time.Time `json:"end" binding:"required"`
+	// Busy blocks are fixed commitments, such as meetings, within the
+	// working hours
+	Busy []TimeBlock `json:"busy" binding:"max=50,dive"`
+	// Mood overrides the mood of the latest analysis
+	Mood string `json:"mood" binding:"omitempty,oneof=Happy Tired Stressed Focused Energetic"`
+}
+
+type PlanItem struct {
+	Type    string    `json:"type"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Minutes int       `json:"minutes"`
+	TaskID  *int      `json:"taskId,omitempty"`
+	Title   string    `json:"title,omitempty"`
+	// GuessedEstimate is set when the task has no estimate and its length
+	// was derived from its priority
+	GuessedEstimate bool       `json:"guessedEstimate,omitempty"`
+	Strict          bool       `json:"strict,omitempty"`
+	DueDate         *time.Time `json:"dueDate,omitempty"`
+}
+
+type UnscheduledTask struct {
+	TaskID  int    `json:"taskId"`
+	Title   string `json:"title"`
+	Minutes int    `json:"minutes"`
+	Reason  string `json:"reason"`
+}
+
+// WaitingTask is a task whose unfinished prerequisites aren't part of the
+// plan, such as tasks assigned to someone else. It is planned regardless.
+type WaitingTask struct {
+	TaskID          int    `json:"taskId"`
+	Title           string `json:"title"`
+	PrerequisiteIDs []int  `json:"prerequisiteIds"`
+}
+
+type Plan struct {
+	Mood             string            `json:"mood,omitempty"`
+	Start            time.Time         `json:"start"`
+	End              time.Time         `json:"end"`
+	FocusMinutes     int               `json:"focusMinutes"`
+	BreakMinutes     int               `json:"breakMinutes"`
+	ScheduledMinutes int               `json:"scheduledMinutes"`
+	FreeMinutes      int               `json:"freeMinutes"`
+	Items            []PlanItem        `json:"items"`
+	Unscheduled      []UnscheduledTask `json:"unscheduled"`
+	Waiting          []WaitingTask     `json:"waiting"`
+}
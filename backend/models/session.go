@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+type Session struct {
+	ID         int       `json:"id" db:"id"`
+	UserAgent  string    `json:"userAgent" db:"user_agent"`
+	IP         string    `json:"ip" db:"ip"`
+	Current    bool      `json:"current" db:"-"`
+	CreatedAt  time.Time `json:"createdAt" db:"created_at"`
+	LastUsedAt time.Time `json:"lastUsedAt" db:"last_used_at"`
+	ExpiresAt  time.Time `json:"expiresAt" db:"expires_at"`
+}
@@ -3,51 +3,114 @@ package models
 import "time"
 
 type Task struct {
-	ID            int       `json:"id" db:"id"`
-	UserID        int       `json:"user_id" db:"user_id"`
-	Title         string    `json:"title" db:"title"`
-	Description   string    `json:"description" db:"description"`
-	Category      string    `json:"category" db:"category"`
-	Priority      string    `json:"priority" db:"priority"`
-	Status        string    `json:"status" db:"status"`
-	DueDate       time.Time `json:"dueDate" db:"due_date"`
-	Importance    int       `json:"importance" db:"importance"`
-	Progress      int       `json:"progress" db:"progress"`
-	Reorganizable bool      `json:"reorganizable" db:"reorganizable"`
-	Strict        bool      `json:"strict" db:"strict"`
-	Notes         string    `json:"notes" db:"notes"`
-	CreatedAt     time.Time `json:"createdAt" db:"created_at"`
-	UpdatedAt     time.Time `json:"updatedAt" db:"updated_at"`
+	ID                 int       `json:"id" db:"id"`
+	UserID             int       `json:"user_id" db:"user_id"`
+	WorkspaceID        *int      `json:"workspaceId,omitempty" db:"workspace_id"`
+	AssigneeID         *int      `json:"assigneeId,omitempty" db:"assignee_id"`
+	Title              string    `json:"title" db:"title"`
+	Description        string    `json:"description" db:"description"`
+	Category           string    `json:"category" db:"category"`
+	Priority           string    `json:"priority" db:"priority"`
+	Status             string    `json:"status" db:"status"`
+	DueDate            time.Time `json:"dueDate" db:"due_date"`
+	Importance         int       `json:"importance" db:"importance"`
+	Progress           int       `json:"progress" db:"progress"`
+	EstimatedMinutes   *int      `json:"estimatedMinutes,omitempty" db:"estimated_minutes"`
+	TrackedMinutes     int       `json:"trackedMinutes" db:"-"`
+	Reorganizable      bool      `json:"reorganizable" db:"reorganizable"`
+	Strict             bool      `json:"strict" db:"strict"`
+	Notes              string    `json:"notes" db:"notes"`
+	RecurrenceRule     string    `json:"recurrenceRule" db:"recurrence_rule"`
+	Occurrence         int       `json:"occurrence" db:"occurrence"`
+	RecurrenceParentID *int      `json:"recurrenceParentId,omitempty" db:"recurrence_parent_id"`
+	Overdue            bool      `json:"overdue" db:"overdue"`
+	Blocked            bool      `json:"blocked" db:"-"`
+	Virtual            bool      `json:"virtual,omitempty" db:"-"`
+	CreatedAt          time.Time `json:"createdAt" db:"created_at"`
+	UpdatedAt          time.Time `json:"updatedAt" db:"updated_at"`
 }
 
 type CreateTaskRequest struct {
-	Title         string    `json:"title" binding:"required"`
-	Description   string    `json:"description"`
-	Category      string    `json:"category" binding:"required"`
-	Priority      string    `json:"priority" binding:"required,oneof=Low Medium High"`
-	Status        string    `json:"status" binding:"required,oneof=Todo 'In Progress' Completed"`
-	DueDate       time.Time `json:"dueDate" binding:"required"`
-	Importance    int       `json:"importance" binding:"required,min=1,max=10"`
-	Progress      int       `json:"progress" binding:"min=0,max=100"`
-	Reorganizable bool      `json:"reorganizable"`
-	Strict        bool      `json:"strict"`
-	Notes         string    `json:"notes"`
+	Title            string    `json:"title" binding:"required"`
+	Description      string    `json:"description"`
+	Category         string    `json:"category" binding:"required"`
+	Priority         string    `json:"priority" binding:"required,oneof=Low Medium High"`
+	Status           string    `json:"status" binding:"required,oneof=Todo 'In Progress' Completed"`
+	DueDate          time.Time `json:"dueDate" binding:"required"`
+	Importance       int       `json:"importance" binding:"required,min=1,max=10"`
+	Progress         int       `json:"progress" binding:"min=0,max=100"`
+	Reorganizable    bool      `json:"reorganizable"`
+	Strict           bool      `json:"strict"`
+	Notes            string    `json:"notes"`
+	RecurrenceRule   string    `json:"recurrenceRule"`
+	WorkspaceID      *int      `json:"workspaceId" binding:"omitempty,min=1"`
+	AssigneeID       *int      `json:"assigneeId" binding:"omitempty,min=1"`
+	EstimatedMinutes *int      `json:"estimatedMinutes" binding:"omitempty,min=1,max=1440"`
 }
 
 type UpdateTaskRequest struct {
-	Title         *string    `json:"title"`
-	Description   *string    `json:"description"`
-	Category      *string    `json:"category"`
-	Priority      *string    `json:"priority"`
-	Status        *string    `json:"status"`
-	DueDate       *time.Time `json:"dueDate"`
-	Importance    *int       `json:"importance"`
-	Progress      *int       `json:"progress"`
-	Reorganizable *bool      `json:"reorganizable"`
-	Strict        *bool      `json:"strict"`
-	Notes         *string    `json:"notes"`
+	Title          *string    `json:"title"`
+	Description    *string    `json:"description"`
+	Category       *string    `json:"category"`
+	Priority       *string    `json:"priority" binding:"omitempty,oneof=Low Medium High"`
+	Status         *string    `json:"status" binding:"omitempty,oneof=Todo 'In Progress' Completed"`
+	DueDate        *time.Time `json:"dueDate"`
+	Importance     *int       `json:"importance" binding:"omitempty,min=1,max=10"`
+	Progress       *int       `json:"progress" binding:"omitempty,min=0,max=100"`
+	Reorganizable  *bool      `json:"reorganizable"`
+	Strict         *bool      `json:"strict"`
+	Notes          *string    `json:"notes"`
+	RecurrenceRule *string    `json:"recurrenceRule"`
+	// WorkspaceID moves the task to another workspace, or back to the
+	// creator's personal tasks with 0
+	WorkspaceID *int `json:"workspaceId" binding:"omitempty,min=0"`
+	// AssigneeID assigns the task, or unassigns it with 0. Moving a task to
+	// another workspace unassigns it unless a new assignee is given.
+	AssigneeID *int `json:"assigneeId" binding:"omitempty,min=0"`
+	// EstimatedMinutes is how long the whole task should take, or 0 to
+	// clear the estimate
+	EstimatedMinutes *int `json:"estimatedMinutes" binding:"omitempty,min=0,max=1440"`
+}
+
+type BulkOperation struct {
+	Op    string             `json:"op" binding:"required,oneof=create update delete"`
+	ID    int                `json:"id"`
+	Task  *CreateTaskRequest `json:"task"`
+	Patch *UpdateTaskRequest `json:"patch"`
+}
+
+type BulkRequest struct {
+	Mode       string          `json:"mode" binding:"omitempty,oneof=atomic best_effort"`
+	Operations []BulkOperation `json:"operations" binding:"required,min=1,max=500"`
+}
+
+type BulkResult struct {
+	Index  int    `json:"index"`
+	Op     string `json:"op"`
+	ID     int    `json:"id,omitempty"`
+	Status string `json:"status"`
+	Task   *Task  `json:"task,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type BulkResponse struct {
+	Mode      string       `json:"mode"`
+	Committed bool         `json:"committed"`
+	Succeeded int          `json:"succeeded"`
+	Failed    int          `json:"failed"`
+	Results   []BulkResult `json:"results"`
 }
 
 type ReorganizeRequest struct {
 	Mood string `json:"mood" binding:"required,oneof=Happy Tired Stressed Focused Energetic"`
 }
+
+type TaskDependency struct {
+	TaskID      int       `json:"taskId" db:"task_id"`
+	DependsOnID int       `json:"dependsOnId" db:"depends_on_id"`
+	CreatedAt   time.Time `json:"createdAt" db:"created_at"`
+}
+
+type AddDependencyRequest struct {
+	DependsOnID int `json:"dependsOnId" binding:"required"`
+}
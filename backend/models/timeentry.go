@@ -0,0 +1,72 @@
+package models
+
+import "time"
+
+// Ways a time entry is recorded.
+const (
+	TimeEntryTimer  = "timer"
+	TimeEntryManual = "manual"
+)
+
+// TimeEntry is time a user spent on a task. A running timer has no EndedAt
+// and its duration counts up to now.
+type TimeEntry struct {
+	ID              int        `json:"id" db:"id"`
+	TaskID          int        `json:"taskId" db:"task_id"`
+	UserID          *int       `json:"userId" db:"user_id"`
+	Username        string     `json:"username" db:"-"`
+	StartedAt       time.Time  `json:"startedAt" db:"started_at"`
+	EndedAt         *time.Time `json:"endedAt,omitempty" db:"ended_at"`
+	DurationSeconds int        `json:"durationSeconds" db:"-"`
+	Running         bool       `json:"running" db:"-"`
+	Note            string     `json:"note" db:"note"`
+	Source          string     `json:"source" db:"source"`
+	CreatedAt       time.Time  `json:"createdAt" db:"created_at"`
+}
+
+type StartTimerRequest struct {
+	Note string `json:"note" binding:"max=1000"`
+}
+
+type CreateTimeEntryRequest struct {
+	StartedAt time.Time `json:"startedAt" binding:"required"`
+	EndedAt   time.Time `json:"endedAt" binding:"required"`
+	Note      string    `json:"note" binding:"max=1000"`
+}
+
+// TaskTime compares the time tracked on a task with its estimate.
+// TrackedMinutes counts the report's own entries within its window, while
+// TotalMinutes counts every entry on the task, by anyone, and is what the
+// estimate is compared with.
+type TaskTime struct {
+	TaskID           int      `json:"taskId"`
+	Title            string   `json:"title"`
+	Category         string   `json:"category"`
+	Status           string   `json:"status"`
+	TrackedMinutes   int      `json:"trackedMinutes"`
+	TotalMinutes     int      `json:"totalMinutes"`
+	EstimatedMinutes *int     `json:"estimatedMinutes,omitempty"`
+	EstimateRatio    *float64 `json:"estimateRatio,omitempty"`
+}
+
+// CategoryTime sums a category's tasks in a time report. The estimate
+// figures only cover completed tasks with an estimate: EstimateRatio is
+// their total tracked time over their estimates, so 1.5 means they took
+// half again as long as estimated.
+type CategoryTime struct {
+	Category         string   `json:"category"`
+	Tasks            int      `json:"tasks"`
+	TrackedMinutes   int      `json:"trackedMinutes"`
+	EstimatedTasks   int      `json:"estimatedTasks"`
+	EstimatedMinutes int      `json:"estimatedMinutes"`
+	ActualMinutes    int      `json:"actualMinutes"`
+	EstimateRatio    *float64 `json:"estimateRatio,omitempty"`
+}
+
+type TimeReport struct {
+	From           time.Time      `json:"from"`
+	To             time.Time      `json:"to"`
+	TrackedMinutes int            `json:"trackedMinutes"`
+	Tasks          []TaskTime     `json:"tasks"`
+	Categories     []CategoryTime `json:"categories"`
+}
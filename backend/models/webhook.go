@@ -0,0 +1,53 @@
+package models
+
+import "time"
+
+// Events a webhook can subscribe to.
+const (
+	WebhookTaskCreated      = "task.created"
+	WebhookTaskCompleted    = "task.completed"
+	WebhookMoodAnalyzed     = "mood.analyzed"
+	WebhookTasksReorganized = "tasks.reorganized"
+)
+
+type Webhook struct {
+	ID        int       `json:"id" db:"id"`
+	URL       string    `json:"url" db:"url"`
+	Events    []string  `json:"events" db:"events"`
+	Active    bool      `json:"active" db:"active"`
+	CreatedAt time.Time `json:"createdAt" db:"created_at"`
+	UpdatedAt time.Time `json:"updatedAt" db:"updated_at"`
+}
+
+type CreateWebhookRequest struct {
+	URL    string   `json:"url" binding:"required,url,max=2000"`
+	Events []string `json:"events" binding:"required,min=1,dive,oneof=task.created task.completed mood.analyzed tasks.reorganized"`
+}
+
+type UpdateWebhookRequest struct {
+	URL    *string  `json:"url" binding:"omitempty,url,max=2000"`
+	Events []string `json:"events" binding:"omitempty,min=1,dive,oneof=task.created task.completed mood.analyzed tasks.reorganized"`
+	Active *bool    `json:"active"`
+}
+
+// WebhookSecretResponse is the only response that contains the signing
+// secret, returned when a webhook is created or its secret is rotated.
+type WebhookSecretResponse struct {
+	Webhook
+	Secret string `json:"secret"`
+}
+
+// WebhookDelivery is one event queued for a webhook, with the outcome of
+// its latest attempt.
+type WebhookDelivery struct {
+	ID             int        `json:"id" db:"id"`
+	Event          string     `json:"event" db:"event"`
+	Status         string     `json:"status" db:"status"`
+	Attempts       int        `json:"attempts" db:"attempts"`
+	ResponseStatus *int       `json:"responseStatus,omitempty" db:"response_status"`
+	LastError      string     `json:"lastError,omitempty" db:"last_error"`
+	NextAttemptAt  *time.Time `json:"nextAttemptAt,omitempty" db:"next_attempt_at"`
+	LastAttemptAt  *time.Time `json:"lastAttemptAt,omitempty" db:"last_attempt_at"`
+	DeliveredAt    *time.Time `json:"deliveredAt,omitempty" db:"delivered_at"`
+	CreatedAt      time.Time  `json:"createdAt" db:"created_at"`
+}
@@ -0,0 +1,89 @@
+package models
+
+import "time"
+
+// Workspace roles. Owners manage the workspace and its members, editors
+// change its tasks and viewers only read them.
+const (
+	WorkspaceRoleOwner  = "owner"
+	WorkspaceRoleEditor = "editor"
+	WorkspaceRoleViewer = "viewer"
+)
+
+type Workspace struct {
+	ID        int               `json:"id" db:"id"`
+	Name      string            `json:"name" db:"name"`
+	Role      string            `json:"role" db:"-"`
+	Members   []WorkspaceMember `json:"members,omitempty" db:"-"`
+	CreatedAt time.Time         `json:"createdAt" db:"created_at"`
+	UpdatedAt time.Time         `json:"updatedAt" db:"updated_at"`
+}
+
+type WorkspaceMember struct {
+	UserID    int       `json:"userId" db:"user_id"`
+	Username  string    `json:"username" db:"username"`
+	Role      string    `json:"role" db:"role"`
+	ShareMood bool      `json:"shareMood" db:"share_mood"`
+	CreatedAt time.Time `json:"createdAt" db:"created_at"`
+}
+
+type WorkspaceRequest struct {
+	Name string `json:"name" binding:"required,max=100"`
+}
+
+// AddWorkspaceMemberRequest adds an existing user, found by email or
+// username, to a workspace.
+type AddWorkspaceMemberRequest struct {
+	Email    string `json:"email" binding:"required_without=Username,omitempty,email"`
+	Username string `json:"username" binding:"required_without=Email"`
+	Role     string `json:"role" binding:"required,oneof=owner editor viewer"`
+}
+
+type UpdateWorkspaceMemberRequest struct {
+	Role string `json:"role" binding:"required,oneof=owner editor viewer"`
+}
+
+type MoodSharingRequest struct {
+	ShareMood *bool `json:"shareMood" binding:"required"`
+}
+
+// WorkloadResponse summarizes the open tasks of a workspace per assignee.
+type WorkloadResponse struct {
+	WorkspaceID int              `json:"workspaceId"`
+	MoodDays    int              `json:"moodDays,omitempty"`
+	Members     []MemberWorkload `json:"members"`
+	Unassigned  Workload         `json:"unassigned"`
+}
+
+// Workload sums open tasks. Load weighs each task by its priority (Low 1,
+// Medium 2, High 3) times its importance.
+type Workload struct {
+	OpenTasks   int            `json:"openTasks"`
+	Load        int            `json:"load"`
+	Overdue     int            `json:"overdue"`
+	DueThisWeek int            `json:"dueThisWeek"`
+	Upcoming    []UpcomingTask `json:"upcoming"`
+}
+
+type MemberWorkload struct {
+	UserID   int    `json:"userId"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+	Workload
+	// RelativeLoad compares the member's load with the average of the
+	// members who can be assigned tasks
+	RelativeLoad float64 `json:"relativeLoad"`
+	// ShareMood tells whether the member shares their mood with owners;
+	// DominantMood and MoodLogs are only set if they do
+	ShareMood    bool   `json:"shareMood"`
+	DominantMood string `json:"dominantMood,omitempty"`
+	MoodLogs     int    `json:"moodLogs,omitempty"`
+	Overloaded   bool   `json:"overloaded"`
+}
+
+type UpcomingTask struct {
+	ID       int       `json:"id"`
+	Title    string    `json:"title"`
+	Priority string    `json:"priority"`
+	DueDate  time.Time `json:"dueDate"`
+}
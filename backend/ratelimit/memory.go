@@ -0,0 +1,111 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often idle buckets and stale lockouts are dropped.
+const sweepInterval = 10 * time.Minute
+
+type memoryBucket struct {
+	tokens  float64
+	updated time.Time
+	idle    time.Duration
+}
+
+// Memory keeps limiter state in process. Limits are per instance.
+type Memory struct {
+	mu        sync.Mutex
+	buckets   map[string]*memoryBucket
+	locks     map[string]*memoryLock
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type memoryLock struct {
+	lockState
+	window time.Duration
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		buckets:   make(map[string]*memoryBucket),
+		locks:     make(map[string]*memoryLock),
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}
+}
+
+func (m *Memory) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.sweep(now)
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &memoryBucket{tokens: float64(limit.Burst), updated: now}
+		m.buckets[key] = b
+	}
+
+	var result Result
+	b.tokens, result = limit.take(b.tokens, now.Sub(b.updated))
+	b.updated = now
+	b.idle = limit.idle()
+	return result, nil
+}
+
+func (m *Memory) LockedFor(ctx context.Context, key string) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if l, ok := m.locks[key]; ok {
+		return remaining(l.lockedUntil, m.now()), nil
+	}
+	return 0, nil
+}
+
+func (m *Memory) RecordFailure(ctx context.Context, key string, policy LockoutPolicy) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	l, ok := m.locks[key]
+	if !ok {
+		l = &memoryLock{}
+		m.locks[key] = l
+	}
+	l.lockState = policy.fail(l.lockState, now)
+	l.window = policy.Window
+	return remaining(l.lockedUntil, now), nil
+}
+
+func (m *Memory) Reset(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.locks, key)
+	return nil
+}
+
+// sweep drops state that no longer affects any decision. Callers hold m.mu.
+func (m *Memory) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < sweepInterval {
+		return
+	}
+	m.lastSweep = now
+
+	for key, b := range m.buckets {
+		if now.Sub(b.updated) > b.idle {
+			delete(m.buckets, key)
+		}
+	}
+	for key, l := range m.locks {
+		if now.Sub(l.lastFailure) > l.window && now.After(l.lockedUntil) {
+			delete(m.locks, key)
+		}
+	}
+}
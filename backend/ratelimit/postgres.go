@@ -0,0 +1,145 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// staleAfter is how long untouched rows are kept. It is longer than any
+// bucket refill, lockout or failure window in use.
+const staleAfter = 24 * time.Hour
+
+// Postgres keeps limiter state in the rate_limit_buckets and
+// rate_limit_lockouts tables so all instances share the same limits.
+type Postgres struct {
+	db *sql.DB
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+func NewPostgres(db *sql.DB) *Postgres {
+	return &Postgres{db: db, lastSweep: time.Now()}
+}
+
+func (p *Postgres) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	p.sweep(ctx)
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Result{}, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO rate_limit_buckets (key, tokens, updated_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (key) DO NOTHING`, key, float64(limit.Burst), now)
+	if err != nil {
+		return Result{}, err
+	}
+
+	var tokens float64
+	var updated time.Time
+	err = tx.QueryRowContext(ctx, `
+		SELECT tokens, updated_at FROM rate_limit_buckets
+		WHERE key = $1 FOR UPDATE`, key).Scan(&tokens, &updated)
+	if err != nil {
+		return Result{}, err
+	}
+
+	elapsed := now.Sub(updated)
+	if elapsed < 0 {
+		elapsed = 0 // another instance's clock is ahead
+	}
+	tokens, result := limit.take(tokens, elapsed)
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE rate_limit_buckets SET tokens = $1, updated_at = $2
+		WHERE key = $3`, tokens, now, key)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return result, tx.Commit()
+}
+
+func (p *Postgres) LockedFor(ctx context.Context, key string) (time.Duration, error) {
+	var lockedUntil sql.NullTime
+	err := p.db.QueryRowContext(ctx,
+		"SELECT locked_until FROM rate_limit_lockouts WHERE key = $1", key).Scan(&lockedUntil)
+	if err == sql.ErrNoRows || (err == nil && !lockedUntil.Valid) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return remaining(lockedUntil.Time, time.Now()), nil
+}
+
+func (p *Postgres) RecordFailure(ctx context.Context, key string, policy LockoutPolicy) (time.Duration, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO rate_limit_lockouts (key, failures)
+		VALUES ($1, 0)
+		ON CONFLICT (key) DO NOTHING`, key)
+	if err != nil {
+		return 0, err
+	}
+
+	var state lockState
+	var lastFailure, lockedUntil sql.NullTime
+	err = tx.QueryRowContext(ctx, `
+		SELECT failures, last_failure_at, locked_until FROM rate_limit_lockouts
+		WHERE key = $1 FOR UPDATE`, key).Scan(&state.failures, &lastFailure, &lockedUntil)
+	if err != nil {
+		return 0, err
+	}
+	state.lastFailure = lastFailure.Time
+	state.lockedUntil = lockedUntil.Time
+
+	now := time.Now()
+	state = policy.fail(state, now)
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE rate_limit_lockouts
+		SET failures = $1, last_failure_at = $2, locked_until = $3
+		WHERE key = $4`,
+		state.failures, state.lastFailure, sql.NullTime{Time: state.lockedUntil, Valid: !state.lockedUntil.IsZero()}, key)
+	if err != nil {
+		return 0, err
+	}
+
+	return remaining(state.lockedUntil, now), tx.Commit()
+}
+
+func (p *Postgres) Reset(ctx context.Context, key string) error {
+	_, err := p.db.ExecContext(ctx, "DELETE FROM rate_limit_lockouts WHERE key = $1", key)
+	return err
+}
+
+// sweep deletes stale rows every sweepInterval. Errors are ignored; the next
+// sweep tries again.
+func (p *Postgres) sweep(ctx context.Context) {
+	p.mu.Lock()
+	if time.Since(p.lastSweep) < sweepInterval {
+		p.mu.Unlock()
+		return
+	}
+	p.lastSweep = time.Now()
+	p.mu.Unlock()
+
+	cutoff := time.Now().Add(-staleAfter)
+	p.db.ExecContext(ctx, "DELETE FROM rate_limit_buckets WHERE updated_at < $1", cutoff)
+	p.db.ExecContext(ctx, `
+		DELETE FROM rate_limit_lockouts
+		WHERE last_failure_at < $1 AND (locked_until IS NULL OR locked_until < NOW())`, cutoff)
+}
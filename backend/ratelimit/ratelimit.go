@@ -0,0 +1,125 @@
+// Package ratelimit provides token-bucket rate limiting and exponential
+// lockouts after repeated failures, backed by memory or Postgres.
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Limit is a token bucket: up to Burst requests at once, refilled at Rate
+// tokens per second.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Every returns a limit that allows burst requests at once and one more per
+// interval.
+func Every(interval time.Duration, burst int) Limit {
+	return Limit{Rate: 1 / interval.Seconds(), Burst: burst}
+}
+
+// LockoutPolicy locks a key out once it reaches Threshold consecutive
+// failures. The lock starts at Base and doubles with every further failure up
+// to Max. Failures are forgotten after Window without a new one.
+type LockoutPolicy struct {
+	Threshold int
+	Base      time.Duration
+	Max       time.Duration
+	Window    time.Duration
+}
+
+// Result is the outcome of taking a token.
+type Result struct {
+	Allowed    bool
+	RetryAfter time.Duration
+}
+
+// Limiter stores buckets and failure counts. Keys are namespaced by the
+// caller, e.g. "login:ip:10.0.0.1".
+type Limiter interface {
+	// Allow takes a token from the key's bucket.
+	Allow(ctx context.Context, key string, limit Limit) (Result, error)
+	// LockedFor returns how long the key is still locked out.
+	LockedFor(ctx context.Context, key string) (time.Duration, error)
+	// RecordFailure counts a failure and returns the lockout it caused, if any.
+	RecordFailure(ctx context.Context, key string, policy LockoutPolicy) (time.Duration, error)
+	// Reset forgets the key's failures and lockout.
+	Reset(ctx context.Context, key string) error
+}
+
+// FromEnv returns the limiter selected by RATE_LIMIT_STORE: memory (default)
+// for a single instance, or postgres to share limits between instances.
+func FromEnv(db *sql.DB) (Limiter, error) {
+	switch store := os.Getenv("RATE_LIMIT_STORE"); store {
+	case "", "memory":
+		return NewMemory(), nil
+	case "postgres":
+		return NewPostgres(db), nil
+	default:
+		return nil, fmt.Errorf("unknown RATE_LIMIT_STORE %q", store)
+	}
+}
+
+// take refills a bucket holding tokens after elapsed time and tries to take
+// one token. It returns the new token count.
+func (l Limit) take(tokens float64, elapsed time.Duration) (float64, Result) {
+	tokens = math.Min(float64(l.Burst), tokens+elapsed.Seconds()*l.Rate)
+	if tokens >= 1 {
+		return tokens - 1, Result{Allowed: true}
+	}
+	wait := time.Duration((1 - tokens) / l.Rate * float64(time.Second))
+	return tokens, Result{RetryAfter: wait}
+}
+
+// idle reports how long a bucket takes to fill up completely, after which its
+// state can be dropped.
+func (l Limit) idle() time.Duration {
+	return time.Duration(float64(l.Burst) / l.Rate * float64(time.Second))
+}
+
+type lockState struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// fail records a failure at now.
+func (p LockoutPolicy) fail(s lockState, now time.Time) lockState {
+	if now.Sub(s.lastFailure) > p.Window {
+		s.failures = 0
+	}
+	s.failures++
+	s.lastFailure = now
+
+	if s.failures >= p.Threshold {
+		lock := p.Max
+		if exp := s.failures - p.Threshold; exp < 30 {
+			lock = p.Base << exp
+		}
+		if lock > p.Max {
+			lock = p.Max
+		}
+		s.lockedUntil = now.Add(lock)
+	}
+	return s
+}
+
+func remaining(lockedUntil, now time.Time) time.Duration {
+	if d := lockedUntil.Sub(now); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// RetryAfter formats a wait as the value of a Retry-After header: whole
+// seconds, rounded up.
+func RetryAfter(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
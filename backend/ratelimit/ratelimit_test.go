@@ -0,0 +1,217 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// clock is a settable time source for the memory store.
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time          { return c.t }
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestMemory() (*Memory, *clock) {
+	c := &clock{t: time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)}
+	m := NewMemory()
+	m.now = c.now
+	m.lastSweep = c.t
+	return m, c
+}
+
+func TestAllow(t *testing.T) {
+	limit := Every(8*time.Second, 3)
+
+	type step struct {
+		after      time.Duration // time since the previous request
+		allowed    bool
+		retryAfter time.Duration
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "burst then refused",
+			steps: []step{
+				{0, true, 0}, {0, true, 0}, {0, true, 0},
+				{0, false, 8 * time.Second},
+			},
+		},
+		{
+			name: "refills one token per interval",
+			steps: []step{
+				{0, true, 0}, {0, true, 0}, {0, true, 0},
+				{2 * time.Second, false, 6 * time.Second},
+				{6 * time.Second, true, 0},
+				{0, false, 8 * time.Second},
+			},
+		},
+		{
+			name: "refill stops at the burst",
+			steps: []step{
+				{0, true, 0},
+				{time.Hour, true, 0}, {0, true, 0}, {0, true, 0},
+				{0, false, 8 * time.Second},
+			},
+		},
+		{
+			name: "refused requests don't take tokens",
+			steps: []step{
+				{0, true, 0}, {0, true, 0}, {0, true, 0},
+				{0, false, 8 * time.Second},
+				{0, false, 8 * time.Second},
+				{8 * time.Second, true, 0},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, c := newTestMemory()
+			for i, s := range tt.steps {
+				c.advance(s.after)
+				result, err := m.Allow(context.Background(), "key", limit)
+				if err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+				if result.Allowed != s.allowed || result.RetryAfter != s.retryAfter {
+					t.Errorf("step %d: Allow = %+v, want allowed %v, retry after %v", i, result, s.allowed, s.retryAfter)
+				}
+			}
+		})
+	}
+}
+
+func TestAllowKeepsKeysApart(t *testing.T) {
+	m, _ := newTestMemory()
+	limit := Every(time.Minute, 1)
+
+	if result, _ := m.Allow(context.Background(), "login:ip:10.0.0.1", limit); !result.Allowed {
+		t.Fatal("first request refused")
+	}
+	if result, _ := m.Allow(context.Background(), "login:ip:10.0.0.2", limit); !result.Allowed {
+		t.Error("another key's request refused")
+	}
+	if result, _ := m.Allow(context.Background(), "login:ip:10.0.0.1", limit); result.Allowed {
+		t.Error("second request for the same key allowed")
+	}
+}
+
+func TestLockout(t *testing.T) {
+	policy := LockoutPolicy{Threshold: 3, Base: time.Minute, Max: 5 * time.Minute, Window: time.Hour}
+
+	type step struct {
+		after  time.Duration // time since the previous failure
+		locked time.Duration // lockout returned by RecordFailure
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name:  "no lock below the threshold",
+			steps: []step{{0, 0}, {0, 0}},
+		},
+		{
+			name: "lock doubles with each failure up to the maximum",
+			steps: []step{
+				{0, 0}, {0, 0},
+				{0, time.Minute},
+				{0, 2 * time.Minute},
+				{0, 4 * time.Minute},
+				{0, 5 * time.Minute},
+				{0, 5 * time.Minute},
+			},
+		},
+		{
+			name: "failures are forgotten after the window",
+			steps: []step{
+				{0, 0}, {0, 0},
+				{time.Hour + time.Second, 0},
+				{0, 0},
+				{0, time.Minute},
+			},
+		},
+		{
+			name: "failures within the window keep counting",
+			steps: []step{
+				{0, 0},
+				{59 * time.Minute, 0},
+				{59 * time.Minute, time.Minute},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, c := newTestMemory()
+			for i, s := range tt.steps {
+				c.advance(s.after)
+				locked, err := m.RecordFailure(context.Background(), "key", policy)
+				if err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+				if locked != s.locked {
+					t.Errorf("step %d: RecordFailure = %v, want %v", i, locked, s.locked)
+				}
+				if got, _ := m.LockedFor(context.Background(), "key"); got != s.locked {
+					t.Errorf("step %d: LockedFor = %v, want %v", i, got, s.locked)
+				}
+			}
+		})
+	}
+}
+
+func TestLockoutExpiresAndResets(t *testing.T) {
+	policy := LockoutPolicy{Threshold: 2, Base: time.Minute, Max: time.Hour, Window: time.Hour}
+	ctx := context.Background()
+	m, c := newTestMemory()
+
+	m.RecordFailure(ctx, "key", policy)
+	m.RecordFailure(ctx, "key", policy)
+	c.advance(40 * time.Second)
+	if got, _ := m.LockedFor(ctx, "key"); got != 20*time.Second {
+		t.Errorf("LockedFor = %v, want 20s", got)
+	}
+	c.advance(20 * time.Second)
+	if got, _ := m.LockedFor(ctx, "key"); got != 0 {
+		t.Errorf("LockedFor after the lock = %v, want 0", got)
+	}
+
+	// The failures still count until Reset, so the next lock is longer
+	if got, _ := m.RecordFailure(ctx, "key", policy); got != 2*time.Minute {
+		t.Errorf("RecordFailure = %v, want 2m", got)
+	}
+	if err := m.Reset(ctx, "key"); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+	if got, _ := m.LockedFor(ctx, "key"); got != 0 {
+		t.Errorf("LockedFor after Reset = %v, want 0", got)
+	}
+	if got, _ := m.RecordFailure(ctx, "key", policy); got != 0 {
+		t.Errorf("RecordFailure after Reset = %v, want no lock", got)
+	}
+}
+
+func TestSweepDropsIdleState(t *testing.T) {
+	ctx := context.Background()
+	m, c := newTestMemory()
+	policy := LockoutPolicy{Threshold: 1, Base: time.Minute, Max: time.Minute, Window: time.Minute}
+
+	m.Allow(ctx, "idle", Every(time.Second, 2))
+	m.RecordFailure(ctx, "failed", policy)
+	c.advance(sweepInterval)
+	m.Allow(ctx, "active", Every(time.Second, 2))
+
+	if _, ok := m.buckets["idle"]; ok {
+		t.Error("idle bucket kept")
+	}
+	if _, ok := m.locks["failed"]; ok {
+		t.Error("expired lockout kept")
+	}
+	if _, ok := m.buckets["active"]; !ok {
+		t.Error("active bucket dropped")
+	}
+}
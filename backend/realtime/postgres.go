@@ -0,0 +1,97 @@
+package realtime
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	notifyChannel = "mmtm_events"
+	// maxNotifyPayload stays under Postgres' 8000 byte NOTIFY payload limit
+	maxNotifyPayload = 7900
+)
+
+// PostgresBroker relays messages through Postgres LISTEN/NOTIFY. Every
+// replica listens on the same channel, loads the data of what it hears and
+// hands it to its own hub, including the messages it published itself.
+type PostgresBroker struct {
+	hub      *Hub
+	db       *sql.DB
+	listener *pq.Listener
+	load     Loader
+}
+
+// NewPostgresBroker publishes on db and listens on a connection of its own
+// to connStr. load reads the data of the messages it hears.
+func NewPostgresBroker(db *sql.DB, connStr string, load Loader) (*PostgresBroker, error) {
+	listener := pq.NewListener(connStr, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Realtime listener: %v", err)
+		}
+	})
+	if err := listener.Listen(notifyChannel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	b := &PostgresBroker{hub: NewHub(), db: db, listener: listener, load: load}
+	go b.relay()
+	return b, nil
+}
+
+func (b *PostgresBroker) relay() {
+	for n := range b.listener.Notify {
+		// A nil notification means the connection was re-established and
+		// messages sent meanwhile are lost
+		if n == nil {
+			continue
+		}
+		var msg Message
+		if err := json.Unmarshal([]byte(n.Extra), &msg); err != nil {
+			log.Printf("Realtime listener: invalid message: %v", err)
+			continue
+		}
+		if !msg.Truncated {
+			if err := b.load(&msg); err != nil {
+				log.Printf("Realtime listener: loading %s: %v", msg.Type, err)
+				continue
+			}
+			if msg.Data == nil {
+				continue
+			}
+		}
+		b.hub.Publish(msg)
+	}
+}
+
+// Publish sends the type and IDs of msg to every replica, never its data.
+// Messages with too many IDs for a notification are sent without them.
+func (b *PostgresBroker) Publish(msg Message) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxNotifyPayload {
+		msg.IDs = nil
+		msg.Truncated = true
+		if payload, err = json.Marshal(msg); err != nil {
+			return err
+		}
+	}
+	_, err = b.db.Exec("SELECT pg_notify($1, $2)", notifyChannel, string(payload))
+	return err
+}
+
+func (b *PostgresBroker) Subscribe(userID int) *Subscription {
+	return b.hub.Subscribe(userID)
+}
+
+func (b *PostgresBroker) Close() error {
+	err := b.listener.Close()
+	b.hub.Close()
+	return err
+}
@@ -0,0 +1,149 @@
+// Package realtime pushes messages to the users connected to the event
+// stream. A Hub fans messages out to the connections of one process; the
+// Postgres broker relays them between processes so every replica reaches
+// its own connections.
+package realtime
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// subscriberBuffer is how many messages a connection may fall behind before
+// it is dropped. Clients reconnect and refetch, which beats a stalled hub.
+const subscriberBuffer = 64
+
+// Message is delivered to the connections of the users in UserIDs. Data
+// never leaves the process: other processes get the type and IDs and read
+// the data again with a Loader, so task contents don't pass through the
+// database in the clear.
+type Message struct {
+	UserIDs []int  `json:"userIds"`
+	Type    string `json:"type"`
+	// IDs are the records the message is about, in order
+	IDs []int `json:"ids,omitempty"`
+	// Mood is the mood of a reorganize
+	Mood string          `json:"mood,omitempty"`
+	Data json.RawMessage `json:"-"`
+	// Truncated messages had too many IDs to relay and lost their data;
+	// clients refetch instead
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// Loader reads the data of a message relayed from another process into
+// msg.Data and may narrow msg.UserIDs to the users who can still see it. A
+// message it leaves without data is about records that are gone, and is
+// dropped.
+type Loader func(msg *Message) error
+
+// Broker delivers published messages to the subscriptions of their users,
+// wherever they are connected.
+type Broker interface {
+	Publish(msg Message) error
+	Subscribe(userID int) *Subscription
+	Close() error
+}
+
+// FromEnv builds the broker selected by REALTIME_BROKER: "postgres" (the
+// default) relays through Postgres LISTEN/NOTIFY so several replicas can
+// serve the stream, "memory" keeps messages in this process. load reads the
+// data of relayed messages.
+func FromEnv(db *sql.DB, connStr string, load Loader) (Broker, error) {
+	switch kind := os.Getenv("REALTIME_BROKER"); kind {
+	case "", "postgres":
+		return NewPostgresBroker(db, connStr, load)
+	case "memory":
+		return NewHub(), nil
+	default:
+		return nil, fmt.Errorf("unknown REALTIME_BROKER %q", kind)
+	}
+}
+
+// Subscription receives the messages of one user. C is closed when the
+// subscription is closed or dropped for falling behind.
+type Subscription struct {
+	C <-chan Message
+
+	ch     chan Message
+	hub    *Hub
+	userID int
+}
+
+// Close stops the subscription. It is safe to call more than once.
+func (s *Subscription) Close() {
+	s.hub.remove(s)
+}
+
+// Hub is the in-process broker.
+type Hub struct {
+	mu   sync.Mutex
+	subs map[int]map[*Subscription]struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{subs: make(map[int]map[*Subscription]struct{})}
+}
+
+// Publish delivers msg to the local subscriptions of its users without
+// blocking.
+func (h *Hub) Publish(msg Message) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, userID := range msg.UserIDs {
+		for sub := range h.subs[userID] {
+			select {
+			case sub.ch <- msg:
+			default:
+				h.removeLocked(sub)
+			}
+		}
+	}
+	return nil
+}
+
+func (h *Hub) Subscribe(userID int) *Subscription {
+	ch := make(chan Message, subscriberBuffer)
+	sub := &Subscription{C: ch, ch: ch, hub: h, userID: userID}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[userID] == nil {
+		h.subs[userID] = make(map[*Subscription]struct{})
+	}
+	h.subs[userID][sub] = struct{}{}
+	return sub
+}
+
+// Close drops every subscription.
+func (h *Hub) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, subs := range h.subs {
+		for sub := range subs {
+			h.removeLocked(sub)
+		}
+	}
+	return nil
+}
+
+func (h *Hub) remove(sub *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.removeLocked(sub)
+}
+
+func (h *Hub) removeLocked(sub *Subscription) {
+	subs := h.subs[sub.userID]
+	if _, ok := subs[sub]; !ok {
+		return
+	}
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(h.subs, sub.userID)
+	}
+	close(sub.ch)
+}
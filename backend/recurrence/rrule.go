@@ -0,0 +1,281 @@
+package recurrence
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rule is the subset of an RFC 5545 RRULE that tasks support:
+// FREQ=DAILY|WEEKLY|MONTHLY with INTERVAL, BYDAY (weekly only), COUNT and UNTIL.
+type Rule struct {
+	Freq     string
+	Interval int
+	ByDay    []time.Weekday
+	Count    int
+	Until    time.Time
+}
+
+var weekdays = map[string]time.Weekday{
+	"MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday, "TH": time.Thursday,
+	"FR": time.Friday, "SA": time.Saturday, "SU": time.Sunday,
+}
+
+var weekdayNames = map[time.Weekday]string{
+	time.Monday: "MO", time.Tuesday: "TU", time.Wednesday: "WE", time.Thursday: "TH",
+	time.Friday: "FR", time.Saturday: "SA", time.Sunday: "SU",
+}
+
+// Parse parses an RRULE value such as "FREQ=WEEKLY;BYDAY=MO,WE;COUNT=10".
+// A leading "RRULE:" is accepted.
+func Parse(value string) (*Rule, error) {
+	value = strings.TrimSpace(value)
+	value = strings.TrimPrefix(strings.ToUpper(value), "RRULE:")
+	if value == "" {
+		return nil, fmt.Errorf("empty recurrence rule")
+	}
+
+	rule := &Rule{Interval: 1}
+	for _, part := range strings.Split(value, ";") {
+		key, val, ok := strings.Cut(part, "=")
+		if !ok || val == "" {
+			return nil, fmt.Errorf("invalid rule part %q", part)
+		}
+
+		switch key {
+		case "FREQ":
+			if val != "DAILY" && val != "WEEKLY" && val != "MONTHLY" {
+				return nil, fmt.Errorf("unsupported FREQ %q", val)
+			}
+			rule.Freq = val
+		case "INTERVAL":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid INTERVAL %q", val)
+			}
+			rule.Interval = n
+		case "BYDAY":
+			for _, day := range strings.Split(val, ",") {
+				wd, ok := weekdays[day]
+				if !ok {
+					return nil, fmt.Errorf("unsupported BYDAY value %q", day)
+				}
+				rule.ByDay = append(rule.ByDay, wd)
+			}
+		case "COUNT":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid COUNT %q", val)
+			}
+			rule.Count = n
+		case "UNTIL":
+			until, err := parseUntil(val)
+			if err != nil {
+				return nil, fmt.Errorf("invalid UNTIL %q", val)
+			}
+			rule.Until = until
+		default:
+			return nil, fmt.Errorf("unsupported rule part %q", key)
+		}
+	}
+
+	if rule.Freq == "" {
+		return nil, fmt.Errorf("FREQ is required")
+	}
+	if len(rule.ByDay) > 0 && rule.Freq != "WEEKLY" {
+		return nil, fmt.Errorf("BYDAY is only supported with FREQ=WEEKLY")
+	}
+	if rule.Count > 0 && !rule.Until.IsZero() {
+		return nil, fmt.Errorf("COUNT and UNTIL cannot both be set")
+	}
+
+	sort.Slice(rule.ByDay, func(i, j int) bool {
+		return mondayIndex(rule.ByDay[i]) < mondayIndex(rule.ByDay[j])
+	})
+
+	return rule, nil
+}
+
+func parseUntil(val string) (time.Time, error) {
+	if t, err := time.Parse("20060102T150405Z", val); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("20060102T150405", val); err == nil {
+		return t, nil
+	}
+	// A date-only UNTIL includes the whole day
+	t, err := time.Parse("20060102", val)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.Add(24*time.Hour - time.Second), nil
+}
+
+// String returns the normalized RRULE value.
+func (r *Rule) String() string {
+	parts := []string{"FREQ=" + r.Freq}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if len(r.ByDay) > 0 {
+		days := make([]string, len(r.ByDay))
+		for i, wd := range r.ByDay {
+			days[i] = weekdayNames[wd]
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	if !r.Until.IsZero() {
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format("20060102T150405Z"))
+	}
+	return strings.Join(parts, ";")
+}
+
+// Next returns the occurrence following prev, where prev is occurrence number
+// n of the series (1 for the first). It returns false once COUNT or UNTIL
+// ends the series.
+func (r *Rule) Next(prev time.Time, n int) (time.Time, bool) {
+	if r.Count > 0 && n >= r.Count {
+		return time.Time{}, false
+	}
+
+	var next time.Time
+	switch r.Freq {
+	case "DAILY":
+		next = prev.AddDate(0, 0, r.Interval)
+	case "WEEKLY":
+		next = r.nextWeekly(prev)
+	case "MONTHLY":
+		// Months without the day (e.g. the 31st) are skipped, as in RFC 5545
+		for i := 1; ; i++ {
+			next = prev.AddDate(0, i*r.Interval, 0)
+			if next.Day() == prev.Day() {
+				break
+			}
+		}
+	}
+
+	if !r.Until.IsZero() && next.After(r.Until) {
+		return time.Time{}, false
+	}
+	return next, true
+}
+
+func (r *Rule) nextWeekly(prev time.Time) time.Time {
+	if len(r.ByDay) == 0 {
+		return prev.AddDate(0, 0, 7*r.Interval)
+	}
+
+	// Later matching day in the same week
+	current := mondayIndex(prev.Weekday())
+	for _, wd := range r.ByDay {
+		if idx := mondayIndex(wd); idx > current {
+			return prev.AddDate(0, 0, idx-current)
+		}
+	}
+
+	// Otherwise the first matching day of the next week in the interval
+	weekStart := prev.AddDate(0, 0, -current)
+	return weekStart.AddDate(0, 0, 7*r.Interval+mondayIndex(r.ByDay[0]))
+}
+
+// Occurrence is one instance of a series, numbered from 1.
+type Occurrence struct {
+	Number int
+	Due    time.Time
+}
+
+// Between returns the occurrences after start (occurrence number n) that fall
+// within [from, to], capped at limit results. Occurrences before from are
+// skipped in whole periods rather than one at a time.
+func (r *Rule) Between(start time.Time, n int, from, to time.Time, limit int) []Occurrence {
+	current, n, ok := r.skipBefore(start, n, from)
+	if !ok {
+		return nil
+	}
+
+	var occurrences []Occurrence
+	for len(occurrences) < limit {
+		next, ok := r.Next(current, n)
+		if !ok || next.After(to) {
+			break
+		}
+		n++
+		if !next.Before(from) {
+			occurrences = append(occurrences, Occurrence{Number: n, Due: next})
+		}
+		current = next
+	}
+	return occurrences
+}
+
+// skipBefore advances from prev, occurrence number n, over whole periods of
+// the rule that end before from. It returns the time to continue the series
+// from with the number of occurrences up to it, or false if the series ends
+// before from. The time is an occurrence, or for BYDAY rules a day in an
+// occurrence's week, which Next continues from the same way.
+func (r *Rule) skipBefore(prev time.Time, n int, from time.Time) (time.Time, int, bool) {
+	from = from.In(prev.Location())
+	switch r.Freq {
+	case "DAILY", "WEEKLY":
+		days, perPeriod := r.Interval, 1
+		if r.Freq == "WEEKLY" {
+			days *= 7
+			if len(r.ByDay) > 0 {
+				perPeriod = len(r.ByDay)
+			}
+		}
+		// Stop at least a day short of from, so no skipped occurrence is in the window
+		periods := (daysBetween(prev, from) - 1) / days
+		if periods <= 0 {
+			return prev, n, true
+		}
+		prev, n = prev.AddDate(0, 0, periods*days), n+periods*perPeriod
+	case "MONTHLY":
+		months := from.Year()*12 + int(from.Month()) - (prev.Year()*12 + int(prev.Month()))
+		steps := (months - 1) / r.Interval
+		// Continue from the last skipped month that has the day, counting
+		// the months that do
+		last, skipped := steps, steps
+		if prev.Day() > 28 {
+			last, skipped = 0, 0
+			for i := 1; i <= steps; i++ {
+				if daysIn(prev.Year(), prev.Month()+time.Month(i*r.Interval)) >= prev.Day() {
+					last, skipped = i, skipped+1
+				}
+			}
+		}
+		if last <= 0 {
+			return prev, n, true
+		}
+		prev, n = prev.AddDate(0, last*r.Interval, 0), n+skipped
+	}
+
+	if r.Count > 0 && n >= r.Count {
+		return time.Time{}, 0, false
+	}
+	return prev, n, true
+}
+
+// daysBetween counts the calendar days from a to b.
+func daysBetween(a, b time.Time) int {
+	start := time.Date(a.Year(), a.Month(), a.Day(), 0, 0, 0, 0, time.UTC)
+	end := time.Date(b.Year(), b.Month(), b.Day(), 0, 0, 0, 0, time.UTC)
+	return int((end.Unix() - start.Unix()) / (24 * 60 * 60))
+}
+
+// daysIn returns the number of days in month of year. Months past December
+// roll over into the following years.
+func daysIn(year int, month time.Month) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+// mondayIndex numbers weekdays from Monday (0) to Sunday (6), matching the
+// RFC 5545 default week start.
+func mondayIndex(wd time.Weekday) int {
+	return (int(wd) + 6) % 7
+}
@@ -0,0 +1,300 @@
+package recurrence
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 9, 0, 0, 0, time.UTC)
+}
+
+// series returns the first count dates of rule starting at start, stopping
+// early if the series ends.
+func series(t *testing.T, rule string, start time.Time, count int) []time.Time {
+	t.Helper()
+	r, err := Parse(rule)
+	if err != nil {
+		t.Fatalf("Parse(%q): %v", rule, err)
+	}
+	dates := []time.Time{start}
+	for n := 1; len(dates) < count; n++ {
+		next, ok := r.Next(dates[len(dates)-1], n)
+		if !ok {
+			break
+		}
+		dates = append(dates, next)
+	}
+	return dates
+}
+
+func TestNext(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  string
+		start time.Time
+		want  []time.Time
+		// ends is set when the series has no more dates than want
+		ends bool
+	}{
+		{
+			name:  "daily with interval",
+			rule:  "FREQ=DAILY;INTERVAL=3",
+			start: date(2024, time.February, 27),
+			want:  []time.Time{date(2024, time.February, 27), date(2024, time.March, 1), date(2024, time.March, 4)},
+		},
+		{
+			name:  "weekly with interval",
+			rule:  "FREQ=WEEKLY;INTERVAL=2",
+			start: date(2024, time.March, 5),
+			want:  []time.Time{date(2024, time.March, 5), date(2024, time.March, 19), date(2024, time.April, 2)},
+		},
+		{
+			name:  "weekly by day",
+			rule:  "FREQ=WEEKLY;BYDAY=FR,MO,WE",
+			start: date(2024, time.March, 6), // Wednesday
+			want: []time.Time{
+				date(2024, time.March, 6), date(2024, time.March, 8),
+				date(2024, time.March, 11), date(2024, time.March, 13),
+			},
+		},
+		{
+			name:  "weekly by day starting off the listed days",
+			rule:  "FREQ=WEEKLY;BYDAY=TU,TH",
+			start: date(2024, time.March, 9), // Saturday
+			want:  []time.Time{date(2024, time.March, 9), date(2024, time.March, 12), date(2024, time.March, 14)},
+		},
+		{
+			name:  "weekly by day with interval",
+			rule:  "FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,TH",
+			start: date(2024, time.March, 4), // Monday
+			want: []time.Time{
+				date(2024, time.March, 4), date(2024, time.March, 7),
+				date(2024, time.March, 18), date(2024, time.March, 21),
+			},
+		},
+		{
+			name:  "monthly on the 31st skips shorter months",
+			rule:  "FREQ=MONTHLY",
+			start: date(2024, time.January, 31),
+			want: []time.Time{
+				date(2024, time.January, 31), date(2024, time.March, 31),
+				date(2024, time.May, 31), date(2024, time.July, 31),
+			},
+		},
+		{
+			name:  "monthly on the 30th skips February",
+			rule:  "FREQ=MONTHLY",
+			start: date(2023, time.January, 30),
+			want:  []time.Time{date(2023, time.January, 30), date(2023, time.March, 30), date(2023, time.April, 30)},
+		},
+		{
+			name:  "monthly on the 29th",
+			rule:  "FREQ=MONTHLY",
+			start: date(2023, time.January, 29),
+			want: []time.Time{
+				date(2023, time.January, 29), date(2023, time.March, 29), date(2023, time.April, 29),
+			},
+		},
+		{
+			name:  "monthly on the 29th in a leap year",
+			rule:  "FREQ=MONTHLY",
+			start: date(2024, time.January, 29),
+			want:  []time.Time{date(2024, time.January, 29), date(2024, time.February, 29), date(2024, time.March, 29)},
+		},
+		{
+			name:  "count ends the series",
+			rule:  "FREQ=DAILY;COUNT=3",
+			start: date(2024, time.March, 1),
+			want:  []time.Time{date(2024, time.March, 1), date(2024, time.March, 2), date(2024, time.March, 3)},
+			ends:  true,
+		},
+		{
+			name:  "until ends the series",
+			rule:  "FREQ=WEEKLY;UNTIL=20240315T090000Z",
+			start: date(2024, time.March, 1),
+			want:  []time.Time{date(2024, time.March, 1), date(2024, time.March, 8), date(2024, time.March, 15)},
+			ends:  true,
+		},
+		{
+			name:  "date-only until includes the whole day",
+			rule:  "FREQ=DAILY;UNTIL=20240302",
+			start: date(2024, time.March, 1),
+			want:  []time.Time{date(2024, time.March, 1), date(2024, time.March, 2)},
+			ends:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			count := len(tt.want)
+			if tt.ends {
+				count += 10
+			}
+			got := series(t, tt.rule, tt.start, count)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("series = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	for _, rule := range []string{
+		"",
+		"INTERVAL=2",
+		"FREQ=YEARLY",
+		"FREQ=DAILY;INTERVAL=0",
+		"FREQ=DAILY;BYDAY=MO",
+		"FREQ=WEEKLY;BYDAY=XX",
+		"FREQ=DAILY;COUNT=2;UNTIL=20240101",
+		"FREQ=DAILY;BYMONTH=1",
+	} {
+		if _, err := Parse(rule); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", rule)
+		}
+	}
+}
+
+// naiveBetween is Between without skipping ahead.
+func naiveBetween(r *Rule, start time.Time, n int, from, to time.Time, limit int) []Occurrence {
+	var occurrences []Occurrence
+	current := start
+	for len(occurrences) < limit {
+		next, ok := r.Next(current, n)
+		if !ok || next.After(to) {
+			break
+		}
+		n++
+		if !next.Before(from) {
+			occurrences = append(occurrences, Occurrence{Number: n, Due: next})
+		}
+		current = next
+	}
+	return occurrences
+}
+
+func TestBetween(t *testing.T) {
+	start := date(2024, time.March, 4) // Monday
+
+	tests := []struct {
+		name     string
+		rule     string
+		from, to time.Time
+		limit    int
+		want     []Occurrence
+	}{
+		{
+			name: "bounds are inclusive",
+			rule: "FREQ=DAILY",
+			from: date(2024, time.March, 6),
+			to:   date(2024, time.March, 8),
+			want: []Occurrence{
+				{3, date(2024, time.March, 6)}, {4, date(2024, time.March, 7)}, {5, date(2024, time.March, 8)},
+			},
+		},
+		{
+			name:  "limit caps the results",
+			rule:  "FREQ=DAILY",
+			from:  date(2024, time.March, 1),
+			to:    date(2024, time.April, 1),
+			limit: 2,
+			want:  []Occurrence{{2, date(2024, time.March, 5)}, {3, date(2024, time.March, 6)}},
+		},
+		{
+			name: "start itself is not included",
+			rule: "FREQ=WEEKLY",
+			from: start,
+			to:   date(2024, time.March, 11),
+			want: []Occurrence{{2, date(2024, time.March, 11)}},
+		},
+		{
+			name: "count ends the series inside the window",
+			rule: "FREQ=DAILY;COUNT=3",
+			from: date(2024, time.March, 1),
+			to:   date(2024, time.March, 31),
+			want: []Occurrence{{2, date(2024, time.March, 5)}, {3, date(2024, time.March, 6)}},
+		},
+		{
+			name: "count ends the series before the window",
+			rule: "FREQ=WEEKLY;BYDAY=MO,FR;COUNT=40",
+			from: date(2030, time.January, 1),
+			to:   date(2030, time.December, 31),
+		},
+		{
+			name: "until ends the series before the window",
+			rule: "FREQ=DAILY;UNTIL=20240310",
+			from: date(2024, time.March, 11),
+			to:   date(2024, time.March, 31),
+		},
+		{
+			name: "far window numbers occurrences from the start",
+			rule: "FREQ=DAILY;INTERVAL=2",
+			from: date(2034, time.March, 1),
+			to:   date(2034, time.March, 4),
+			want: []Occurrence{{1826, date(2034, time.March, 2)}, {1827, date(2034, time.March, 4)}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := Parse(tt.rule)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			limit := tt.limit
+			if limit == 0 {
+				limit = 100
+			}
+			got := r.Between(start, 1, tt.from, tt.to, limit)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Between = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBetweenSkipsAheadLikeStepping(t *testing.T) {
+	rules := []string{
+		"FREQ=DAILY",
+		"FREQ=DAILY;INTERVAL=5",
+		"FREQ=WEEKLY;INTERVAL=3",
+		"FREQ=WEEKLY;BYDAY=MO,WE,FR",
+		"FREQ=WEEKLY;INTERVAL=2;BYDAY=TU,SU",
+		"FREQ=MONTHLY",
+		"FREQ=MONTHLY;INTERVAL=5",
+		"FREQ=DAILY;COUNT=500",
+		"FREQ=WEEKLY;BYDAY=TH;UNTIL=20300101",
+	}
+	starts := []time.Time{
+		date(2024, time.January, 31),
+		date(2023, time.January, 29),
+		date(2024, time.February, 29),
+		date(2024, time.March, 9), // Saturday, off every BYDAY list above
+		date(2024, time.March, 15),
+	}
+	for _, rule := range rules {
+		r, err := Parse(rule)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", rule, err)
+		}
+		for _, start := range starts {
+			for _, from := range []time.Time{
+				start.AddDate(0, 0, 1),
+				start.AddDate(0, 0, 40),
+				start.AddDate(0, 11, 3),
+				start.AddDate(4, 1, 0),
+				start.AddDate(5, 0, 0).Add(-time.Hour),
+			} {
+				to := from.AddDate(0, 3, 0)
+				got := r.Between(start, 1, from, to, 50)
+				want := naiveBetween(r, start, 1, from, to, 50)
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("%s from %v, window %v: Between = %v, stepping gives %v",
+						rule, start.Format("2006-01-02"), from.Format("2006-01-02"), got, want)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,240 @@
+// Package scheduler runs background jobs on one backend instance at a time.
+// Instances elect a leader through a Postgres advisory lock; only the leader
+// runs jobs, and every run is recorded in the job_runs table. A job missed
+// while no instance was leading runs as soon as one takes over.
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	// lockKey identifies the scheduler's advisory lock ("mmtm")
+	lockKey = 0x6d6d746d
+	// electionInterval is how often followers try to become leader and the
+	// leader checks that it still holds the lock
+	electionInterval = 30 * time.Second
+	// retryDelay is how soon a failed job runs again
+	retryDelay = 5 * time.Minute
+	// runRetention is how long job runs are kept
+	runRetention = 30 * 24 * time.Hour
+)
+
+// Schedule decides when a job runs next after a run that started at after.
+type Schedule interface {
+	Next(after time.Time) time.Time
+}
+
+type every time.Duration
+
+// Every runs a job at a fixed interval.
+func Every(interval time.Duration) Schedule {
+	return every(interval)
+}
+
+func (e every) Next(after time.Time) time.Time {
+	return after.Add(time.Duration(e))
+}
+
+type daily struct {
+	hour, minute int
+}
+
+// Daily runs a job once a day at the given UTC time.
+func Daily(hour, minute int) Schedule {
+	return daily{hour: hour, minute: minute}
+}
+
+func (d daily) Next(after time.Time) time.Time {
+	after = after.UTC()
+	next := time.Date(after.Year(), after.Month(), after.Day(), d.hour, d.minute, 0, 0, time.UTC)
+	if !next.After(after) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// Job is a named task run on a schedule. Run returns a short summary that is
+// recorded with the run.
+type Job struct {
+	Name     string
+	Schedule Schedule
+	Run      func(ctx context.Context) (string, error)
+}
+
+type Scheduler struct {
+	db       *sql.DB
+	jobs     []Job
+	instance string
+}
+
+func New(db *sql.DB) *Scheduler {
+	instance, err := os.Hostname()
+	if err != nil {
+		instance = "unknown"
+	}
+	return &Scheduler{db: db, instance: instance}
+}
+
+// Add registers a job. Jobs must be added before Run.
+func (s *Scheduler) Add(job Job) {
+	s.jobs = append(s.jobs, job)
+}
+
+// Run takes part in leader election and runs jobs while leading. It returns
+// once ctx is cancelled and the job in progress, if any, has finished.
+func (s *Scheduler) Run(ctx context.Context) {
+	if len(s.jobs) == 0 {
+		return
+	}
+	for {
+		if err := s.lead(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Scheduler: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(electionInterval):
+		}
+	}
+}
+
+// lead runs jobs for as long as this instance holds the advisory lock. The
+// lock belongs to one connection, so losing the connection hands leadership
+// to another instance.
+func (s *Scheduler) lead(ctx context.Context) error {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var leader bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", lockKey).Scan(&leader); err != nil {
+		return err
+	}
+	if !leader {
+		return nil
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", lockKey)
+	log.Printf("Scheduler: %s is leading", s.instance)
+
+	// Runs left unfinished by a previous leader were cut short
+	_, err = s.db.ExecContext(ctx, `
+		UPDATE job_runs SET status = 'failed', error = 'interrupted', finished_at = CURRENT_TIMESTAMP
+		WHERE status = 'running'`)
+	if err != nil {
+		return err
+	}
+
+	next, err := s.nextRuns(ctx)
+	if err != nil {
+		return err
+	}
+
+	for {
+		job := s.jobs[0]
+		for _, j := range s.jobs[1:] {
+			if next[j.Name].Before(next[job.Name]) {
+				job = j
+			}
+		}
+
+		wait := time.Until(next[job.Name])
+		if wait > electionInterval {
+			wait = electionInterval
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+
+		if time.Now().Before(next[job.Name]) {
+			if err := conn.PingContext(ctx); err != nil {
+				return err
+			}
+			continue
+		}
+
+		started := time.Now()
+		if s.runJob(ctx, job) {
+			next[job.Name] = job.Schedule.Next(started)
+		} else {
+			next[job.Name] = started.Add(retryDelay)
+		}
+	}
+}
+
+// nextRuns schedules each job after its last successful run. Jobs that never
+// ran are due now.
+func (s *Scheduler) nextRuns(ctx context.Context) (map[string]time.Time, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT job, MAX(started_at) FROM job_runs
+		WHERE status = 'succeeded'
+		GROUP BY job`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lastRuns := make(map[string]time.Time)
+	for rows.Next() {
+		var job string
+		var started time.Time
+		if err := rows.Scan(&job, &started); err != nil {
+			return nil, err
+		}
+		lastRuns[job] = started
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	next := make(map[string]time.Time, len(s.jobs))
+	for _, job := range s.jobs {
+		if last, ok := lastRuns[job.Name]; ok {
+			next[job.Name] = job.Schedule.Next(last)
+		} else {
+			next[job.Name] = time.Now()
+		}
+	}
+	return next, nil
+}
+
+// runJob runs a job, records the run and reports whether it succeeded.
+func (s *Scheduler) runJob(ctx context.Context, job Job) bool {
+	var runID int
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO job_runs (job, instance, status) VALUES ($1, $2, 'running')
+		RETURNING id`, job.Name, s.instance).Scan(&runID)
+	if err != nil {
+		log.Printf("Scheduler: failed to record %s run: %v", job.Name, err)
+		return false
+	}
+
+	result, runErr := job.Run(ctx)
+	status, errText := "succeeded", ""
+	if runErr != nil {
+		status, errText = "failed", runErr.Error()
+		log.Printf("Scheduler: %s failed: %v", job.Name, runErr)
+	}
+
+	// Record the outcome even if shutdown began while the job ran
+	_, err = s.db.Exec(`
+		UPDATE job_runs SET status = $1, result = $2, error = $3, finished_at = CURRENT_TIMESTAMP
+		WHERE id = $4`, status, result, errText, runID)
+	if err != nil {
+		log.Printf("Scheduler: failed to record %s run: %v", job.Name, err)
+	}
+	_, err = s.db.Exec("DELETE FROM job_runs WHERE job = $1 AND started_at < $2",
+		job.Name, time.Now().Add(-runRetention))
+	if err != nil {
+		log.Printf("Scheduler: failed to prune %s runs: %v", job.Name, err)
+	}
+	return runErr == nil
+}
@@ -0,0 +1,108 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 key of the RFC 6238 test vectors, "12345678901234567890".
+var rfcSecret = encoding.EncodeToString([]byte("12345678901234567890"))
+
+// The RFC 6238 (appendix B) SHA1 vectors, cut to the last six digits.
+var rfcVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestGenerateMatchesRFC6238(t *testing.T) {
+	key := []byte("12345678901234567890")
+	for _, v := range rfcVectors {
+		if got := generate(key, v.unix/int64(Period.Seconds())); got != v.code {
+			t.Errorf("code at %d = %s, want %s", v.unix, got, v.code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, v := range rfcVectors {
+		at := time.Unix(v.unix, 0)
+		step, ok := Validate(rfcSecret, v.code, at)
+		if !ok || step != v.unix/30 {
+			t.Errorf("Validate(%s at %d) = %d, %v, want step %d", v.code, v.unix, step, ok, v.unix/30)
+		}
+	}
+
+	at := time.Unix(1111111111, 0)
+	if _, ok := Validate(strings.ToLower(rfcSecret), "050471", at); !ok {
+		t.Error("lower-case secret refused")
+	}
+	if _, ok := Validate(rfcSecret, "050 471", at); !ok {
+		t.Error("code with a space refused")
+	}
+	for _, code := range []string{"050472", "05047", "0504711", ""} {
+		if _, ok := Validate(rfcSecret, code, at); ok {
+			t.Errorf("Validate(%q) accepted", code)
+		}
+	}
+	if _, ok := Validate("not base32!", "050471", at); ok {
+		t.Error("invalid secret accepted")
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	key := []byte("12345678901234567890")
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / 30
+
+	tests := []struct {
+		offset int64
+		ok     bool
+	}{
+		{-2, false},
+		{-1, true},
+		{0, true},
+		{1, true},
+		{2, false},
+	}
+	for _, tt := range tests {
+		code := generate(key, current+tt.offset)
+		step, ok := Validate(rfcSecret, code, now)
+		if ok != tt.ok {
+			t.Errorf("code %d steps away: accepted = %v, want %v", tt.offset, ok, tt.ok)
+		}
+		if ok && step != current+tt.offset {
+			t.Errorf("code %d steps away: step = %d, want %d", tt.offset, step, current+tt.offset)
+		}
+	}
+}
+
+func TestValidateOnceRefusesReplay(t *testing.T) {
+	key := []byte("12345678901234567890")
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / 30
+	code := generate(key, current)
+
+	step, ok := ValidateOnce(rfcSecret, code, now, 0)
+	if !ok || step != current {
+		t.Fatalf("first use = %d, %v, want step %d", step, ok, current)
+	}
+	if _, ok := ValidateOnce(rfcSecret, code, now, step); ok {
+		t.Error("same code accepted twice")
+	}
+	// Nor is an older code still inside the skew window
+	if _, ok := ValidateOnce(rfcSecret, generate(key, current-1), now, step); ok {
+		t.Error("code from before the last used step accepted")
+	}
+	next := generate(key, current+1)
+	if got, ok := ValidateOnce(rfcSecret, next, now.Add(Period), step); !ok || got != current+1 {
+		t.Errorf("next step = %d, %v, want %d", got, ok, current+1)
+	}
+}